@@ -0,0 +1,479 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// subjectKeyPrefix is the prefix of store keys holding the sessions index of the subject
+	subjectKeyPrefix = "subject:"
+	// sidKeyPrefix is the prefix of store keys mapping the provider session to the subject
+	sidKeyPrefix = "sid:"
+	// revokedKeyPrefix is the prefix of store keys holding the revoked access tokens
+	revokedKeyPrefix = "revoked:"
+	// sessionKindServer is the session kept in the store as server side session
+	sessionKindServer = "server"
+	// sessionKindRefresh is the refresh token kept in the store
+	sessionKindRefresh = "refresh"
+	// subjectLockKeyPrefix is the prefix of store keys locking the update of the sessions index
+	subjectLockKeyPrefix = "subject-lock:"
+	// sessionIndexLockTTL bounds how long the sessions index is locked by single update
+	sessionIndexLockTTL = 10 * time.Second
+	// sessionIndexPollInterval is how often the update waiting for the lock tries again
+	sessionIndexPollInterval = 10 * time.Millisecond
+)
+
+var errSessionIndexLockTimeout = errors.New("timed out waiting for the lock of the sessions index")
+
+// sessionRecord is an entry of the subject sessions index
+type sessionRecord struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key,omitempty"`
+	Kind      string    `json:"kind"`
+	SID       string    `json:"sid,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// expired checks if the record has expired, zero expiration means no expiration
+func (s *sessionRecord) expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && now.After(s.ExpiresAt)
+}
+
+// getSubjectKey returns the store key of the subject sessions index
+func getSubjectKey(subject string) string {
+	return subjectKeyPrefix + utils.GetHashKey(subject)
+}
+
+// getSidKey returns the store key holding the subject of the provider session
+func getSidKey(sid string) string {
+	return sidKeyPrefix + utils.GetHashKey(sid)
+}
+
+// getRevokedKey returns the store key marking the access token as revoked
+func getRevokedKey(token string) string {
+	return revokedKeyPrefix + utils.GetHashKey(token)
+}
+
+// getSessionRecordID returns the url safe identifier of the record, store keys are
+// not exposed by the api
+func getSessionRecordID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// useSessionIndex checks if the sessions of the subjects are indexed in the store
+func (r *oauthProxy) useSessionIndex() bool {
+	return r.config.EnableSessionsAdmin || r.config.EnableBackchannelLogout
+}
+
+// loadSessionIndex retrieves the not expired sessions of the subject
+func (r *oauthProxy) loadSessionIndex(subject string) ([]*sessionRecord, error) {
+	content, err := r.store.Get(getSubjectKey(subject))
+
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*sessionRecord{}
+
+	if content == "" {
+		return records, nil
+	}
+
+	var stored []*sessionRecord
+
+	if err := json.Unmarshal([]byte(content), &stored); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	for _, record := range stored {
+		if !record.expired(now) {
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// saveSessionIndex writes the sessions of the subject, the index lives as long
+// as the longest living session
+func (r *oauthProxy) saveSessionIndex(subject string, records []*sessionRecord) error {
+	if len(records) == 0 {
+		return r.store.Delete(getSubjectKey(subject))
+	}
+
+	var expiration time.Duration
+
+	for _, record := range records {
+		if record.ExpiresAt.IsZero() {
+			expiration = 0
+			break
+		}
+
+		if remaining := time.Until(record.ExpiresAt); remaining > expiration {
+			expiration = remaining
+		}
+	}
+
+	content, err := json.Marshal(records)
+
+	if err != nil {
+		return err
+	}
+
+	return r.store.Set(getSubjectKey(subject), string(content), expiration)
+}
+
+// lockSessionIndex takes the lock of the subject sessions index in the store, the index is
+// updated by all the instances sharing the store, the lock expires by itself when the
+// instance holding it dies
+func (r *oauthProxy) lockSessionIndex(subject string) (func(), error) {
+	key := subjectLockKeyPrefix + utils.GetHashKey(subject)
+	deadline := time.Now().Add(sessionIndexLockTTL)
+
+	for {
+		acquired, err := r.store.SetNX(key, "true", sessionIndexLockTTL)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if acquired {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errSessionIndexLockTimeout
+		}
+
+		time.Sleep(sessionIndexPollInterval)
+	}
+
+	return func() {
+		if err := r.store.Delete(key); err != nil {
+			r.log.Warn("failed to release the sessions index lock", zap.Error(err))
+		}
+	}, nil
+}
+
+// addSessionToIndex records the session of the subject, existing record with the same
+// key only gets the new expiration
+func (r *oauthProxy) addSessionToIndex(subject, sid, kind, key string, expiration time.Duration) error {
+	if !r.useSessionIndex() || subject == "" {
+		return nil
+	}
+
+	unlock, err := r.lockSessionIndex(subject)
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	records, err := r.loadSessionIndex(subject)
+
+	if err != nil {
+		return err
+	}
+
+	var expiresAt time.Time
+
+	if expiration > 0 {
+		expiresAt = time.Now().Add(expiration)
+	}
+
+	found := false
+
+	for _, record := range records {
+		if record.Key == key {
+			record.ExpiresAt = expiresAt
+			found = true
+		}
+	}
+
+	if !found {
+		records = append(records, &sessionRecord{
+			ID:        getSessionRecordID(key),
+			Key:       key,
+			Kind:      kind,
+			SID:       sid,
+			CreatedAt: time.Now(),
+			ExpiresAt: expiresAt,
+		})
+	}
+
+	if err := r.saveSessionIndex(subject, records); err != nil {
+		return err
+	}
+
+	if sid != "" {
+		return r.store.Set(getSidKey(sid), subject, expiration)
+	}
+
+	return nil
+}
+
+// removeSessionFromIndex removes the session from the subject index
+func (r *oauthProxy) removeSessionFromIndex(subject, key string) error {
+	if !r.useSessionIndex() || subject == "" {
+		return nil
+	}
+
+	unlock, err := r.lockSessionIndex(subject)
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	records, err := r.loadSessionIndex(subject)
+
+	if err != nil {
+		return err
+	}
+
+	kept := make([]*sessionRecord, 0, len(records))
+
+	for _, record := range records {
+		if record.Key != key {
+			kept = append(kept, record)
+		}
+	}
+
+	return r.saveSessionIndex(subject, kept)
+}
+
+// revokeSession removes the session from the store, optionally revokes the refresh token
+// at the provider and denies further use of the access token until it would have expired
+func (r *oauthProxy) revokeSession(subject string, record *sessionRecord, revokeAtProvider bool) error {
+	var accessKey, refreshToken string
+
+	switch record.Kind {
+	case sessionKindServer:
+		session, err := r.loadServerSessionByKey(record.Key)
+
+		if err != nil && err != apperrors.ErrNoSessionStateFound {
+			return err
+		}
+
+		if session != nil {
+			accessKey = getRevokedKey(session.AccessToken)
+			refreshToken = session.RefreshToken
+		}
+	default:
+		// the refresh token is stored under hash of the access token
+		accessKey = revokedKeyPrefix + record.Key
+
+		encrypted, err := r.store.Get(record.Key)
+
+		if err != nil {
+			return err
+		}
+
+		if encrypted != "" {
+			if refreshToken, err = encryption.DecodeText(encrypted, r.config.EncryptionKey); err != nil {
+				return apperrors.ErrDecryption
+			}
+		}
+	}
+
+	if accessKey != "" {
+		var expiration time.Duration
+
+		if !record.ExpiresAt.IsZero() {
+			expiration = time.Until(record.ExpiresAt)
+		}
+
+		if err := r.store.Set(accessKey, "true", expiration); err != nil {
+			return err
+		}
+
+		r.forgetVerifiedIdentity(strings.TrimPrefix(accessKey, revokedKeyPrefix))
+	}
+
+	if err := r.store.Delete(record.Key); err != nil {
+		return err
+	}
+
+	if revokeAtProvider && refreshToken != "" {
+		issuer := r.getTokenIssuer(refreshToken)
+
+		if err := r.revokeToken(issuer, r.getRevocationURL(issuer), refreshToken); err != nil {
+			r.log.Warn(
+				"unable to revoke the refresh token at the provider",
+				zap.Error(err),
+				zap.String("sub", subject),
+			)
+		}
+	}
+
+	return r.removeSessionFromIndex(subject, record.Key)
+}
+
+// isTokenRevoked checks if the access token was revoked through the sessions admin api
+func (r *oauthProxy) isTokenRevoked(token string) (bool, error) {
+	return r.store.Exists(getRevokedKey(token))
+}
+
+// adminSessionsAuthMiddleware permits only bearer tokens holding the admin roles
+func (r *oauthProxy) adminSessionsAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		token, err := utils.GetTokenInBearer(req)
+
+		if err != nil {
+			wrt.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// step: the token is verified by the issuer found in its iss claim
+		issuer := r.getTokenIssuer(token)
+
+		if _, err := r.newAccessTokenVerifier(issuer).Verify(context.Background(), token); err != nil {
+			r.log.Warn("sessions admin token failed verification", zap.Error(err))
+			wrt.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		webToken, err := jwt.ParseSigned(token)
+
+		if err != nil {
+			wrt.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		user, err := extractIdentity(webToken)
+
+		if err != nil {
+			wrt.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		user.issuer = issuer
+		r.mapIdentityClaims(user)
+
+		if !utils.HasAccess(r.config.SessionsAdminRoles, user.roles, true) {
+			r.log.Warn(
+				"access to sessions admin api denied",
+				zap.String("sub", user.id),
+				zap.Strings("required", r.config.SessionsAdminRoles),
+			)
+			wrt.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(wrt, req)
+	})
+}
+
+// sessionsListHandler returns the active sessions of the subject
+func (r *oauthProxy) sessionsListHandler(wrt http.ResponseWriter, req *http.Request) {
+	//nolint:contextcheck
+	subject := chi.URLParam(req, "sub")
+	records, err := r.loadSessionIndex(subject)
+
+	if err != nil {
+		r.log.Error("unable to retrieve the sessions", zap.Error(err), zap.String("sub", subject))
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, record := range records {
+		record.Key = ""
+	}
+
+	content, err := json.Marshal(records)
+
+	if err != nil {
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	wrt.Header().Set("Content-Type", "application/json")
+	wrt.WriteHeader(http.StatusOK)
+	_, _ = wrt.Write(content)
+}
+
+// sessionsRevokeHandler revokes all sessions of the subject, or single one when
+// the session id is given
+func (r *oauthProxy) sessionsRevokeHandler(wrt http.ResponseWriter, req *http.Request) {
+	//nolint:contextcheck
+	subject := chi.URLParam(req, "sub")
+	//nolint:contextcheck
+	sessionID := chi.URLParam(req, "id")
+
+	records, err := r.loadSessionIndex(subject)
+
+	if err != nil {
+		r.log.Error("unable to retrieve the sessions", zap.Error(err), zap.String("sub", subject))
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	revoked := 0
+
+	for _, record := range records {
+		if sessionID != "" && record.ID != sessionID {
+			continue
+		}
+
+		if err := r.revokeSession(subject, record, true); err != nil {
+			r.log.Error(
+				"unable to revoke the session",
+				zap.Error(err),
+				zap.String("sub", subject),
+				zap.String("session", record.ID),
+			)
+			wrt.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		revoked++
+	}
+
+	if sessionID != "" && revoked == 0 {
+		wrt.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	r.log.Info(
+		"revoked the sessions of the user",
+		zap.String("sub", subject),
+		zap.Int("count", revoked),
+	)
+
+	wrt.WriteHeader(http.StatusNoContent)
+}
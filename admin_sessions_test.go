@@ -0,0 +1,278 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/gogatekeeper/gatekeeper/pkg/storage"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeSessionsSubject = "1e11e539-8256-4b3b-bda8-cc0d56cddb48"
+
+func newFakeSessionsAdminConfig() *Config {
+	cfg := newFakeServerSessionConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EnableSessionsAdmin = true
+	cfg.SessionsAdminRoles = []string{fakeAdminRole}
+	cfg.NoRedirects = true
+
+	return cfg
+}
+
+func doSessionsAdminRequest(t *testing.T, proxy *fakeProxy, method, uri, token string) *http.Response {
+	req, err := http.NewRequest(method, proxy.getServiceURL()+proxy.config.WithOAuthURI(uri), nil)
+	assert.NoError(t, err)
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+
+	return resp
+}
+
+func TestSessionsIndex(t *testing.T) {
+	cfg := newFakeSessionsAdminConfig()
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	assert.NoError(t, proxy.proxy.addSessionToIndex("sub", "", sessionKindServer, "key1", time.Hour))
+	assert.NoError(t, proxy.proxy.addSessionToIndex("sub", "", sessionKindRefresh, "key2", time.Millisecond))
+	assert.NoError(t, proxy.proxy.addSessionToIndex("sub", "", sessionKindServer, "key1", 2*time.Hour))
+
+	time.Sleep(5 * time.Millisecond)
+
+	records, err := proxy.proxy.loadSessionIndex("sub")
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "key1", records[0].Key)
+	assert.Equal(t, getSessionRecordID("key1"), records[0].ID)
+	assert.True(t, records[0].ExpiresAt.After(time.Now().Add(time.Hour)))
+
+	assert.NoError(t, proxy.proxy.removeSessionFromIndex("sub", "key1"))
+
+	records, err = proxy.proxy.loadSessionIndex("sub")
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+
+	// index is not maintained unless the admin api is enabled
+	proxy.proxy.config.EnableSessionsAdmin = false
+	assert.NoError(t, proxy.proxy.addSessionToIndex("sub", "", sessionKindServer, "key1", time.Hour))
+
+	records, err = proxy.proxy.loadSessionIndex("sub")
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+// slowReadStore delays the values read from the store
+type slowReadStore struct {
+	storage.Storage
+	delay time.Duration
+}
+
+func (s *slowReadStore) Get(key string) (string, error) {
+	value, err := s.Storage.Get(key)
+	time.Sleep(s.delay)
+
+	return value, err
+}
+
+func TestSessionsIndexSharedByInstances(t *testing.T) {
+	first := newFakeProxy(newFakeSessionsAdminConfig(), &fakeAuthConfig{})
+	defer first.idp.Close()
+
+	second := newFakeProxy(newFakeSessionsAdminConfig(), &fakeAuthConfig{})
+	defer second.idp.Close()
+
+	// step: both instances update the index of the subject in the same store, the reads are
+	// slow enough for the updates to overlap
+	store := &slowReadStore{Storage: first.proxy.store, delay: 2 * time.Millisecond}
+	first.proxy.store = store
+	second.proxy.store = store
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		for _, proxy := range []*fakeProxy{first, second} {
+			wg.Add(1)
+
+			go func(proxy *fakeProxy, key string) {
+				defer wg.Done()
+				assert.NoError(t, proxy.proxy.addSessionToIndex("sub", "", sessionKindServer, key, time.Hour))
+			}(proxy, fmt.Sprintf("%p-%d", proxy, i))
+		}
+	}
+
+	wg.Wait()
+
+	records, err := first.proxy.loadSessionIndex("sub")
+	assert.NoError(t, err)
+	assert.Len(t, records, 40)
+
+	locked, err := first.proxy.store.Exists(subjectLockKeyPrefix + utils.GetHashKey("sub"))
+	assert.NoError(t, err)
+	assert.False(t, locked)
+}
+
+func TestSessionsAdminAPI(t *testing.T) {
+	cfg := newFakeSessionsAdminConfig()
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	// step: server side session of the user
+	userToken, err := newTestToken(proxy.idp.getLocation()).getToken()
+	assert.NoError(t, err)
+
+	refreshToken, err := newTestToken(proxy.idp.getLocation()).getToken()
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	session, _ := proxy.proxy.newServerSession(userToken, refreshToken, "", time.Hour)
+	assert.NoError(t, proxy.proxy.createServerSession(
+		httptest.NewRequest(http.MethodGet, "/", nil),
+		recorder,
+		fakeSessionsSubject,
+		"",
+		session,
+		time.Hour,
+	))
+	sessionCookie := recorder.Result().Cookies()[0]
+
+	// step: refresh token of the user kept in the store
+	bearerToken := newTestToken(proxy.idp.getLocation())
+	bearerToken.claims.Jti = "bearer"
+	rawBearer, err := bearerToken.getToken()
+	assert.NoError(t, err)
+
+	encrypted, err := encryption.EncodeText(refreshToken, cfg.EncryptionKey)
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.proxy.StoreRefreshToken(rawBearer, encrypted, time.Hour))
+	assert.NoError(t, proxy.proxy.addSessionToIndex(
+		fakeSessionsSubject,
+		"",
+		sessionKindRefresh,
+		utils.GetHashKey(rawBearer),
+		time.Hour,
+	))
+
+	adminToken := newTestToken(proxy.idp.getLocation())
+	adminToken.addRealmRoles([]string{fakeAdminRole})
+	rawAdmin, err := adminToken.getToken()
+	assert.NoError(t, err)
+
+	uri := "/sessions/" + fakeSessionsSubject
+
+	resp := doSessionsAdminRequest(t, proxy, http.MethodGet, uri, "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = doSessionsAdminRequest(t, proxy, http.MethodGet, uri, userToken)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = doSessionsAdminRequest(t, proxy, http.MethodGet, uri, rawAdmin)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var records []*sessionRecord
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&records))
+	resp.Body.Close()
+	assert.Len(t, records, 2)
+
+	for _, record := range records {
+		assert.Empty(t, record.Key)
+	}
+
+	resp = doSessionsAdminRequest(t, proxy, http.MethodDelete, uri+"/unknown", rawAdmin)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// step: revoke the server side session only
+	resp = doSessionsAdminRequest(
+		t,
+		proxy,
+		http.MethodDelete,
+		uri+"/"+getSessionRecordID(getSessionKey(sessionCookie.Value)),
+		rawAdmin,
+	)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, proxy.getServiceURL()+"/auth_all/test", nil)
+	assert.NoError(t, err)
+	req.AddCookie(sessionCookie)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	revoked, err := proxy.proxy.isTokenRevoked(userToken)
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+
+	// step: bearer token still works until all sessions are revoked
+	req, err = http.NewRequest(http.MethodGet, proxy.getServiceURL()+"/auth_all/test", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+rawBearer)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doSessionsAdminRequest(t, proxy, http.MethodDelete, uri, rawAdmin)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	refresh, err := proxy.proxy.store.Get(utils.GetHashKey(rawBearer))
+	assert.NoError(t, err)
+	assert.Empty(t, refresh)
+
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = doSessionsAdminRequest(t, proxy, http.MethodGet, uri, rawAdmin)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&records))
+	resp.Body.Close()
+	assert.Empty(t, records)
+}
+
+func TestSessionsAdminAPIWithPartnerToken(t *testing.T) {
+	partner := newFakeAuthServer(&fakeAuthConfig{})
+	defer partner.Close()
+
+	cfg := newFakeSessionsAdminConfig()
+	cfg.Issuers = []*IssuerConfig{newFakePartnerIssuer(partner)}
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	// step: the partner roles are mapped with the claim mapping of the partner issuer
+	token, err := newTestToken(partner.getLocation()).getToken(
+		map[string]interface{}{"roles": []interface{}{"admin"}},
+	)
+	assert.NoError(t, err)
+
+	resp := doSessionsAdminRequest(t, proxy, http.MethodGet, "/sessions/"+fakeSessionsSubject, token)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// apiKeyPrefix is the prefix of store keys holding the identities of the api keys
+const apiKeyPrefix = "apikey:"
+
+// apiKeyIdentity is the identity of the caller the api key is issued to
+type apiKeyIdentity struct {
+	// Hash is the hex encoded sha256 of the api key
+	Hash    string                 `json:"hash" yaml:"hash"`
+	Subject string                 `json:"subject" yaml:"subject"`
+	Name    string                 `json:"name" yaml:"name"`
+	Email   string                 `json:"email" yaml:"email"`
+	Roles   []string               `json:"roles" yaml:"roles"`
+	Groups  []string               `json:"groups" yaml:"groups"`
+	Claims  map[string]interface{} `json:"claims" yaml:"claims"`
+}
+
+// apiKeyProvider holds the identities of the api keys in the key file, the file is reloaded
+// when it changes
+type apiKeyProvider struct {
+	sync.RWMutex
+	// file is the path of the key file
+	file string
+	// identities are the identities keyed by the hash of the api key
+	identities map[string]*apiKeyIdentity
+	// target is the file the key file resolves to, the mounted config maps swap the symlinks
+	target string
+	// watcher watches the directory of the key file
+	watcher *fsnotify.Watcher
+	// the logger for this service
+	log *zap.Logger
+}
+
+// getAPIKeyHash returns the hex encoded sha256 of the api key
+func getAPIKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeyProvider loads the identities of the api keys from the key file
+func newAPIKeyProvider(file string, log *zap.Logger) (*apiKeyProvider, error) {
+	provider := &apiKeyProvider{file: path.Clean(file), log: log}
+
+	if err := provider.load(); err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+// load reads the key file, the identities are replaced only when the whole file is valid
+func (p *apiKeyProvider) load() error {
+	content, err := ioutil.ReadFile(p.file)
+
+	if err != nil {
+		return err
+	}
+
+	var entries []*apiKeyIdentity
+
+	if err := yaml.Unmarshal(content, &entries); err != nil {
+		return fmt.Errorf("unable to parse the api keys file: %w", err)
+	}
+
+	identities := make(map[string]*apiKeyIdentity, len(entries))
+
+	for idx, entry := range entries {
+		if entry.Hash == "" || entry.Subject == "" {
+			return fmt.Errorf("api key %d in the api keys file must have hash and subject", idx)
+		}
+
+		if _, found := identities[entry.Hash]; found {
+			return fmt.Errorf("api key of %s is in the api keys file more than once", entry.Subject)
+		}
+
+		// step: the claims are used as the claims decoded from the json tokens
+		for name, value := range entry.Claims {
+			entry.Claims[name] = normalizeYAMLValue(value)
+		}
+
+		identities[entry.Hash] = entry
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.identities = identities
+
+	return nil
+}
+
+// normalizeYAMLValue converts the yaml maps, which have keys of any type, into the json maps
+// with string keys
+func normalizeYAMLValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(value))
+
+		for key, item := range value {
+			normalized[fmt.Sprint(key)] = normalizeYAMLValue(item)
+		}
+
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(value))
+
+		for idx, item := range value {
+			normalized[idx] = normalizeYAMLValue(item)
+		}
+
+		return normalized
+	default:
+		return value
+	}
+}
+
+// get returns the identity of the api key hash, nil when there is none
+func (p *apiKeyProvider) get(hash string) *apiKeyIdentity {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.identities[hash]
+}
+
+// watch reloads the key file on changes, the current keys are kept when the file is invalid
+func (p *apiKeyProvider) watch() error {
+	p.log.Info("adding a file watch on the api keys file", zap.String("file", p.file))
+
+	watcher, err := fsnotify.NewWatcher()
+
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(path.Dir(p.file)); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("unable to add watch on directory: %s, error: %s", path.Dir(p.file), err)
+	}
+
+	p.watcher = watcher
+	p.target, _ = filepath.EvalSymlinks(p.file)
+
+	go func() {
+		for {
+			select {
+			case event, found := <-watcher.Events:
+				if !found {
+					return
+				}
+
+				if !p.isChanged(event) {
+					continue
+				}
+
+				if err := p.load(); err != nil {
+					p.log.Error(
+						"unable to reload the api keys file, keeping the current keys",
+						zap.String("file", p.file),
+						zap.Error(err),
+					)
+					continue
+				}
+
+				p.log.Info("reloaded the api keys file", zap.String("file", p.file))
+			case err, found := <-watcher.Errors:
+				if !found {
+					return
+				}
+
+				p.log.Error("received an error from the file watcher", zap.Error(err))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// isChanged checks if the event in the directory changes the key file, either the file itself
+// or the symlinks it resolves through, e.g. the ..data symlink of the mounted config map
+func (p *apiKeyProvider) isChanged(event fsnotify.Event) bool {
+	if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+		return false
+	}
+
+	target, _ := filepath.EvalSymlinks(p.file)
+	changed := event.Name == p.file || target != p.target
+	p.target = target
+
+	return changed
+}
+
+// close stops watching the key file
+func (p *apiKeyProvider) close() error {
+	if p.watcher == nil {
+		return nil
+	}
+
+	return p.watcher.Close()
+}
+
+// getAPIKeyIdentity returns the identity of the api key, from the key file or the store
+func (r *oauthProxy) getAPIKeyIdentity(key string) (*userContext, error) {
+	hash := getAPIKeyHash(key)
+
+	var identity *apiKeyIdentity
+
+	if r.apiKeys != nil {
+		identity = r.apiKeys.get(hash)
+	}
+
+	if identity == nil && r.store != nil {
+		content, err := r.store.Get(apiKeyPrefix + hash)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if content != "" {
+			identity = &apiKeyIdentity{}
+
+			if err := json.Unmarshal([]byte(content), identity); err != nil {
+				return nil, fmt.Errorf("unable to parse the api key identity: %w", err)
+			}
+		}
+	}
+
+	if identity == nil || identity.Subject == "" {
+		return nil, apperrors.ErrInvalidAPIKey
+	}
+
+	claims := make(map[string]interface{}, len(identity.Claims)+1)
+
+	for name, value := range identity.Claims {
+		claims[name] = value
+	}
+
+	claims["sub"] = identity.Subject
+	name := utils.DefaultTo(identity.Name, identity.Subject)
+
+	return &userContext{
+		id:            identity.Subject,
+		name:          name,
+		preferredName: name,
+		email:         identity.Email,
+		roles:         identity.Roles,
+		groups:        identity.Groups,
+		scopes:        getTokenScopes(claims),
+		claims:        claims,
+		bearerToken:   true,
+		apiKey:        true,
+	}, nil
+}
@@ -0,0 +1,247 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const (
+	fakeAPIKey      = "cron-secret-key"
+	fakeAdminAPIKey = "admin-secret-key"
+)
+
+// writeAPIKeysFile writes the key file with the identities of the fake api keys
+func writeAPIKeysFile(t *testing.T, file string, keys ...string) {
+	content := ""
+
+	for _, key := range keys {
+		content += fmt.Sprintf(`- hash: %s
+  subject: %s
+  name: %s-job
+  email: %s@example.com
+  roles:
+  - %s
+  groups:
+  - jobs
+  claims:
+    team: reporting
+`, getAPIKeyHash(key), key, key, key, fakeTestRole)
+	}
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+}
+
+func TestAPIKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "api-keys.yaml")
+	writeAPIKeysFile(t, file, fakeAPIKey)
+
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableAPIKeys = true
+	cfg.APIKeyHeader = "X-API-Key"
+	cfg.APIKeysFile = file
+	cfg.AddClaims = []string{"team"}
+	cfg.EnableTokenHeader = true
+	cfg.EnableAuthorizationHeader = true
+
+	requests := []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			Headers:       map[string]string{"X-API-Key": fakeAPIKey},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Auth-Subject":  fakeAPIKey,
+				"X-Auth-Username": fakeAPIKey + "-job",
+				"X-Auth-Email":    fakeAPIKey + "@example.com",
+				"X-Auth-Roles":    fakeTestRole,
+				"X-Auth-Groups":   "jobs",
+				"X-Auth-Team":     "reporting",
+			},
+			ExpectedNoProxyHeaders: []string{"X-API-Key", "Authorization", "X-Auth-Token", "X-Auth-ExpiresIn"},
+		},
+		{
+			URI:           fakeTestRoleURL,
+			Headers:       map[string]string{"X-API-Key": fakeAPIKey},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          fakeAdminRoleURL,
+			Headers:      map[string]string{"X-API-Key": fakeAPIKey},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          fakeAuthAllURL,
+			Headers:      map[string]string{"X-API-Key": "unknown"},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+
+	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
+func TestAPIKeysInStore(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableAPIKeys = true
+	cfg.APIKeyHeader = "X-API-Key"
+	cfg.StoreURL = "memory://"
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	identity := fmt.Sprintf(`{"subject": "store-job", "roles": [%q]}`, fakeAdminRole)
+	err := proxy.proxy.store.Set(apiKeyPrefix+getAPIKeyHash(fakeAdminAPIKey), identity, 0)
+	assert.NoError(t, err)
+
+	proxy.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAdminRoleURL,
+			Headers:       map[string]string{"X-API-Key": fakeAdminAPIKey},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Auth-Subject": "store-job",
+			},
+		},
+		{
+			URI:          fakeAdminRoleURL,
+			Headers:      map[string]string{"X-API-Key": fakeAPIKey},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	})
+}
+
+func TestAPIKeysFileReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "api-keys.yaml")
+	writeAPIKeysFile(t, file, fakeAPIKey)
+
+	provider, err := newAPIKeyProvider(file, zap.NewNop())
+	assert.NoError(t, err)
+	assert.NoError(t, provider.watch())
+	defer provider.close()
+	assert.NotNil(t, provider.get(getAPIKeyHash(fakeAPIKey)))
+	assert.Nil(t, provider.get(getAPIKeyHash(fakeAdminAPIKey)))
+
+	writeAPIKeysFile(t, file, fakeAdminAPIKey)
+
+	assert.Eventually(
+		t,
+		func() bool { return provider.get(getAPIKeyHash(fakeAdminAPIKey)) != nil },
+		5*time.Second,
+		10*time.Millisecond,
+	)
+	assert.Nil(t, provider.get(getAPIKeyHash(fakeAPIKey)))
+
+	// step: invalid file does not drop the current keys
+	assert.NoError(t, ioutil.WriteFile(file, []byte("- subject: no-hash\n"), 0600))
+	assert.Error(t, provider.load())
+	assert.NotNil(t, provider.get(getAPIKeyHash(fakeAdminAPIKey)))
+}
+
+func TestAPIKeysFileReloadConfigMap(t *testing.T) {
+	// step: the layout of the mounted config map, the key file is the symlink through ..data
+	dir := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "..first"), 0700))
+	writeAPIKeysFile(t, filepath.Join(dir, "..first", "api-keys.yaml"), fakeAPIKey)
+	assert.NoError(t, os.Symlink("..first", filepath.Join(dir, "..data")))
+	assert.NoError(t, os.Symlink(filepath.Join("..data", "api-keys.yaml"), filepath.Join(dir, "api-keys.yaml")))
+
+	provider, err := newAPIKeyProvider(filepath.Join(dir, "api-keys.yaml"), zap.NewNop())
+	assert.NoError(t, err)
+	assert.NoError(t, provider.watch())
+	assert.NotNil(t, provider.get(getAPIKeyHash(fakeAPIKey)))
+
+	// step: the update of the config map swaps the ..data symlink
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "..second"), 0700))
+	writeAPIKeysFile(t, filepath.Join(dir, "..second", "api-keys.yaml"), fakeAdminAPIKey)
+	assert.NoError(t, os.Symlink("..second", filepath.Join(dir, "..data_tmp")))
+	assert.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "..first")))
+
+	assert.Eventually(
+		t,
+		func() bool { return provider.get(getAPIKeyHash(fakeAdminAPIKey)) != nil },
+		5*time.Second,
+		10*time.Millisecond,
+	)
+	assert.Nil(t, provider.get(getAPIKeyHash(fakeAPIKey)))
+	assert.NoError(t, provider.close())
+}
+
+func TestAPIKeysNestedClaims(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "api-keys.yaml")
+	content := fmt.Sprintf(`- hash: %s
+  subject: %s
+  claims:
+    address:
+      country: CZ
+      zip: 11000
+    projects:
+    - name: reporting
+      ids: [1, 2]
+`, getAPIKeyHash(fakeAPIKey), fakeAPIKey)
+	assert.NoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+
+	provider, err := newAPIKeyProvider(file, zap.NewNop())
+	assert.NoError(t, err)
+
+	identity := provider.get(getAPIKeyHash(fakeAPIKey))
+
+	if !assert.NotNil(t, identity) {
+		return
+	}
+
+	assert.Equal(t, map[string]interface{}{"country": "CZ", "zip": 11000}, identity.Claims["address"])
+	assert.Equal(
+		t,
+		[]interface{}{map[string]interface{}{"name": "reporting", "ids": []interface{}{1, 2}}},
+		identity.Claims["projects"],
+	)
+
+	_, err = json.Marshal(identity.Claims)
+	assert.NoError(t, err)
+}
+
+func TestNewAPIKeyProviderInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := newAPIKeyProvider(filepath.Join(dir, "missing.yaml"), zap.NewNop())
+	assert.True(t, os.IsNotExist(err))
+
+	file := filepath.Join(dir, "duplicate.yaml")
+	writeAPIKeysFile(t, file, fakeAPIKey, fakeAPIKey)
+
+	_, err = newAPIKeyProvider(file, zap.NewNop())
+	assert.Error(t, err)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	oidc3 "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// backchannelLogoutEvent is the event member identifying the logout token
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	// logoutTokenKeyPrefix is the prefix of store keys holding the jti of the used logout tokens
+	logoutTokenKeyPrefix = "logout-token:"
+	// logoutTokenMaxSkew is how far the issued at time of the logout token can be from now
+	logoutTokenMaxSkew = 2 * time.Minute
+)
+
+var (
+	errLogoutTokenNoEvent   = errors.New("logout token is missing the back-channel logout event")
+	errLogoutTokenNoSubject = errors.New("logout token must contain sid or sub claim")
+	errLogoutTokenNonce     = errors.New("logout token must not contain nonce claim")
+	errLogoutTokenNoID      = errors.New("logout token must contain jti claim")
+	errLogoutTokenIssuedAt  = errors.New("logout token is outside of the acceptable time window")
+	errLogoutTokenReplayed  = errors.New("logout token has been used already")
+)
+
+// logoutTokenClaims are the claims of the back-channel logout token
+type logoutTokenClaims struct {
+	ID      string                     `json:"jti"`
+	Expiry  *jwt.NumericDate           `json:"exp"`
+	Subject string                     `json:"sub"`
+	Sid     string                     `json:"sid"`
+	Events  map[string]json.RawMessage `json:"events"`
+	Nonce   *string                    `json:"nonce"`
+}
+
+// verifyLogoutToken verifies the logout token against the keys of its issuer and checks the
+// claims required by https://openid.net/specs/openid-connect-backchannel-1_0.html#Validation
+func (r *oauthProxy) verifyLogoutToken(rawToken string) (*logoutTokenClaims, error) {
+	issuer := r.getTokenIssuer(rawToken)
+	verifier := r.getIssuerProvider(issuer).Verifier(
+		&oidc3.Config{
+			ClientID:        r.getIssuerConfig(issuer).ClientID,
+			SkipIssuerCheck: issuer == nil && r.config.SkipAccessTokenIssuerCheck,
+		},
+	)
+
+	token, err := verifier.Verify(context.Background(), rawToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &logoutTokenClaims{}
+
+	if err := token.Claims(claims); err != nil {
+		return nil, err
+	}
+
+	if _, found := claims.Events[backchannelLogoutEvent]; !found {
+		return nil, errLogoutTokenNoEvent
+	}
+
+	if claims.Subject == "" && claims.Sid == "" {
+		return nil, errLogoutTokenNoSubject
+	}
+
+	if claims.Nonce != nil {
+		return nil, errLogoutTokenNonce
+	}
+
+	if claims.ID == "" {
+		return nil, errLogoutTokenNoID
+	}
+
+	if skew := time.Since(token.IssuedAt); skew > logoutTokenMaxSkew || skew < -logoutTokenMaxSkew {
+		return nil, errLogoutTokenIssuedAt
+	}
+
+	return claims, nil
+}
+
+// backchannelLogoutHandler invalidates the sessions of the user logged out at the provider
+func (r *oauthProxy) backchannelLogoutHandler(writer http.ResponseWriter, req *http.Request) {
+	writer.Header().Set("Cache-Control", "no-store")
+
+	claims, err := r.verifyLogoutToken(req.FormValue("logout_token"))
+
+	if err != nil {
+		r.log.Warn("invalid back-channel logout token", zap.Error(err))
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// step: the logout tokens are single use, the jti is remembered until the token expires
+	fresh, err := r.store.SetNX(
+		logoutTokenKeyPrefix+utils.GetHashKey(claims.ID),
+		"true",
+		time.Until(claims.Expiry.Time()),
+	)
+
+	if err != nil {
+		r.log.Error("unable to record the back-channel logout token", zap.Error(err))
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !fresh {
+		r.log.Warn("invalid back-channel logout token", zap.Error(errLogoutTokenReplayed))
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	subject := claims.Subject
+
+	if subject == "" {
+		if subject, err = r.store.Get(getSidKey(claims.Sid)); err != nil {
+			r.log.Error("unable to find the subject of the session", zap.Error(err))
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if subject == "" {
+		writer.WriteHeader(http.StatusOK)
+		return
+	}
+
+	records, err := r.loadSessionIndex(subject)
+
+	if err != nil {
+		r.log.Error("unable to retrieve the sessions", zap.Error(err), zap.String("sub", subject))
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	revoked := 0
+
+	for _, record := range records {
+		if claims.Sid != "" && record.SID != claims.Sid {
+			continue
+		}
+
+		// the session has already ended at the provider, no need to revoke the tokens there
+		if err := r.revokeSession(subject, record, false); err != nil {
+			r.log.Error(
+				"unable to invalidate the session",
+				zap.Error(err),
+				zap.String("sub", subject),
+			)
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		revoked++
+	}
+
+	if claims.Sid != "" {
+		if err := r.store.Delete(getSidKey(claims.Sid)); err != nil {
+			r.log.Warn("unable to remove the session subject mapping", zap.Error(err))
+		}
+	}
+
+	r.log.Info(
+		"back-channel logout of the user",
+		zap.String("sub", subject),
+		zap.Int("sessions", revoked),
+	)
+
+	writer.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,210 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeBackchannelLogoutConfig() *Config {
+	cfg := newFakeServerSessionConfig()
+	cfg.EnableBackchannelLogout = true
+	cfg.NoRedirects = true
+
+	return cfg
+}
+
+func newTestLogoutToken(t *testing.T, issuer string, claims map[string]interface{}) string {
+	token := newTestToken(issuer)
+	logoutClaims := map[string]interface{}{
+		"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+	}
+
+	for name, value := range claims {
+		logoutClaims[name] = value
+	}
+
+	raw, err := token.getToken(logoutClaims)
+	assert.NoError(t, err)
+
+	return raw
+}
+
+func postLogoutToken(t *testing.T, proxy *fakeProxy, token string) *http.Response {
+	resp, err := http.PostForm(
+		proxy.getServiceURL()+proxy.config.WithOAuthURI("/backchannel-logout"),
+		url.Values{"logout_token": {token}},
+	)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	return resp
+}
+
+func createTestServerSession(t *testing.T, proxy *fakeProxy, sid string) (*http.Cookie, string) {
+	fakeToken := newTestToken(proxy.idp.getLocation())
+	fakeToken.claims.Jti = sid
+	token, err := fakeToken.getToken()
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	session, _ := proxy.proxy.newServerSession(token, "", "", time.Hour)
+	assert.NoError(t, proxy.proxy.createServerSession(
+		httptest.NewRequest(http.MethodGet, "/", nil),
+		recorder,
+		fakeSessionsSubject,
+		sid,
+		session,
+		time.Hour,
+	))
+
+	return recorder.Result().Cookies()[0], token
+}
+
+func TestBackchannelLogoutBySid(t *testing.T) {
+	cfg := newFakeBackchannelLogoutConfig()
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	loggedOut, token := createTestServerSession(t, proxy, "sid-1")
+	other, _ := createTestServerSession(t, proxy, "sid-2")
+
+	resp := postLogoutToken(t, proxy, newTestLogoutToken(t, proxy.idp.getLocation(), map[string]interface{}{
+		"sub": "",
+		"sid": "sid-1",
+	}))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	_, err := proxy.proxy.loadServerSession(loggedOut.Value)
+	assert.ErrorIs(t, err, apperrors.ErrNoSessionStateFound)
+
+	revoked, err := proxy.proxy.isTokenRevoked(token)
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+
+	_, err = proxy.proxy.loadServerSession(other.Value)
+	assert.NoError(t, err)
+
+	for cookie, code := range map[*http.Cookie]int{loggedOut: http.StatusUnauthorized, other: http.StatusOK} {
+		req, err := http.NewRequest(http.MethodGet, proxy.getServiceURL()+"/auth_all/test", nil)
+		assert.NoError(t, err)
+		req.AddCookie(cookie)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, code, resp.StatusCode)
+	}
+}
+
+func TestBackchannelLogoutBySubject(t *testing.T) {
+	cfg := newFakeBackchannelLogoutConfig()
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	first, _ := createTestServerSession(t, proxy, "sid-1")
+	second, _ := createTestServerSession(t, proxy, "sid-2")
+
+	resp := postLogoutToken(t, proxy, newTestLogoutToken(t, proxy.idp.getLocation(), nil))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, cookie := range []*http.Cookie{first, second} {
+		_, err := proxy.proxy.loadServerSession(cookie.Value)
+		assert.ErrorIs(t, err, apperrors.ErrNoSessionStateFound)
+	}
+
+	records, err := proxy.proxy.loadSessionIndex(fakeSessionsSubject)
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestBackchannelLogoutInvalidToken(t *testing.T) {
+	cfg := newFakeBackchannelLogoutConfig()
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	cookie, _ := createTestServerSession(t, proxy, "sid-1")
+	issuer := proxy.idp.getLocation()
+
+	withoutEvent, err := newTestToken(issuer).getToken()
+	assert.NoError(t, err)
+
+	unsigned, err := newTestToken(issuer).getUnsignedToken()
+	assert.NoError(t, err)
+
+	expired := newTestToken(issuer)
+	expired.setExpiration(time.Now().Add(-time.Minute))
+	expiredToken, err := expired.getToken(map[string]interface{}{
+		"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+	})
+	assert.NoError(t, err)
+
+	testCases := map[string]string{
+		"Empty":        "",
+		"WithoutEvent": withoutEvent,
+		"Unsigned":     unsigned,
+		"Expired":      expiredToken,
+		"WithNonce":    newTestLogoutToken(t, issuer, map[string]interface{}{"nonce": "nonce"}),
+		"WithoutSubjectAndSid": newTestLogoutToken(t, issuer, map[string]interface{}{
+			"sub": "",
+		}),
+		"WrongAudience": newTestLogoutToken(t, issuer, map[string]interface{}{"aud": "other"}),
+		"WithoutJti":    newTestLogoutToken(t, issuer, map[string]interface{}{"jti": ""}),
+		"IssuedLongAgo": newTestLogoutToken(t, issuer, map[string]interface{}{
+			"iat": time.Now().Add(-2 * logoutTokenMaxSkew).Unix(),
+		}),
+		"IssuedInFuture": newTestLogoutToken(t, issuer, map[string]interface{}{
+			"iat": time.Now().Add(2 * logoutTokenMaxSkew).Unix(),
+		}),
+	}
+
+	for name, token := range testCases {
+		resp := postLogoutToken(t, proxy, token)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+	}
+
+	_, err = proxy.proxy.loadServerSession(cookie.Value)
+	assert.NoError(t, err)
+}
+
+func TestBackchannelLogoutReplayedToken(t *testing.T) {
+	cfg := newFakeBackchannelLogoutConfig()
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	createTestServerSession(t, proxy, "sid-1")
+
+	token := newTestLogoutToken(t, proxy.idp.getLocation(), map[string]interface{}{
+		"sub": "",
+		"sid": "sid-1",
+	})
+
+	resp := postLogoutToken(t, proxy, token)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = postLogoutToken(t, proxy, token)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/constant"
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// basicKeyPrefix is the prefix of cache keys holding the tokens of the basic credentials
+const basicKeyPrefix = "basic:"
+
+// getBasicAuthToken returns the access token of the basic credentials obtained through the
+// password grant, the tokens are cached until they expire, concurrent logins with the same
+// credentials are collapsed into single provider call
+func (r *oauthProxy) getBasicAuthToken(username, password string) (string, error) {
+	key := basicKeyPrefix + utils.GetHashKey(username+":"+password)
+
+	if r.basicAuthCache != nil {
+		token, err := r.basicAuthCache.Get(key)
+
+		if err != nil {
+			r.log.Warn("unable to retrieve the token of basic credentials from cache", zap.Error(err))
+		} else if token != "" {
+			return token, nil
+		}
+	}
+
+	result, err, _ := r.basicAuthGroup.Do(key, func() (interface{}, error) {
+		token, err := r.loginWithPassword(username, password)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if expiration := time.Until(getAccessTokenExpiry(token)); r.basicAuthCache != nil && expiration > 0 {
+			if err := r.basicAuthCache.Set(key, token.AccessToken, expiration); err != nil {
+				r.log.Warn("unable to cache the token of basic credentials", zap.Error(err))
+			}
+		}
+
+		return token.AccessToken, nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return result.(string), nil
+}
+
+// isBrowserNavigation checks if the request is a page navigation of the browser
+func isBrowserNavigation(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// getAccessTokenExpiry returns the expiration of the access token, the exp claim of the jwt
+// takes precedence over the optional expires_in of the token response
+func getAccessTokenExpiry(token *oauth2.Token) time.Time {
+	webToken, err := jwt.ParseSigned(token.AccessToken)
+
+	if err != nil {
+		return token.Expiry
+	}
+
+	claims := &jwt.Claims{}
+
+	if err := webToken.UnsafeClaimsWithoutVerification(claims); err != nil || claims.Expiry == nil {
+		return token.Expiry
+	}
+
+	return claims.Expiry.Time()
+}
+
+// loginWithPassword requests the access token with the password grant
+func (r *oauthProxy) loginWithPassword(username, password string) (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		r.config.OpenIDProviderTimeout,
+	)
+
+	defer cancel()
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, r.providerClient)
+
+	start := time.Now()
+	token, err := r.newOAuth2Config(nil, "").PasswordCredentialsToken(ctx, username, password)
+
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+
+		// the provider refuses invalid credentials with 400 invalid_grant or 401
+		if errors.As(err, &retrieveErr) && retrieveErr.Response != nil &&
+			retrieveErr.Response.StatusCode < http.StatusInternalServerError {
+			return nil, fmt.Errorf("%w: %s", apperrors.ErrInvalidBasicCredentials, err)
+		}
+
+		return nil, err
+	}
+
+	// @metric observe the time taken for a login request
+	oauthLatencyMetric.WithLabelValues("basic").Observe(time.Since(start).Seconds())
+	// @metric a token has been issued
+	oauthTokensMetric.WithLabelValues("basic").Inc()
+
+	return token, nil
+}
+
+// basicAuthMiddleware exchanges the basic credentials of the legacy clients for an access
+// token, which is then used as the bearer token of the request
+func (r *oauthProxy) basicAuthMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+			scope, assertOk := req.Context().Value(constant.ContextScopeName).(*RequestScope)
+
+			if !assertOk {
+				r.log.Error(
+					"assertion failed",
+				)
+				return
+			}
+
+			username, password, found := req.BasicAuth()
+
+			if !found {
+				// step: the legacy clients send the basic credentials only when challenged,
+				// the browsers are still redirected to the login page when allowed
+				if !r.hasIdentityCredentials(req) && (r.config.NoRedirects || !isBrowserNavigation(req)) {
+					r.basicAuthChallenge(wrt, req)
+					return
+				}
+
+				next.ServeHTTP(wrt, req)
+				return
+			}
+
+			token, err := r.getBasicAuthToken(username, password)
+
+			if err != nil {
+				scope.Logger.Error(
+					"unable to login with the basic credentials",
+					zap.String("client_ip", utils.RealIP(req)),
+					zap.String("username", username),
+					zap.Error(err),
+				)
+
+				if !errors.Is(err, apperrors.ErrInvalidBasicCredentials) {
+					wrt.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+
+				r.basicAuthChallenge(wrt, req)
+				return
+			}
+
+			// bearer tokens are expected to be encrypted when the encryption is enabled
+			if r.config.EnableEncryptedToken {
+				if token, err = encryption.EncodeText(token, r.config.EncryptionKey); err != nil {
+					scope.Logger.Error("unable to encrypt the access token", zap.Error(err))
+					wrt.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+			}
+
+			req.Header.Set(
+				constant.AuthorizationHeader,
+				fmt.Sprintf("%s %s", constant.AuthorizationType, token),
+			)
+
+			next.ServeHTTP(wrt, req)
+		})
+	}
+}
+
+// hasIdentityCredentials checks if the request carries the token, the session or the api key
+func (r *oauthProxy) hasIdentityCredentials(req *http.Request) bool {
+	if req.Header.Get(constant.AuthorizationHeader) != "" {
+		return true
+	}
+
+	if r.config.EnableAPIKeys && req.Header.Get(r.config.APIKeyHeader) != "" {
+		return true
+	}
+
+	if r.config.EnableServerSessions {
+		_, err := r.getSessionIDFromCookie(req)
+		return err == nil
+	}
+
+	_, err := utils.GetTokenInCookie(req, r.config.CookieAccessName)
+
+	return err == nil
+}
+
+// basicAuthChallenge rejects the request with the basic authentication challenge
+// https://www.rfc-editor.org/rfc/rfc7617#section-2
+func (r *oauthProxy) basicAuthChallenge(wrt http.ResponseWriter, req *http.Request) {
+	wrt.Header().Set(
+		"WWW-Authenticate",
+		fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, constant.Prog),
+	)
+	wrt.WriteHeader(http.StatusUnauthorized)
+	r.revokeProxy(wrt, req)
+}
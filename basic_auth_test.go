@@ -0,0 +1,207 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeBasicAuthURL = "/legacy/test"
+
+// getBasicAuthorization returns the authorization header of the basic credentials
+func getBasicAuthorization(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// newFakeBasicAuthConfig returns the config with the resource accepting the basic credentials
+func newFakeBasicAuthConfig() *Config {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = append(cfg.Resources, &authorization.Resource{
+		URL:       "/legacy/*",
+		Methods:   utils.AllHTTPMethods,
+		BasicAuth: true,
+	})
+
+	return cfg
+}
+
+func TestBasicAuth(t *testing.T) {
+	testCases := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+		PasswordRequests  int32
+	}{
+		{
+			Name:          "TestValidCredentialsAreCached",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           fakeBasicAuthURL,
+					Headers:       map[string]string{"Authorization": getBasicAuthorization(validUsername, validPassword)},
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
+						"Authorization": func(t *testing.T, c *Config, value string) {
+							assert.True(t, strings.HasPrefix(value, "Bearer "))
+						},
+					},
+				},
+				{
+					URI:           fakeBasicAuthURL,
+					Headers:       map[string]string{"Authorization": getBasicAuthorization(validUsername, validPassword)},
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+			PasswordRequests: 1,
+		},
+		{
+			Name: "TestValidCredentialsWithEncryptedToken",
+			ProxySettings: func(c *Config) {
+				c.EnableEncryptedToken = true
+				c.EncryptionKey = testEncryptionKey
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           fakeBasicAuthURL,
+					Headers:       map[string]string{"Authorization": getBasicAuthorization(validUsername, validPassword)},
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+			PasswordRequests: 1,
+		},
+		{
+			Name:          "TestInvalidCredentialsAreChallenged",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:          fakeBasicAuthURL,
+					Headers:      map[string]string{"Authorization": getBasicAuthorization(validUsername, "bad")},
+					ExpectedCode: http.StatusUnauthorized,
+					ExpectedHeaders: map[string]string{
+						"WWW-Authenticate": `Basic realm="gatekeeper", charset="UTF-8"`,
+					},
+				},
+				{
+					URI:          fakeBasicAuthURL,
+					Headers:      map[string]string{"Authorization": getBasicAuthorization(validUsername, "bad")},
+					ExpectedCode: http.StatusUnauthorized,
+				},
+			},
+			// refused credentials are not cached, the oauth2 client tries both ways of
+			// sending the client credentials on each login
+			PasswordRequests: 4,
+		},
+		{
+			Name:          "TestBearerTokenOnBasicAuthResource",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           fakeBasicAuthURL,
+					HasToken:      true,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+		{
+			Name:          "TestNoCredentialsAreChallenged",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:          fakeBasicAuthURL,
+					ExpectedCode: http.StatusUnauthorized,
+					ExpectedHeaders: map[string]string{
+						"WWW-Authenticate": `Basic realm="gatekeeper", charset="UTF-8"`,
+					},
+				},
+			},
+		},
+		{
+			Name:          "TestBrowserWithoutCredentialsIsRedirected",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:              fakeBasicAuthURL,
+					Redirects:        true,
+					Headers:          map[string]string{"Accept": "text/html,application/xhtml+xml"},
+					ExpectedCode:     http.StatusSeeOther,
+					ExpectedLocation: "/oauth/authorize?state",
+				},
+				{
+					URI:          fakeBasicAuthURL,
+					Redirects:    true,
+					ExpectedCode: http.StatusUnauthorized,
+					ExpectedHeaders: map[string]string{
+						"WWW-Authenticate": `Basic realm="gatekeeper", charset="UTF-8"`,
+					},
+				},
+			},
+		},
+		{
+			Name:          "TestAccessCookieOnBasicAuthResource",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:            fakeBasicAuthURL,
+					HasToken:       true,
+					HasCookieToken: true,
+					ExpectedProxy:  true,
+					ExpectedCode:   http.StatusOK,
+				},
+			},
+		},
+		{
+			Name:          "TestBasicCredentialsOnOtherResource",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:          fakeAuthAllURL,
+					Headers:      map[string]string{"Authorization": getBasicAuthorization(validUsername, validPassword)},
+					ExpectedCode: http.StatusUnauthorized,
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeBasicAuthConfig()
+				testCase.ProxySettings(cfg)
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+				proxy.RunTests(t, testCase.ExecutionSettings)
+
+				assert.Equal(t, testCase.PasswordRequests, atomic.LoadInt32(&proxy.idp.passwordRequests))
+			},
+		)
+	}
+}
@@ -0,0 +1,444 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
+	"github.com/gogatekeeper/gatekeeper/pkg/constant"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// claimWildcard is the path segment matching every key of the claim object
+const claimWildcard = "*"
+
+var errInvalidClaim = errors.New("invalid claim")
+
+var (
+	// defaultRolesClaims is the keycloak layout of the realm roles
+	defaultRolesClaims = []string{"realm_access.roles"}
+	// defaultClientRolesClaims is the keycloak layout of the client roles
+	defaultClientRolesClaims = []string{"resource_access.*.roles"}
+)
+
+// claimValue is the value found at the claim path, key is the object key matched
+// by the last wildcard of the path
+type claimValue struct {
+	key   string
+	value interface{}
+}
+
+// findClaimValues resolves the dot separated path in the claims, the keys of the claims can
+// contain dots as well, e.g. namespaced claims as https://example.com/roles
+func findClaimValues(claims interface{}, path string, key string) []claimValue {
+	if path == "" {
+		return []claimValue{{key: key, value: claims}}
+	}
+
+	object, assertOk := claims.(map[string]interface{})
+
+	if !assertOk {
+		return nil
+	}
+
+	if value, found := object[path]; found {
+		return []claimValue{{key: key, value: value}}
+	}
+
+	for idx := strings.Index(path, "."); idx >= 0; {
+		segment, rest := path[:idx], path[idx+1:]
+
+		if segment == claimWildcard {
+			names := make([]string, 0, len(object))
+
+			for name := range object {
+				names = append(names, name)
+			}
+
+			sort.Strings(names)
+
+			values := []claimValue{}
+
+			for _, name := range names {
+				values = append(values, findClaimValues(object[name], rest, name)...)
+			}
+
+			return values
+		}
+
+		if value, found := object[segment]; found {
+			return findClaimValues(value, rest, key)
+		}
+
+		next := strings.Index(rest, ".")
+
+		if next < 0 {
+			break
+		}
+
+		idx += next + 1
+	}
+
+	return nil
+}
+
+// claimStrings returns the string or the strings of the list in the claim value
+func claimStrings(value interface{}) []string {
+	items := []string{}
+
+	switch content := value.(type) {
+	case string:
+		if content != "" {
+			items = append(items, content)
+		}
+	case []interface{}:
+		for _, item := range content {
+			if text, assertOk := item.(string); assertOk && text != "" {
+				items = append(items, text)
+			}
+		}
+	}
+
+	return items
+}
+
+// claimsReader reads the typed values of the decoded claims, the first claim of unexpected
+// type is kept as the error, missing claims have zero values
+type claimsReader struct {
+	claims map[string]interface{}
+	err    error
+}
+
+// invalid records the claim of unexpected type
+func (c *claimsReader) invalid(name string) {
+	if c.err == nil {
+		c.err = fmt.Errorf("%w: %s", errInvalidClaim, name)
+	}
+}
+
+// value returns the value at the path of the nested claims
+func (c *claimsReader) value(path ...string) interface{} {
+	var value interface{} = c.claims
+
+	for _, name := range path {
+		if value == nil {
+			return nil
+		}
+
+		object, assertOk := value.(map[string]interface{})
+
+		if !assertOk {
+			c.invalid(name)
+			return nil
+		}
+
+		value = object[name]
+	}
+
+	return value
+}
+
+// text returns the string claim
+func (c *claimsReader) text(path ...string) string {
+	switch value := c.value(path...).(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		c.invalid(strings.Join(path, "."))
+		return ""
+	}
+}
+
+// list returns the string or the strings of the list claim
+func (c *claimsReader) list(path ...string) []string {
+	switch value := c.value(path...).(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{value}
+	case []interface{}:
+		items := make([]string, 0, len(value))
+
+		for _, item := range value {
+			text, assertOk := item.(string)
+
+			if !assertOk {
+				c.invalid(strings.Join(path, "."))
+				return nil
+			}
+
+			items = append(items, text)
+		}
+
+		return items
+	default:
+		c.invalid(strings.Join(path, "."))
+		return nil
+	}
+}
+
+// object returns the object claim
+func (c *claimsReader) object(path ...string) map[string]interface{} {
+	switch value := c.value(path...).(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		return value
+	default:
+		c.invalid(strings.Join(path, "."))
+		return nil
+	}
+}
+
+// date returns the seconds since epoch claim
+func (c *claimsReader) date(path ...string) *jwt.NumericDate {
+	var seconds int64
+
+	switch value := c.value(path...).(type) {
+	case nil:
+		return nil
+	case float64:
+		seconds = int64(value)
+	case json.Number:
+		number, err := value.Float64()
+
+		if err != nil {
+			c.invalid(strings.Join(path, "."))
+			return nil
+		}
+
+		seconds = int64(number)
+	default:
+		c.invalid(strings.Join(path, "."))
+		return nil
+	}
+
+	date := jwt.NumericDate(seconds)
+
+	return &date
+}
+
+// permissions returns the uma permissions of the authorization claim
+func (c *claimsReader) permissions(path ...string) authorization.Permissions {
+	permissions := authorization.Permissions{}
+	items, assertOk := c.value(path...).([]interface{})
+
+	if !assertOk {
+		if c.value(path...) != nil {
+			c.invalid(strings.Join(path, "."))
+		}
+
+		return permissions
+	}
+
+	for _, item := range items {
+		object, assertOk := item.(map[string]interface{})
+
+		if !assertOk {
+			c.invalid(strings.Join(path, "."))
+			return permissions
+		}
+
+		reader := &claimsReader{claims: object}
+		permissions.Permissions = append(permissions.Permissions, authorization.Permission{
+			Scopes:       reader.list("scopes"),
+			ResourceID:   reader.text("rsid"),
+			ResourceName: reader.text("rsname"),
+		})
+
+		if reader.err != nil {
+			c.invalid(strings.Join(path, "."))
+		}
+	}
+
+	return permissions
+}
+
+// getStandardClaims returns the registered claims of the decoded claims
+// https://www.rfc-editor.org/rfc/rfc7519#section-4.1
+func getStandardClaims(claims map[string]interface{}) (*jwt.Claims, error) {
+	reader := &claimsReader{claims: claims}
+	stdClaims := &jwt.Claims{
+		Issuer:    reader.text("iss"),
+		Subject:   reader.text("sub"),
+		Audience:  jwt.Audience(reader.list("aud")),
+		Expiry:    reader.date("exp"),
+		NotBefore: reader.date("nbf"),
+		IssuedAt:  reader.date("iat"),
+		ID:        reader.text("jti"),
+	}
+
+	return stdClaims, reader.err
+}
+
+// getCustomClaims returns the non standard claims the user identity is made of
+func getCustomClaims(claims map[string]interface{}) (*custClaims, error) {
+	reader := &claimsReader{claims: claims}
+	customClaims := &custClaims{
+		Email:          reader.text("email"),
+		PrefName:       reader.text("preferred_username"),
+		RealmAccess:    realmRoles{Roles: reader.list("realm_access", "roles")},
+		Groups:         reader.list("groups"),
+		ResourceAccess: reader.object("resource_access"),
+		FamilyName:     reader.text("family_name"),
+		GivenName:      reader.text("given_name"),
+		Username:       reader.text("username"),
+		Authorization:  reader.permissions("authorization", "permissions"),
+		Sid:            reader.text("sid"),
+		SessionState:   reader.text("session_state"),
+	}
+
+	return customClaims, reader.err
+}
+
+// getTokenScopes returns the oauth scopes of the token, the scope claim holds the space
+// separated scopes, some providers use the scp claim with the list of scopes instead
+// https://www.rfc-editor.org/rfc/rfc8693#section-4.2
+func getTokenScopes(claims map[string]interface{}) []string {
+	scopes := []string{}
+
+	for _, name := range []string{constant.ClaimScope, constant.ClaimScp} {
+		for _, value := range claimStrings(claims[name]) {
+			scopes = append(scopes, strings.Fields(value)...)
+		}
+	}
+
+	return scopes
+}
+
+// getClaimStrings collects the strings found at all the claim paths
+func getClaimStrings(claims map[string]interface{}, paths []string) []string {
+	items := []string{}
+
+	for _, path := range paths {
+		for _, found := range findClaimValues(claims, path, "") {
+			items = append(items, claimStrings(found.value)...)
+		}
+	}
+
+	return items
+}
+
+// getClientRoles collects the client roles found at the claim paths, the roles are prefixed
+// with the client matched by wildcard, or with the configured prefix
+func getClientRoles(claims map[string]interface{}, paths []string, prefix string) []string {
+	roles := []string{}
+
+	for _, path := range paths {
+		for _, found := range findClaimValues(claims, path, "") {
+			client := utils.DefaultTo(found.key, prefix)
+
+			for _, role := range claimStrings(found.value) {
+				if client != "" {
+					role = fmt.Sprintf("%s:%s", client, role)
+				}
+
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	return roles
+}
+
+// useClaimMapping checks if the identity is taken from other claims than keycloak ones
+func (r *IssuerConfig) useClaimMapping() bool {
+	return len(r.RolesClaims) > 0 ||
+		len(r.ClientRolesClaims) > 0 ||
+		r.ClientRolesPrefix != "" ||
+		len(r.GroupsClaims) > 0 ||
+		len(r.UsernameClaims) > 0 ||
+		len(r.EmailClaims) > 0
+}
+
+// mapIdentityClaims takes the roles, groups, username and email of the user from the
+// configured claims, not configured ones keep the keycloak layout
+func (r *IssuerConfig) mapIdentityClaims(user *userContext) {
+	if !r.useClaimMapping() {
+		return
+	}
+
+	if len(r.RolesClaims) > 0 || len(r.ClientRolesClaims) > 0 || r.ClientRolesPrefix != "" {
+		rolesClaims := r.RolesClaims
+
+		if len(rolesClaims) == 0 {
+			rolesClaims = defaultRolesClaims
+		}
+
+		clientRolesClaims := r.ClientRolesClaims
+
+		if len(clientRolesClaims) == 0 {
+			clientRolesClaims = defaultClientRolesClaims
+		}
+
+		user.roles = append(
+			getClaimStrings(user.claims, rolesClaims),
+			getClientRoles(user.claims, clientRolesClaims, r.ClientRolesPrefix)...,
+		)
+	}
+
+	if len(r.GroupsClaims) > 0 {
+		user.groups = getClaimStrings(user.claims, r.GroupsClaims)
+	}
+
+	// step: the first claim found is used, otherwise the keycloak one is kept
+	if emails := getClaimStrings(user.claims, r.EmailClaims); len(emails) > 0 {
+		user.email = emails[0]
+	}
+
+	if names := getClaimStrings(user.claims, r.UsernameClaims); len(names) > 0 {
+		user.name = names[0]
+		user.preferredName = names[0]
+	}
+}
+
+// isClaimMappingValid checks the claim paths of the issuer
+func (r *IssuerConfig) isClaimMappingValid() error {
+	claims := map[string][]string{
+		"roles-claims":        r.RolesClaims,
+		"client-roles-claims": r.ClientRolesClaims,
+		"groups-claims":       r.GroupsClaims,
+		"username-claims":     r.UsernameClaims,
+		"email-claims":        r.EmailClaims,
+	}
+
+	for option, paths := range claims {
+		for _, path := range paths {
+			if strings.TrimSpace(path) == "" {
+				return fmt.Errorf("%s must not contain empty claim path", option)
+			}
+		}
+	}
+
+	if strings.Contains(r.ClientRolesPrefix, ":") {
+		return errors.New("client roles prefix must not contain colon")
+	}
+
+	return nil
+}
+
+// mapIdentityClaims applies the claim mapping of the issuer the token comes from
+func (r *oauthProxy) mapIdentityClaims(user *userContext) {
+	r.getIssuerConfig(user.issuer).mapIdentityClaims(user)
+}
@@ -0,0 +1,349 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestGetClaimStrings(t *testing.T) {
+	claims := map[string]interface{}{
+		"roles":                     []interface{}{"admin", "user"},
+		"https://example.com/roles": []interface{}{"editor"},
+		"org": map[string]interface{}{
+			"team.name": "platform",
+			"groups":    []interface{}{"devs", 1, ""},
+		},
+		"mail": "jdoe@example.com",
+	}
+
+	testCases := []struct {
+		Name     string
+		Paths    []string
+		Expected []string
+	}{
+		{
+			Name:     "TestTopLevelClaim",
+			Paths:    []string{"roles"},
+			Expected: []string{"admin", "user"},
+		},
+		{
+			Name:     "TestNamespacedClaim",
+			Paths:    []string{"https://example.com/roles"},
+			Expected: []string{"editor"},
+		},
+		{
+			Name:     "TestNestedClaim",
+			Paths:    []string{"org.groups"},
+			Expected: []string{"devs"},
+		},
+		{
+			Name:     "TestNestedClaimWithDottedKey",
+			Paths:    []string{"org.team.name"},
+			Expected: []string{"platform"},
+		},
+		{
+			Name:     "TestMultipleSources",
+			Paths:    []string{"roles", "https://example.com/roles", "missing"},
+			Expected: []string{"admin", "user", "editor"},
+		},
+		{
+			Name:     "TestStringClaim",
+			Paths:    []string{"mail"},
+			Expected: []string{"jdoe@example.com"},
+		},
+		{
+			Name:     "TestMissingClaim",
+			Paths:    []string{"org.missing", "mail.domain"},
+			Expected: []string{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				assert.Equal(t, testCase.Expected, getClaimStrings(claims, testCase.Paths))
+			},
+		)
+	}
+}
+
+func TestGetTokenScopes(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Claims   map[string]interface{}
+		Expected []string
+	}{
+		{
+			Name:     "TestScopeClaim",
+			Claims:   map[string]interface{}{"scope": "openid  orders:read orders:write"},
+			Expected: []string{"openid", "orders:read", "orders:write"},
+		},
+		{
+			Name:     "TestScpListClaim",
+			Claims:   map[string]interface{}{"scp": []interface{}{"orders:read", "orders:write"}},
+			Expected: []string{"orders:read", "orders:write"},
+		},
+		{
+			Name:     "TestScpStringClaim",
+			Claims:   map[string]interface{}{"scp": "orders:read orders:write"},
+			Expected: []string{"orders:read", "orders:write"},
+		},
+		{
+			Name:     "TestBothClaims",
+			Claims:   map[string]interface{}{"scope": "openid", "scp": []interface{}{"orders:read"}},
+			Expected: []string{"openid", "orders:read"},
+		},
+		{
+			Name:     "TestNoScopes",
+			Claims:   map[string]interface{}{},
+			Expected: []string{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				assert.Equal(t, testCase.Expected, getTokenScopes(testCase.Claims))
+			},
+		)
+	}
+}
+
+func TestGetStandardAndCustomClaims(t *testing.T) {
+	claims := map[string]interface{}{
+		"iss":                "https://idp.example.com",
+		"sub":                "jdoe",
+		"aud":                "orders",
+		"exp":                float64(1900000000),
+		"iat":                float64(1800000000),
+		"email":              "jdoe@example.com",
+		"preferred_username": "john",
+		"realm_access":       map[string]interface{}{"roles": []interface{}{"user"}},
+		"resource_access":    map[string]interface{}{"orders": map[string]interface{}{"roles": []interface{}{"read"}}},
+		"groups":             []interface{}{"devs"},
+		"sid":                "session",
+		"authorization": map[string]interface{}{
+			"permissions": []interface{}{
+				map[string]interface{}{"rsid": "1", "rsname": "orders", "scopes": []interface{}{"view"}},
+			},
+		},
+	}
+
+	stdClaims, err := getStandardClaims(claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://idp.example.com", stdClaims.Issuer)
+	assert.Equal(t, "jdoe", stdClaims.Subject)
+	assert.Equal(t, jwt.Audience{"orders"}, stdClaims.Audience)
+	assert.Equal(t, int64(1900000000), stdClaims.Expiry.Time().Unix())
+	assert.Equal(t, int64(1800000000), stdClaims.IssuedAt.Time().Unix())
+	assert.Nil(t, stdClaims.NotBefore)
+
+	customClaims, err := getCustomClaims(claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "jdoe@example.com", customClaims.Email)
+	assert.Equal(t, "john", customClaims.PrefName)
+	assert.Equal(t, []string{"user"}, customClaims.RealmAccess.Roles)
+	assert.Equal(t, []string{"devs"}, customClaims.Groups)
+	assert.Contains(t, customClaims.ResourceAccess, "orders")
+	assert.Equal(t, "session", customClaims.Sid)
+	assert.Len(t, customClaims.Authorization.Permissions, 1)
+	assert.Equal(t, "orders", customClaims.Authorization.Permissions[0].ResourceName)
+	assert.Equal(t, []string{"view"}, customClaims.Authorization.Permissions[0].Scopes)
+
+	// step: claims of unexpected type are rejected
+	_, err = getStandardClaims(map[string]interface{}{"exp": "tomorrow"})
+	assert.ErrorIs(t, err, errInvalidClaim)
+
+	_, err = getCustomClaims(map[string]interface{}{"realm_access": map[string]interface{}{"roles": []interface{}{1}}})
+	assert.ErrorIs(t, err, errInvalidClaim)
+
+	_, err = getCustomClaims(map[string]interface{}{"resource_access": "orders"})
+	assert.ErrorIs(t, err, errInvalidClaim)
+}
+
+func TestGetClientRoles(t *testing.T) {
+	claims := map[string]interface{}{
+		"resource_access": map[string]interface{}{
+			"web": map[string]interface{}{"roles": []interface{}{"viewer"}},
+			"api": map[string]interface{}{"roles": []interface{}{"admin", "user"}},
+		},
+		"client_roles": []interface{}{"writer"},
+	}
+
+	testCases := []struct {
+		Name     string
+		Paths    []string
+		Prefix   string
+		Expected []string
+	}{
+		{
+			Name:     "TestWildcardPrefixesClient",
+			Paths:    defaultClientRolesClaims,
+			Expected: []string{"api:admin", "api:user", "web:viewer"},
+		},
+		{
+			Name:     "TestWildcardIgnoresPrefix",
+			Paths:    defaultClientRolesClaims,
+			Prefix:   "app",
+			Expected: []string{"api:admin", "api:user", "web:viewer"},
+		},
+		{
+			Name:     "TestConfiguredPrefix",
+			Paths:    []string{"client_roles"},
+			Prefix:   "app",
+			Expected: []string{"app:writer"},
+		},
+		{
+			Name:     "TestWithoutPrefix",
+			Paths:    []string{"client_roles"},
+			Expected: []string{"writer"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				assert.Equal(t, testCase.Expected, getClientRoles(claims, testCase.Paths, testCase.Prefix))
+			},
+		)
+	}
+}
+
+func TestClaimMapping(t *testing.T) {
+	extraClaims := map[string]interface{}{
+		"roles":    []interface{}{"admin"},
+		"teams":    []interface{}{"devs", "ops"},
+		"nickname": "jdoe",
+		"contact":  map[string]interface{}{"mail": "jdoe@example.com"},
+	}
+
+	testCases := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name: "TestClientRolesWithPrefix",
+			ProxySettings: func(c *Config) {
+				c.ClientRolesClaims = []string{"roles"}
+				c.ClientRolesPrefix = "role"
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/admin/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeaders: map[string]string{
+						"X-Auth-Roles": "default,role:admin",
+					},
+				},
+			},
+		},
+		{
+			Name: "TestRolesClaims",
+			ProxySettings: func(c *Config) {
+				c.RolesClaims = []string{"roles"}
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/admin/test",
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusForbidden,
+				},
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeaders: map[string]string{
+						"X-Auth-Roles": "admin,defaultclient:default",
+					},
+				},
+			},
+		},
+		{
+			Name: "TestGroupsUsernameAndEmailClaims",
+			ProxySettings: func(c *Config) {
+				c.GroupsClaims = []string{"teams"}
+				c.UsernameClaims = []string{"missing", "nickname"}
+				c.EmailClaims = []string{"contact.mail"}
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeaders: map[string]string{
+						"X-Auth-Groups":   "devs,ops",
+						"X-Auth-Username": "jdoe",
+						"X-Auth-Email":    "jdoe@example.com",
+						"X-Auth-Roles":    "default,defaultclient:default",
+					},
+				},
+			},
+		},
+		{
+			Name:          "TestKeycloakClaimsByDefault",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeaders: map[string]string{
+						"X-Auth-Groups":   "default",
+						"X-Auth-Username": "rjayawardene",
+						"X-Auth-Email":    "gambol99@gmail.com",
+					},
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeKeycloakConfig()
+				cfg.NoRedirects = true
+				testCase.ProxySettings(cfg)
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+				token, err := newTestToken(proxy.idp.getLocation()).getToken(extraClaims)
+				assert.NoError(t, err)
+
+				for idx := range testCase.ExecutionSettings {
+					testCase.ExecutionSettings[idx].RawToken = token
+				}
+
+				proxy.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
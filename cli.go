@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
@@ -27,6 +28,7 @@ import (
 	"github.com/gogatekeeper/gatekeeper/pkg/constant"
 	"github.com/gogatekeeper/gatekeeper/pkg/utils"
 	"github.com/urfave/cli"
+	"go.uber.org/zap"
 )
 
 // newOauthProxyApp creates a new cli application and runs it
@@ -87,6 +89,10 @@ func newOauthProxyApp() *cli.App {
 		signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 		<-signalChannel
 
+		if err := proxy.CloseStore(); err != nil {
+			proxy.log.Error("unable to close the resources of the proxy", zap.Error(err))
+		}
+
 		return nil
 	}
 
@@ -181,7 +187,7 @@ func getCommandLineOptions() []cli.Flag {
 //nolint:cyclop
 func parseCLIOptions(cliCtx *cli.Context, config *Config) error {
 	// step: we can ignore these options in the Config struct
-	ignoredOptions := []string{"tag-data", "match-claims", "resources", "headers"}
+	ignoredOptions := []string{"tag-data", "match-claims", "resources", "headers", "issuers"}
 	// step: iterate the Config and grab command line options via reflection
 	count := reflect.TypeOf(config).Elem().NumField()
 
@@ -238,6 +244,16 @@ func parseCLIOptions(cliCtx *cli.Context, config *Config) error {
 		utils.MergeMaps(config.Headers, headers)
 	}
 
+	if cliCtx.IsSet("issuers") {
+		for _, x := range cliCtx.StringSlice("issuers") {
+			issuer := &IssuerConfig{}
+			if err := json.Unmarshal([]byte(x), issuer); err != nil {
+				return fmt.Errorf("invalid issuer %s, %s", x, err)
+			}
+			config.Issuers = append(config.Issuers, issuer)
+		}
+	}
+
 	if cliCtx.IsSet("resources") {
 		for _, x := range cliCtx.StringSlice("resources") {
 			resource, err := authorization.NewResource().Parse(x)
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
@@ -14,6 +15,8 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -48,6 +51,10 @@ const (
 	fakeTestRoleURL        = "/test_role"
 	fakeTestWhitelistedURL = "/auth_all/white_listed*"
 	testProxyAccepted      = "Proxy-Accepted"
+	fakeOpaqueToken        = "opaque-access-token"
+	fakeDeviceCode         = "device-code"
+	fakeUserCode           = "WDJB-MJHT"
+	fakeForbiddenAudience  = "forbidden"
 	validUsername          = "test"
 	validPassword          = "test"
 )
@@ -634,7 +641,11 @@ func (f *fakeProxy) performUserLogin(reqCfg *fakeRequest) error {
 		return err
 	}
 	for _, cookie := range resp.Cookies() {
-		if cookie.Name == f.config.CookieAccessName || cookie.Name == f.config.CookieRefreshName {
+		if cookie.Name == f.config.CookieAccessName ||
+			cookie.Name == f.config.CookieRefreshName ||
+			cookie.Name == f.config.CookieSessionName ||
+			cookie.Name == f.config.CookieIDTokenName ||
+			cookie.Name == f.config.CookieSessionTimestampName {
 			f.cookies[cookie.Name] = &http.Cookie{
 				Name:   cookie.Name,
 				Path:   "/",
@@ -730,6 +741,9 @@ func newFakeKeycloakConfig() *Config {
 		ClientSecret:                fakeSecret,
 		CookieAccessName:            "kc-access",
 		CookieRefreshName:           "kc-state",
+		CookieSessionName:           "kc-session",
+		CookieIDTokenName:           "id_token",
+		CookieSessionTimestampName:  "kc-session-time",
 		DisableAllLogging:           true,
 		DiscoveryURL:                randomLocalHost,
 		EnableAuthorizationCookies:  true,
@@ -903,8 +917,8 @@ func newTestToken(issuer string) *fakeToken {
 	return &fakeToken{claims: claims}
 }
 
-// getToken returns a JWT token from the clains
-func (t *fakeToken) getToken() (string, error) {
+// getToken returns a JWT token from the clains, extra claims are merged in
+func (t *fakeToken) getToken(extraClaims ...interface{}) (string, error) {
 	input := []byte("")
 	block, _ := pem.Decode([]byte(fakePrivateKey))
 	if block != nil {
@@ -927,6 +941,11 @@ func (t *fakeToken) getToken() (string, error) {
 	}
 
 	b := jwt.Signed(signer).Claims(&t.claims)
+
+	for _, claims := range extraClaims {
+		b = b.Claims(claims)
+	}
+
 	jwt, err := b.CompactSerialize()
 
 	if err != nil {
@@ -1001,6 +1020,24 @@ type fakeAuthServer struct {
 	expiration                time.Duration
 	resourceSetHandlerFailure bool
 	fakeAuthConfig            *fakeAuthConfig
+	// refreshRequests counts the refresh token grants
+	refreshRequests int32
+	// refreshDelay delays the response to the refresh token grant
+	refreshDelay time.Duration
+	// introspectionRequests counts the token introspection requests
+	introspectionRequests int32
+	// codeChallenges holds the pkce code challenges of the issued codes
+	codeChallenges sync.Map
+	// pkceExchanges counts the codes exchanged with valid pkce code verifier
+	pkceExchanges int32
+	// nonces holds the nonces of the issued codes, returned in the id token
+	nonces sync.Map
+	// deviceTokenRequests counts the polls of the device, the first one is pending
+	deviceTokenRequests int32
+	// exchangeRequests counts the token exchanges
+	exchangeRequests int32
+	// passwordRequests counts the password grants
+	passwordRequests int32
 }
 
 const fakePrivateKey = `
@@ -1083,12 +1120,16 @@ hHbOowWOqA2rxWxSHrkBTQju/uYQKG5GMnXWgZokUgwRDMaNMpdp03GG4Bgeg/06
 `
 
 type fakeOidcDiscoveryResponse struct {
-	Issuer      string   `json:"issuer"`
-	AuthURL     string   `json:"authorization_endpoint"`
-	TokenURL    string   `json:"token_endpoint"`
-	JWKSURL     string   `json:"jwks_uri"`
-	UserInfoURL string   `json:"userinfo_endpoint"`
-	Algorithms  []string `json:"id_token_signing_alg_values_supported"`
+	Issuer           string   `json:"issuer"`
+	AuthURL          string   `json:"authorization_endpoint"`
+	TokenURL         string   `json:"token_endpoint"`
+	JWKSURL          string   `json:"jwks_uri"`
+	UserInfoURL      string   `json:"userinfo_endpoint"`
+	EndSessionURL    string   `json:"end_session_endpoint"`
+	RevocationURL    string   `json:"revocation_endpoint"`
+	IntrospectionURL string   `json:"introspection_endpoint"`
+	DeviceURL        string   `json:"device_authorization_endpoint"`
+	Algorithms       []string `json:"id_token_signing_alg_values_supported"`
 }
 
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -1139,6 +1180,8 @@ func newFakeAuthServer(config *fakeAuthConfig) *fakeAuthServer {
 	router.Post(baseURI+"/protocol/openid-connect/logout", service.logoutHandler)
 	router.Post(baseURI+"/protocol/openid-connect/revoke", service.revocationHandler)
 	router.Post(baseURI+"/protocol/openid-connect/token", service.tokenHandler)
+	router.Post(baseURI+"/protocol/openid-connect/token/introspect", service.introspectionHandler)
+	router.Post(baseURI+"/protocol/openid-connect/auth/device", service.deviceHandler)
 	router.Get(baseURI+"/authz/protection/resource_set", service.ResourcesHandler)
 	router.Get(baseURI+"/authz/protection/resource_set/{id}", service.ResourceHandler)
 	router.Post(baseURI+"/authz/protection/permission", service.PermissionTicketHandler)
@@ -1211,12 +1254,16 @@ func (r *fakeAuthServer) discoveryHandler(wrt http.ResponseWriter, req *http.Req
 	)
 	baseWithProto := "/protocol/openid-connect"
 	renderJSON(http.StatusOK, wrt, req, fakeOidcDiscoveryResponse{
-		Issuer:      base,
-		AuthURL:     base + baseWithProto + "/auth",
-		TokenURL:    base + baseWithProto + "/token",
-		JWKSURL:     base + baseWithProto + "/certs",
-		UserInfoURL: base + baseWithProto + "/userinfo",
-		Algorithms:  []string{"RS256"},
+		Issuer:           base,
+		AuthURL:          base + baseWithProto + "/auth",
+		TokenURL:         base + baseWithProto + "/token",
+		JWKSURL:          base + baseWithProto + "/certs",
+		UserInfoURL:      base + baseWithProto + "/userinfo",
+		EndSessionURL:    base + baseWithProto + "/logout",
+		RevocationURL:    base + baseWithProto + "/revoke",
+		IntrospectionURL: base + baseWithProto + "/token/introspect",
+		DeviceURL:        base + baseWithProto + "/auth/device",
+		Algorithms:       []string{"RS256"},
 	})
 }
 
@@ -1242,6 +1289,19 @@ func (r *fakeAuthServer) authHandler(wrt http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	if challenge := req.URL.Query().Get("code_challenge"); challenge != "" {
+		if req.URL.Query().Get("code_challenge_method") != "S256" {
+			wrt.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r.codeChallenges.Store(randString, challenge)
+	}
+
+	if nonce := req.URL.Query().Get("nonce"); nonce != "" {
+		r.nonces.Store(randString, nonce)
+	}
+
 	redirectionURL := fmt.Sprintf("%s?state=%s&code=%s", redirect, state, randString)
 
 	http.Redirect(wrt, req, redirectionURL, http.StatusSeeOther)
@@ -1263,6 +1323,50 @@ func (r *fakeAuthServer) revocationHandler(wrt http.ResponseWriter, req *http.Re
 	wrt.WriteHeader(http.StatusOK)
 }
 
+// deviceHandler starts the device authorization of the fakeDeviceCode
+func (r *fakeAuthServer) deviceHandler(wrt http.ResponseWriter, req *http.Request) {
+	if clientID, secret, ok := req.BasicAuth(); !ok || clientID != fakeClientID || secret != fakeSecret {
+		renderJSON(http.StatusUnauthorized, wrt, req, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	renderJSON(http.StatusOK, wrt, req, map[string]interface{}{
+		"device_code":               fakeDeviceCode,
+		"user_code":                 fakeUserCode,
+		"verification_uri":          r.getLocation() + "/device",
+		"verification_uri_complete": r.getLocation() + "/device?user_code=" + fakeUserCode,
+		"expires_in":                600,
+		"interval":                  5,
+	})
+}
+
+// introspectionHandler reports only the fakeOpaqueToken as active
+func (r *fakeAuthServer) introspectionHandler(wrt http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&r.introspectionRequests, 1)
+
+	if clientID, secret, ok := req.BasicAuth(); !ok || clientID != fakeClientID || secret != fakeSecret {
+		wrt.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if req.FormValue("token") != fakeOpaqueToken {
+		renderJSON(http.StatusOK, wrt, req, map[string]interface{}{"active": false})
+		return
+	}
+
+	renderJSON(http.StatusOK, wrt, req, map[string]interface{}{
+		"active":             true,
+		"sub":                fakeSessionsSubject,
+		"exp":                time.Now().Add(r.expiration).Unix(),
+		"client_id":          fakeClientID,
+		"username":           "opaque-user",
+		"email":              "opaque@example.com",
+		"token_type":         "Bearer",
+		"resource_access":    map[string]interface{}{"role": map[string]interface{}{"roles": []string{"admin"}}},
+		"preferred_username": "",
+	})
+}
+
 func (r *fakeAuthServer) userInfoHandler(wrt http.ResponseWriter, req *http.Request) {
 	items := strings.Split(req.Header.Get("Authorization"), " ")
 	if len(items) != 2 {
@@ -1332,6 +1436,7 @@ func (r *fakeAuthServer) tokenHandler(writer http.ResponseWriter, req *http.Requ
 
 	switch req.FormValue("grant_type") {
 	case GrantTypeUserCreds:
+		atomic.AddInt32(&r.passwordRequests, 1)
 		username := req.FormValue("username")
 		password := req.FormValue("password")
 
@@ -1384,6 +1489,9 @@ func (r *fakeAuthServer) tokenHandler(writer http.ResponseWriter, req *http.Requ
 			"error_description": "invalid client credentials",
 		})
 	case GrantTypeRefreshToken:
+		atomic.AddInt32(&r.refreshRequests, 1)
+		time.Sleep(r.refreshDelay)
+
 		oldRefreshToken, err := jwt.ParseSigned(req.FormValue("refresh_token"))
 
 		if err != nil {
@@ -1428,11 +1536,81 @@ func (r *fakeAuthServer) tokenHandler(writer http.ResponseWriter, req *http.Requ
 			ExpiresIn:   float64(expires.Second()),
 		})
 	case GrantTypeAuthCode:
+		verifier := req.FormValue("code_verifier")
+		challenge, found := r.codeChallenges.LoadAndDelete(req.FormValue("code"))
+
+		if found || verifier != "" {
+			sum := sha256.Sum256([]byte(verifier))
+
+			if !found || challenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+				renderJSON(http.StatusBadRequest, writer, req, map[string]string{
+					"error":             "invalid_grant",
+					"error_description": "PKCE verification failed",
+				})
+				return
+			}
+
+			atomic.AddInt32(&r.pkceExchanges, 1)
+		}
+
+		jwtID := jwtAccess
+
+		if nonce, found := r.nonces.LoadAndDelete(req.FormValue("code")); found {
+			if jwtID, err = token.getToken(map[string]interface{}{"nonce": nonce}); err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		renderJSON(http.StatusOK, writer, req, tokenResponse{
+			IDToken:      jwtID,
+			AccessToken:  jwtAccess,
+			RefreshToken: jwtRefresh,
+			ExpiresIn:    float64(expires.Second()),
+		})
+	case GrantTypeDeviceCode:
+		if req.FormValue("device_code") != fakeDeviceCode {
+			renderJSON(http.StatusBadRequest, writer, req, map[string]string{"error": "expired_token"})
+			return
+		}
+
+		if atomic.AddInt32(&r.deviceTokenRequests, 1) == 1 {
+			renderJSON(http.StatusBadRequest, writer, req, map[string]string{"error": "authorization_pending"})
+			return
+		}
+
 		renderJSON(http.StatusOK, writer, req, tokenResponse{
 			IDToken:      jwtAccess,
 			AccessToken:  jwtAccess,
 			RefreshToken: jwtRefresh,
 			ExpiresIn:    float64(expires.Second()),
+			Scope:        "openid",
+		})
+	case GrantTypeTokenExchange:
+		atomic.AddInt32(&r.exchangeRequests, 1)
+
+		audience := req.FormValue("audience")
+
+		if req.FormValue("subject_token") == "" || audience == fakeForbiddenAudience {
+			renderJSON(http.StatusForbidden, writer, req, map[string]string{"error": "access_denied"})
+			return
+		}
+
+		jwtExchanged, err := token.getToken(map[string]interface{}{
+			"aud":   audience,
+			"scope": req.FormValue("scope"),
+		})
+
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		renderJSON(http.StatusOK, writer, req, map[string]interface{}{
+			"access_token":      jwtExchanged,
+			"issued_token_type": req.FormValue("requested_token_type"),
+			"token_type":        "Bearer",
+			"expires_in":        int64(r.expiration.Seconds()),
 		})
 	case GrantTypeUmaTicket:
 		renderJSON(http.StatusOK, writer, req, tokenResponse{
@@ -30,6 +30,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
 	"github.com/gogatekeeper/gatekeeper/pkg/constant"
 	"github.com/gogatekeeper/gatekeeper/pkg/utils"
 	yaml "gopkg.in/yaml.v2"
@@ -47,6 +48,11 @@ func newDefaultConfig() *Config {
 		AccessTokenDuration:           time.Duration(720) * time.Hour,
 		CookieAccessName:              constant.AccessCookie,
 		CookieRefreshName:             constant.RefreshCookie,
+		CookieSessionName:             constant.SessionCookie,
+		CookieIDTokenName:             constant.IDTokenCookie,
+		CookieSessionTimestampName:    constant.SessionTimeCookie,
+		CookiePKCEName:                constant.PKCECookie,
+		CookieNonceName:               constant.NonceCookie,
 		CookieOAuthStateName:          constant.RequestStateCookie,
 		CookieRequestURIName:          constant.RequestURICookie,
 		EnableAuthorizationCookies:    true,
@@ -88,6 +94,12 @@ func newDefaultConfig() *Config {
 		PatRetryCount:                 5,
 		PatRetryInterval:              10 * time.Second,
 		OpaTimeout:                    10 * time.Second,
+		StoreTimeout:                  2 * time.Second,
+		StoreBreakerThreshold:         5,
+		StoreBreakerCooldown:          30 * time.Second,
+		IntrospectionCacheTTL:         30 * time.Second,
+		DPoPProofMaxAge:               time.Minute,
+		APIKeyHeader:                  "X-API-Key",
 	}
 }
 
@@ -419,6 +431,26 @@ func (r *Config) isTokenVerificationSettingsValid() error {
 			r.isTokenEncryptionValid,
 			r.isSecureCookieValid,
 			r.isStoreURLValid,
+			r.isStoreResilienceValid,
+			r.isStoreEncryptionValid,
+			r.isServerSessionsValid,
+			r.isSessionLifetimeValid,
+			r.isSessionsAdminValid,
+			r.isBackchannelLogoutValid,
+			r.isPostLogoutRedirectURIsValid,
+			r.isProactiveRefreshValid,
+			r.isTokenIntrospectionValid,
+			r.isClaimMappingValid,
+			r.isIssuersValid,
+			r.isPKCEValid,
+			r.isNonceValid,
+			r.isDeviceFlowValid,
+			r.isTokenExchangeValid,
+			r.isDPoPValid,
+			r.isCertificateBoundTokensValid,
+			r.isVerifiedTokenCacheValid,
+			r.isAPIKeysValid,
+			r.isBasicAuthValid,
 		}
 
 		for _, validationFunc := range validationRegistry {
@@ -546,12 +578,21 @@ func (r *Config) isTokenEncryptionValid() error {
 		)
 	}
 
-	if r.EnableRefreshTokens && (len(r.EncryptionKey) != 16 &&
-		len(r.EncryptionKey) != 32) {
+	if r.EnableRefreshTokens {
+		return r.isEncryptionKeyValid("refresh tokens")
+	}
+
+	return nil
+}
+
+// isEncryptionKeyValid checks the encryption key required by the feature
+func (r *Config) isEncryptionKeyValid(feature string) error {
+	if len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32 {
 		return fmt.Errorf(
 			"the encryption key (%d) must be either 16 or 32 "+
-				"characters for AES-128/AES-256 selection",
+				"characters for AES-128/AES-256 selection, it is required by %s",
 			len(r.EncryptionKey),
+			feature,
 		)
 	}
 
@@ -579,6 +620,311 @@ func (r *Config) isStoreURLValid() error {
 	return nil
 }
 
+func (r *Config) isStoreResilienceValid() error {
+	if r.StoreTimeout < 0 {
+		return errors.New("the store timeout must be greater than or equal to zero")
+	}
+
+	if r.StoreBreakerThreshold < 0 {
+		return errors.New("the store breaker threshold must be greater than or equal to zero")
+	}
+
+	if r.StoreBreakerThreshold > 0 && r.StoreBreakerCooldown <= 0 {
+		return errors.New("the store breaker cooldown must be greater than zero when breaker is enabled")
+	}
+
+	return nil
+}
+
+func (r *Config) isStoreEncryptionValid() error {
+	if r.StoreEncryptionKey == "" {
+		return nil
+	}
+
+	if r.StoreURL == "" {
+		return errors.New("the store encryption key requires store url")
+	}
+
+	if len(r.StoreEncryptionKey) != 16 && len(r.StoreEncryptionKey) != 32 {
+		return fmt.Errorf(
+			"the store encryption key (%d) must be either 16 or 32 "+
+				"characters for AES-128/AES-256 selection",
+			len(r.StoreEncryptionKey),
+		)
+	}
+
+	return nil
+}
+
+func (r *Config) isServerSessionsValid() error {
+	if !r.EnableServerSessions {
+		return nil
+	}
+
+	if r.StoreURL == "" {
+		return errors.New("server sessions require store url")
+	}
+
+	if r.CookieSessionName == "" {
+		return errors.New("server sessions require session cookie name")
+	}
+
+	return r.isEncryptionKeyValid("server sessions")
+}
+
+func (r *Config) isSessionLifetimeValid() error {
+	if r.SessionIdleTimeout < 0 || r.SessionMaxLifetime < 0 {
+		return errors.New("session idle timeout and max lifetime must not be negative")
+	}
+
+	if r.SessionIdleTimeout == 0 && r.SessionMaxLifetime == 0 {
+		return nil
+	}
+
+	if r.CookieSessionTimestampName == "" {
+		return errors.New("session idle timeout and max lifetime require session timestamp cookie name")
+	}
+
+	return r.isEncryptionKeyValid("session idle timeout and max lifetime")
+}
+
+func (r *Config) isPKCEValid() error {
+	if !r.EnablePKCE {
+		return nil
+	}
+
+	if r.CookiePKCEName == "" {
+		return errors.New("pkce requires pkce cookie name")
+	}
+
+	return r.isEncryptionKeyValid("pkce")
+}
+
+func (r *Config) isNonceValid() error {
+	if !r.EnableNonce {
+		return nil
+	}
+
+	if r.CookieNonceName == "" {
+		return errors.New("nonce requires nonce cookie name")
+	}
+
+	return r.isEncryptionKeyValid("nonce")
+}
+
+func (r *Config) isDeviceFlowValid() error {
+	if !r.EnableDeviceFlow {
+		return nil
+	}
+
+	if r.ClientID == "" {
+		return errors.New("device flow requires client id")
+	}
+
+	if r.DeviceAuthorizationEndpoint != "" {
+		if _, err := url.ParseRequestURI(r.DeviceAuthorizationEndpoint); err != nil {
+			return fmt.Errorf("the device authorization url is invalid: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (r *Config) isDPoPValid() error {
+	if !r.EnableDPoP {
+		return nil
+	}
+
+	if r.DPoPProofMaxAge <= 0 {
+		return errors.New("dpop proof max age must be positive")
+	}
+
+	if r.SkipAuthorizationHeaderIdentity {
+		return errors.New("dpop cannot be used with skip authorization header identity")
+	}
+
+	return nil
+}
+
+func (r *Config) isCertificateBoundTokensValid() error {
+	if !r.EnableCertificateBoundTokens {
+		return nil
+	}
+
+	if r.TLSClientCertificate == "" {
+		return errors.New("certificate bound tokens require mutual tls, tls client certificate is not set")
+	}
+
+	return nil
+}
+
+func (r *Config) isVerifiedTokenCacheValid() error {
+	if r.VerifiedTokenCacheSize < 0 {
+		return errors.New("verified token cache size cannot be negative")
+	}
+
+	return nil
+}
+
+func (r *Config) isAPIKeysValid() error {
+	if !r.EnableAPIKeys {
+		return nil
+	}
+
+	if r.APIKeyHeader == "" {
+		return errors.New("api keys require api key header")
+	}
+
+	if r.APIKeysFile == "" && r.StoreURL == "" {
+		return errors.New("api keys require api keys file or store url")
+	}
+
+	if r.APIKeysFile != "" && !utils.FileExists(r.APIKeysFile) {
+		return fmt.Errorf("the api keys file %s does not exist", r.APIKeysFile)
+	}
+
+	return nil
+}
+
+func (r *Config) isBasicAuthValid() error {
+	if !r.useBasicAuth() {
+		return nil
+	}
+
+	if r.ClientID == "" {
+		return errors.New("basic auth of the resources requires client id")
+	}
+
+	if r.SkipAuthorizationHeaderIdentity {
+		return errors.New("basic auth of the resources cannot be used with skip authorization header identity")
+	}
+
+	return nil
+}
+
+func (r *Config) isTokenExchangeValid() error {
+	if len(r.TokenExchangeScopes) > 0 && r.TokenExchangeAudience == "" {
+		return errors.New("token exchange scopes require token exchange audience")
+	}
+
+	if r.useTokenExchange() && (r.ClientID == "" || r.ClientSecret == "") {
+		return errors.New("token exchange requires client id and client secret")
+	}
+
+	return nil
+}
+
+// useTokenExchange returns true when the token is exchanged before forwarding to any resource
+func (r *Config) useTokenExchange() bool {
+	if r.TokenExchangeAudience != "" {
+		return true
+	}
+
+	for _, res := range r.Resources {
+		if res.ExchangeAudience != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// useBasicAuth indicates any of the resources accepts the basic credentials
+func (r *Config) useBasicAuth() bool {
+	for _, res := range r.Resources {
+		if res.BasicAuth {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getTokenExchange returns the audience and scopes the token is exchanged for before forwarding
+// to the resource, the settings of the resource take precedence
+func (r *Config) getTokenExchange(res *authorization.Resource) (string, []string) {
+	if res.ExchangeAudience != "" {
+		return res.ExchangeAudience, res.ExchangeScopes
+	}
+
+	return r.TokenExchangeAudience, r.TokenExchangeScopes
+}
+
+func (r *Config) isProactiveRefreshValid() error {
+	if r.ProactiveRefreshPercent < 0 || r.ProactiveRefreshPercent >= 100 {
+		return errors.New("proactive refresh percent must be between 0 and 99")
+	}
+
+	if r.ProactiveRefreshPercent > 0 && !r.EnableRefreshTokens {
+		return errors.New("proactive refresh requires enable refresh tokens")
+	}
+
+	return nil
+}
+
+func (r *Config) isTokenIntrospectionValid() error {
+	if !r.EnableTokenIntrospection {
+		return nil
+	}
+
+	if r.ClientID == "" || r.ClientSecret == "" {
+		return errors.New("token introspection requires client id and client secret")
+	}
+
+	if r.IntrospectionCacheTTL < 0 {
+		return errors.New("introspection cache ttl must not be negative")
+	}
+
+	// the opaque tokens do not tell which of the issuers to ask
+	if len(r.Issuers) > 0 {
+		return errors.New("token introspection cannot be used with additional issuers")
+	}
+
+	if r.IntrospectionEndpoint != "" {
+		if _, err := url.ParseRequestURI(r.IntrospectionEndpoint); err != nil {
+			return fmt.Errorf("the introspection url is invalid: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (r *Config) isSessionsAdminValid() error {
+	if !r.EnableSessionsAdmin {
+		return nil
+	}
+
+	if r.StoreURL == "" {
+		return errors.New("sessions admin api requires store url")
+	}
+
+	if len(r.SessionsAdminRoles) == 0 {
+		return errors.New("sessions admin api requires at least one admin role")
+	}
+
+	return nil
+}
+
+func (r *Config) isBackchannelLogoutValid() error {
+	if r.EnableBackchannelLogout && r.StoreURL == "" {
+		return errors.New("back-channel logout requires store url")
+	}
+
+	return nil
+}
+
+func (r *Config) isPostLogoutRedirectURIsValid() error {
+	for _, redirect := range r.PostLogoutRedirectURIs {
+		location, err := url.Parse(redirect)
+
+		if err != nil || location.Scheme == "" || location.Host == "" {
+			return fmt.Errorf("post logout redirect uri %s must be absolute url", redirect)
+		}
+	}
+
+	return nil
+}
+
 func (r *Config) isResourceValid() error {
 	// step: add custom http methods for check
 	if r.CustomHTTPMethods != nil {
@@ -705,3 +1051,63 @@ func (r *Config) extractDiscoveryURIComponents() error {
 	r.Realm = matches[realmIndex]
 	return nil
 }
+
+func (r *Config) isClaimMappingValid() error {
+	return r.getDefaultIssuerConfig().isClaimMappingValid()
+}
+
+func (r *Config) isIssuersValid() error {
+	names := make(map[string]bool)
+
+	for _, issuer := range r.Issuers {
+		if issuer.Name == "" {
+			return errors.New("issuer name must be set")
+		}
+
+		if names[issuer.Name] {
+			return fmt.Errorf("issuer %s is defined more than once", issuer.Name)
+		}
+
+		names[issuer.Name] = true
+
+		if _, err := url.ParseRequestURI(issuer.DiscoveryURL); err != nil {
+			return fmt.Errorf("the discovery url of issuer %s is invalid: %w", issuer.Name, err)
+		}
+
+		if issuer.ClientID == "" {
+			return fmt.Errorf("client id of issuer %s must be set", issuer.Name)
+		}
+
+		if issuer.Audience != "" && issuer.SkipAccessTokenClientIDCheck {
+			return fmt.Errorf("audience of issuer %s is not checked with skip-access-token-clientid-check", issuer.Name)
+		}
+
+		for _, path := range issuer.Paths {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("path %s of issuer %s must start with /", path, issuer.Name)
+			}
+		}
+
+		if err := issuer.isClaimMappingValid(); err != nil {
+			return fmt.Errorf("issuer %s: %w", issuer.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// getDefaultIssuerConfig returns the issuer configuration of the discovery url
+func (r *Config) getDefaultIssuerConfig() *IssuerConfig {
+	return &IssuerConfig{
+		DiscoveryURL:                 r.DiscoveryURL,
+		ClientID:                     r.ClientID,
+		ClientSecret:                 r.ClientSecret,
+		SkipAccessTokenClientIDCheck: r.SkipAccessTokenClientIDCheck,
+		RolesClaims:                  r.RolesClaims,
+		ClientRolesClaims:            r.ClientRolesClaims,
+		ClientRolesPrefix:            r.ClientRolesPrefix,
+		GroupsClaims:                 r.GroupsClaims,
+		UsernameClaims:               r.UsernameClaims,
+		EmailClaims:                  r.EmailClaims,
+	}
+}
@@ -1756,6 +1756,341 @@ func TestIsStoreURLValid(t *testing.T) {
 	}
 }
 
+func TestIsStoreEncryptionValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidWithoutStoreEncryptionKey",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidStoreEncryptionKey",
+			Config: &Config{
+				StoreURL:           "redis://127.0.0.1:6379",
+				StoreEncryptionKey: testEncryptionKey,
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidStoreEncryptionKeyLength",
+			Config: &Config{
+				StoreURL:           "redis://127.0.0.1:6379",
+				StoreEncryptionKey: "short",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidStoreEncryptionKeyWithoutStore",
+			Config: &Config{
+				StoreEncryptionKey: testEncryptionKey,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isStoreEncryptionValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsServerSessionsValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidServerSessionsDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidServerSessions",
+			Config: &Config{
+				EnableServerSessions: true,
+				StoreURL:             "redis://127.0.0.1:6379",
+				EncryptionKey:        testEncryptionKey,
+				CookieSessionName:    "kc-session",
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidServerSessionsWithoutStore",
+			Config: &Config{
+				EnableServerSessions: true,
+				EncryptionKey:        testEncryptionKey,
+				CookieSessionName:    "kc-session",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidServerSessionsWithoutEncryptionKey",
+			Config: &Config{
+				EnableServerSessions: true,
+				StoreURL:             "redis://127.0.0.1:6379",
+				CookieSessionName:    "kc-session",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidServerSessionsWithoutCookieName",
+			Config: &Config{
+				EnableServerSessions: true,
+				StoreURL:             "redis://127.0.0.1:6379",
+				EncryptionKey:        testEncryptionKey,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isServerSessionsValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsSessionLifetimeValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidSessionLifetimeDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidSessionLifetime",
+			Config: &Config{
+				SessionIdleTimeout:         30 * time.Minute,
+				SessionMaxLifetime:         8 * time.Hour,
+				CookieSessionTimestampName: "kc-session-time",
+				EncryptionKey:              testEncryptionKey,
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidNegativeIdleTimeout",
+			Config: &Config{
+				SessionIdleTimeout:         -time.Minute,
+				CookieSessionTimestampName: "kc-session-time",
+				EncryptionKey:              testEncryptionKey,
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidSessionLifetimeWithoutEncryptionKey",
+			Config: &Config{
+				SessionMaxLifetime:         8 * time.Hour,
+				CookieSessionTimestampName: "kc-session-time",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidSessionLifetimeWithoutCookieName",
+			Config: &Config{
+				SessionIdleTimeout: 30 * time.Minute,
+				EncryptionKey:      testEncryptionKey,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isSessionLifetimeValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsSessionsAdminValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidSessionsAdminDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidSessionsAdmin",
+			Config: &Config{
+				EnableSessionsAdmin: true,
+				StoreURL:            "redis://127.0.0.1:6379",
+				SessionsAdminRoles:  []string{"admin"},
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidSessionsAdminWithoutStore",
+			Config: &Config{
+				EnableSessionsAdmin: true,
+				SessionsAdminRoles:  []string{"admin"},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidSessionsAdminWithoutRoles",
+			Config: &Config{
+				EnableSessionsAdmin: true,
+				StoreURL:            "redis://127.0.0.1:6379",
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isSessionsAdminValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsBackchannelLogoutValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidBackchannelLogoutDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidBackchannelLogout",
+			Config: &Config{
+				EnableBackchannelLogout: true,
+				StoreURL:                "redis://127.0.0.1:6379",
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidBackchannelLogoutWithoutStore",
+			Config: &Config{
+				EnableBackchannelLogout: true,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isBackchannelLogoutValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsPostLogoutRedirectURIsValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidWithoutRedirects",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidAbsoluteRedirects",
+			Config: &Config{
+				PostLogoutRedirectURIs: []string{"https://example.com/logged-out", "http://127.0.0.1:3000"},
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidRelativeRedirect",
+			Config: &Config{
+				PostLogoutRedirectURIs: []string{"/logged-out"},
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isPostLogoutRedirectURIsValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
 func TestIsResourceValid(t *testing.T) {
 	testCases := []struct {
 		Name   string
@@ -2222,3 +2557,954 @@ func TestDefaultDenyValid(t *testing.T) {
 		)
 	}
 }
+
+func TestIsProactiveRefreshValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidProactiveRefreshDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidProactiveRefresh",
+			Config: &Config{
+				EnableRefreshTokens:     true,
+				ProactiveRefreshPercent: 80,
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidProactiveRefreshWithoutRefreshTokens",
+			Config: &Config{
+				ProactiveRefreshPercent: 80,
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidNegativeProactiveRefreshPercent",
+			Config: &Config{
+				EnableRefreshTokens:     true,
+				ProactiveRefreshPercent: -1,
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidProactiveRefreshPercentOver99",
+			Config: &Config{
+				EnableRefreshTokens:     true,
+				ProactiveRefreshPercent: 100,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isProactiveRefreshValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsEncryptionKeyValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidAES128Key",
+			Config: &Config{EncryptionKey: "sdkljfalisujeyia"},
+			Valid:  true,
+		},
+		{
+			Name:   "ValidAES256Key",
+			Config: &Config{EncryptionKey: "sdkljfalisujeyiasdkljfalisujeyia"},
+			Valid:  true,
+		},
+		{
+			Name:   "InValidMissingKey",
+			Config: &Config{},
+			Valid:  false,
+		},
+		{
+			Name:   "InValidKeyLength",
+			Config: &Config{EncryptionKey: "short"},
+			Valid:  false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isEncryptionKeyValid("test")
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsTokenIntrospectionValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidTokenIntrospectionDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidTokenIntrospection",
+			Config: &Config{
+				EnableTokenIntrospection: true,
+				ClientID:                 "test",
+				ClientSecret:             "test",
+				IntrospectionCacheTTL:    time.Minute,
+				IntrospectionEndpoint:    "https://idp.example.com/introspect",
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidTokenIntrospectionWithoutSecret",
+			Config: &Config{
+				EnableTokenIntrospection: true,
+				ClientID:                 "test",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidNegativeIntrospectionCacheTTL",
+			Config: &Config{
+				EnableTokenIntrospection: true,
+				ClientID:                 "test",
+				ClientSecret:             "test",
+				IntrospectionCacheTTL:    -time.Minute,
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidIntrospectionURL",
+			Config: &Config{
+				EnableTokenIntrospection: true,
+				ClientID:                 "test",
+				ClientSecret:             "test",
+				IntrospectionEndpoint:    "not a url",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidTokenIntrospectionWithIssuers",
+			Config: &Config{
+				EnableTokenIntrospection: true,
+				ClientID:                 "test",
+				ClientSecret:             "test",
+				Issuers:                  []*IssuerConfig{{Name: "partner"}},
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isTokenIntrospectionValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsClaimMappingValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidClaimMappingDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidClaimMapping",
+			Config: &Config{
+				RolesClaims:       []string{"roles", "https://example.com/roles"},
+				ClientRolesClaims: []string{"apps.*.roles"},
+				ClientRolesPrefix: "api",
+				GroupsClaims:      []string{"groups"},
+				UsernameClaims:    []string{"nickname", "sub"},
+				EmailClaims:       []string{"mail"},
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidEmptyRolesClaim",
+			Config: &Config{
+				RolesClaims: []string{"roles", ""},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidEmptyUsernameClaim",
+			Config: &Config{
+				UsernameClaims: []string{" "},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidClientRolesPrefix",
+			Config: &Config{
+				ClientRolesPrefix: "api:",
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isClaimMappingValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsIssuersValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidWithoutIssuers",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidIssuers",
+			Config: &Config{
+				Issuers: []*IssuerConfig{
+					{
+						Name:         "partner",
+						DiscoveryURL: "https://sso.example.com/realms/partner",
+						ClientID:     "test",
+						Hosts:        []string{"partner.example.com"},
+						Paths:        []string{"/partner"},
+						RolesClaims:  []string{"roles"},
+					},
+				},
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidIssuerWithoutName",
+			Config: &Config{
+				Issuers: []*IssuerConfig{
+					{
+						DiscoveryURL: "https://sso.example.com/realms/partner",
+						ClientID:     "test",
+					},
+				},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidDuplicateIssuer",
+			Config: &Config{
+				Issuers: []*IssuerConfig{
+					{
+						Name:         "partner",
+						DiscoveryURL: "https://sso.example.com/realms/partner",
+						ClientID:     "test",
+					},
+					{
+						Name:         "partner",
+						DiscoveryURL: "https://sso.example.com/realms/other",
+						ClientID:     "test",
+					},
+				},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidIssuerDiscoveryURL",
+			Config: &Config{
+				Issuers: []*IssuerConfig{
+					{
+						Name:         "partner",
+						DiscoveryURL: "not a url",
+						ClientID:     "test",
+					},
+				},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidIssuerWithoutClientID",
+			Config: &Config{
+				Issuers: []*IssuerConfig{
+					{
+						Name:         "partner",
+						DiscoveryURL: "https://sso.example.com/realms/partner",
+					},
+				},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidIssuerPath",
+			Config: &Config{
+				Issuers: []*IssuerConfig{
+					{
+						Name:         "partner",
+						DiscoveryURL: "https://sso.example.com/realms/partner",
+						ClientID:     "test",
+						Paths:        []string{"partner"},
+					},
+				},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidIssuerClaimMapping",
+			Config: &Config{
+				Issuers: []*IssuerConfig{
+					{
+						Name:         "partner",
+						DiscoveryURL: "https://sso.example.com/realms/partner",
+						ClientID:     "test",
+						GroupsClaims: []string{""},
+					},
+				},
+			},
+			Valid: false,
+		},
+		{
+			Name: "ValidIssuerAudience",
+			Config: &Config{
+				Issuers: []*IssuerConfig{
+					{
+						Name:         "partner",
+						DiscoveryURL: "https://sso.example.com/realms/partner",
+						ClientID:     "test",
+						Audience:     "partner-api",
+					},
+				},
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidIssuerAudienceWithSkippedCheck",
+			Config: &Config{
+				Issuers: []*IssuerConfig{
+					{
+						Name:                         "partner",
+						DiscoveryURL:                 "https://sso.example.com/realms/partner",
+						ClientID:                     "test",
+						Audience:                     "partner-api",
+						SkipAccessTokenClientIDCheck: true,
+					},
+				},
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isIssuersValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsPKCEValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidPKCEDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidPKCE",
+			Config: &Config{
+				EnablePKCE:     true,
+				CookiePKCEName: "kc-pkce",
+				EncryptionKey:  testEncryptionKey,
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidPKCEWithoutEncryptionKey",
+			Config: &Config{
+				EnablePKCE:     true,
+				CookiePKCEName: "kc-pkce",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidPKCEWithoutCookieName",
+			Config: &Config{
+				EnablePKCE:    true,
+				EncryptionKey: testEncryptionKey,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isPKCEValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsNonceValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidNonceDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidNonce",
+			Config: &Config{
+				EnableNonce:     true,
+				CookieNonceName: "kc-nonce",
+				EncryptionKey:   testEncryptionKey,
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidNonceWithoutEncryptionKey",
+			Config: &Config{
+				EnableNonce:     true,
+				CookieNonceName: "kc-nonce",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidNonceWithoutCookieName",
+			Config: &Config{
+				EnableNonce:   true,
+				EncryptionKey: testEncryptionKey,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isNonceValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsDeviceFlowValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidDeviceFlowDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidDeviceFlow",
+			Config: &Config{
+				EnableDeviceFlow: true,
+				ClientID:         "test",
+			},
+			Valid: true,
+		},
+		{
+			Name: "ValidDeviceFlowWithEndpoint",
+			Config: &Config{
+				EnableDeviceFlow:            true,
+				ClientID:                    "test",
+				DeviceAuthorizationEndpoint: "https://idp.example.com/device",
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidDeviceFlowWithoutClientID",
+			Config: &Config{
+				EnableDeviceFlow: true,
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidDeviceFlowWithInvalidEndpoint",
+			Config: &Config{
+				EnableDeviceFlow:            true,
+				ClientID:                    "test",
+				DeviceAuthorizationEndpoint: "not-url",
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isDeviceFlowValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsTokenExchangeValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidTokenExchangeDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidTokenExchange",
+			Config: &Config{
+				TokenExchangeAudience: "upstream",
+				TokenExchangeScopes:   []string{"read"},
+				ClientID:              "test",
+				ClientSecret:          "test",
+			},
+			Valid: true,
+		},
+		{
+			Name: "ValidResourceTokenExchange",
+			Config: &Config{
+				ClientID:     "test",
+				ClientSecret: "test",
+				Resources: []*authorization.Resource{
+					{URL: "/orders/*", ExchangeAudience: "orders"},
+				},
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidTokenExchangeWithoutClientSecret",
+			Config: &Config{
+				TokenExchangeAudience: "upstream",
+				ClientID:              "test",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidResourceTokenExchangeWithoutClientSecret",
+			Config: &Config{
+				ClientID: "test",
+				Resources: []*authorization.Resource{
+					{URL: "/orders/*", ExchangeAudience: "orders"},
+				},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidTokenExchangeScopesWithoutAudience",
+			Config: &Config{
+				TokenExchangeScopes: []string{"read"},
+				ClientID:            "test",
+				ClientSecret:        "test",
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isTokenExchangeValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsDPoPValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidDPoPDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidDPoP",
+			Config: &Config{
+				EnableDPoP:      true,
+				DPoPProofMaxAge: time.Minute,
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidDPoPWithoutProofMaxAge",
+			Config: &Config{
+				EnableDPoP: true,
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidDPoPWithSkipAuthorizationHeaderIdentity",
+			Config: &Config{
+				EnableDPoP:                      true,
+				DPoPProofMaxAge:                 time.Minute,
+				SkipAuthorizationHeaderIdentity: true,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isDPoPValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsCertificateBoundTokensValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidCertificateBoundTokensDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidCertificateBoundTokens",
+			Config: &Config{
+				EnableCertificateBoundTokens: true,
+				TLSClientCertificate:         "/etc/gatekeeper/ca.pem",
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidCertificateBoundTokensWithoutMutualTLS",
+			Config: &Config{
+				EnableCertificateBoundTokens: true,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isCertificateBoundTokensValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsVerifiedTokenCacheValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidCacheDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidCacheSize",
+			Config: &Config{
+				VerifiedTokenCacheSize: 1000,
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidNegativeCacheSize",
+			Config: &Config{
+				VerifiedTokenCacheSize: -1,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isVerifiedTokenCacheValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsAPIKeysValid(t *testing.T) {
+	file := writeFakeConfigFile(t, "[]")
+	defer os.Remove(file.Name())
+
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidAPIKeysDisabled",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidAPIKeysFile",
+			Config: &Config{
+				EnableAPIKeys: true,
+				APIKeyHeader:  "X-API-Key",
+				APIKeysFile:   file.Name(),
+			},
+			Valid: true,
+		},
+		{
+			Name: "ValidAPIKeysInStore",
+			Config: &Config{
+				EnableAPIKeys: true,
+				APIKeyHeader:  "X-API-Key",
+				StoreURL:      "redis://127.0.0.1:6379",
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidMissingAPIKeyHeader",
+			Config: &Config{
+				EnableAPIKeys: true,
+				APIKeysFile:   file.Name(),
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidMissingAPIKeysSource",
+			Config: &Config{
+				EnableAPIKeys: true,
+				APIKeyHeader:  "X-API-Key",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidMissingAPIKeysFile",
+			Config: &Config{
+				EnableAPIKeys: true,
+				APIKeyHeader:  "X-API-Key",
+				APIKeysFile:   "/tmp/missing-api-keys.yaml",
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isAPIKeysValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsBasicAuthValid(t *testing.T) {
+	basicAuthResources := []*authorization.Resource{
+		{
+			URL:       "/legacy/*",
+			BasicAuth: true,
+		},
+	}
+
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidBasicAuthNotUsed",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidBasicAuth",
+			Config: &Config{
+				ClientID:  "test",
+				Resources: basicAuthResources,
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidMissingClientID",
+			Config: &Config{
+				Resources: basicAuthResources,
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidSkipAuthorizationHeaderIdentity",
+			Config: &Config{
+				ClientID:                        "test",
+				Resources:                       basicAuthResources,
+				SkipAuthorizationHeaderIdentity: true,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isBasicAuthValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
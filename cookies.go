@@ -134,6 +134,22 @@ func (r *oauthProxy) dropRefreshTokenCookie(req *http.Request, w http.ResponseWr
 	r.dropCookieWithChunks(req, w, r.config.CookieRefreshName, value, duration)
 }
 
+// dropSessionCookie drops a server side session id cookie from the response
+func (r *oauthProxy) dropSessionCookie(req *http.Request, w http.ResponseWriter, sessionID string, duration time.Duration) {
+	r.dropCookie(w, req.Host, r.config.CookieSessionName, sessionID, duration)
+}
+
+// useIDTokenCookie checks if the encrypted id token is kept in the cookie, so it can be
+// sent as id_token_hint on logout, server side sessions keep it in the store
+func (r *oauthProxy) useIDTokenCookie() bool {
+	return r.config.EnableLogoutRedirect && !r.config.EnableServerSessions && r.config.EncryptionKey != ""
+}
+
+// dropIDTokenCookie drops a encrypted id token cookie from the response
+func (r *oauthProxy) dropIDTokenCookie(req *http.Request, w http.ResponseWriter, value string, duration time.Duration) {
+	r.dropCookieWithChunks(req, w, r.config.CookieIDTokenName, value, duration)
+}
+
 // writeStateParameterCookie sets a state parameter cookie into the response
 func (r *oauthProxy) writeStateParameterCookie(req *http.Request, wrt http.ResponseWriter) string {
 	uuid, err := uuid.NewV4()
@@ -161,6 +177,45 @@ func (r *oauthProxy) writeStateParameterCookie(req *http.Request, wrt http.Respo
 func (r *oauthProxy) clearAllCookies(req *http.Request, w http.ResponseWriter) {
 	r.clearAccessTokenCookie(req, w)
 	r.clearRefreshTokenCookie(req, w)
+
+	if r.config.EnableServerSessions {
+		r.clearSessionCookie(req, w)
+	}
+
+	if r.useIDTokenCookie() {
+		r.clearIDTokenCookie(req, w)
+	}
+
+	if r.useSessionTimestamps() {
+		r.clearSessionTimestampsCookie(req, w)
+	}
+}
+
+// clearIDTokenCookie clears the id token cookie
+func (r *oauthProxy) clearIDTokenCookie(req *http.Request, wrt http.ResponseWriter) {
+	r.dropCookie(wrt, req.Host, r.config.CookieIDTokenName, "", -10*time.Hour)
+
+	// clear divided cookies
+	for idx := 1; idx < 600; idx++ {
+		var _, err = req.Cookie(r.config.CookieIDTokenName + "-" + strconv.Itoa(idx))
+
+		if err == nil {
+			r.dropCookie(
+				wrt,
+				req.Host,
+				r.config.CookieIDTokenName+"-"+strconv.Itoa(idx),
+				"",
+				-10*time.Hour,
+			)
+		} else {
+			break
+		}
+	}
+}
+
+// clearSessionCookie clears the server side session id cookie
+func (r *oauthProxy) clearSessionCookie(req *http.Request, wrt http.ResponseWriter) {
+	r.dropCookie(wrt, req.Host, r.config.CookieSessionName, "", -10*time.Hour)
 }
 
 // clearRefreshSessionCookie clears the session cookie
@@ -0,0 +1,238 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// deviceAuthorizationResponse is the response of the device authorization endpoint
+// https://www.rfc-editor.org/rfc/rfc8628#section-3.2
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval,omitempty"`
+}
+
+// deviceTokenResponse is the successful response of the token endpoint to the device
+// https://www.rfc-editor.org/rfc/rfc8628#section-3.5
+type deviceTokenResponse struct {
+	AccessToken  string  `json:"access_token"`
+	IDToken      string  `json:"id_token"`
+	RefreshToken string  `json:"refresh_token"`
+	ExpiresIn    float64 `json:"expires_in"`
+	Scope        string  `json:"scope"`
+}
+
+// getDeviceAuthorizationURL returns the device authorization endpoint, configured one takes
+// precedence over the one advertised by the provider
+func (r *oauthProxy) getDeviceAuthorizationURL() string {
+	return utils.DefaultTo(
+		r.config.DeviceAuthorizationEndpoint,
+		r.getProviderEndpoints(nil).DeviceAuthorizationEndpoint,
+	)
+}
+
+// postDeviceRequest posts the form to the provider endpoint with the client credentials and
+// returns the status and content of the response
+func (r *oauthProxy) postDeviceRequest(endpoint string, values url.Values, label string) (int, []byte, error) {
+	values.Set("client_id", r.config.ClientID)
+
+	request, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to construct the %s request: %w", label, err)
+	}
+
+	request.SetBasicAuth(url.QueryEscape(r.config.ClientID), url.QueryEscape(r.config.ClientSecret))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+	response, err := r.providerClient.Do(request)
+
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to post to %s endpoint: %w", label, err)
+	}
+
+	defer response.Body.Close()
+
+	oauthLatencyMetric.WithLabelValues(label).
+		Observe(time.Since(start).Seconds())
+
+	content, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return response.StatusCode, content, nil
+}
+
+// writeDeviceResponse writes the json content to the device, responses are never cached
+func writeDeviceResponse(wrt http.ResponseWriter, code int, content []byte) {
+	wrt.Header().Set("Content-Type", "application/json")
+	wrt.Header().Set("Cache-Control", "no-store")
+	wrt.WriteHeader(code)
+	_, _ = wrt.Write(content)
+}
+
+// deviceAuthorizationHandler starts the device authorization flow at the provider and returns
+// the user code and the verification uri the user has to visit
+// https://www.rfc-editor.org/rfc/rfc8628#section-3.1
+func (r *oauthProxy) deviceAuthorizationHandler(wrt http.ResponseWriter, req *http.Request) {
+	deviceURL := r.getDeviceAuthorizationURL()
+
+	if deviceURL == "" {
+		r.log.Error("unable to start the device flow", zap.Error(apperrors.ErrNoDeviceAuthorizationEndpoint))
+		wrt.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	conf := r.newOAuth2Config(nil, "")
+	values := url.Values{"scope": {strings.Join(conf.Scopes, " ")}}
+	code, content, err := r.postDeviceRequest(deviceURL, values, "device_authorization")
+
+	if err != nil {
+		r.log.Error("unable to start the device flow", zap.Error(err))
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the provider errors are relayed, the device has to know why it was refused
+	if code != http.StatusOK {
+		r.log.Warn(
+			"device authorization refused by the provider",
+			zap.Int("status", code),
+			zap.String("response", string(content)),
+		)
+		writeDeviceResponse(wrt, code, content)
+		return
+	}
+
+	resp := &deviceAuthorizationResponse{}
+
+	if err := json.Unmarshal(content, resp); err != nil || resp.DeviceCode == "" || resp.UserCode == "" {
+		r.log.Error(
+			"invalid response from device authorization endpoint",
+			zap.Error(err),
+			zap.String("response", string(content)),
+		)
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	content, err = json.Marshal(resp)
+
+	if err != nil {
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeDeviceResponse(wrt, http.StatusOK, content)
+}
+
+// deviceTokenHandler polls the token endpoint once with the device code, the pending and
+// slow down errors are relayed so the device keeps polling, once the user has authorized the
+// device the tokens are returned the same way as by the login handler
+// https://www.rfc-editor.org/rfc/rfc8628#section-3.4
+func (r *oauthProxy) deviceTokenHandler(wrt http.ResponseWriter, req *http.Request) {
+	deviceCode := req.PostFormValue("device_code")
+
+	if deviceCode == "" {
+		writeDeviceResponse(wrt, http.StatusBadRequest, []byte(`{"error":"invalid_request"}`))
+		return
+	}
+
+	conf := r.newOAuth2Config(nil, "")
+	values := url.Values{
+		"grant_type":  {GrantTypeDeviceCode},
+		"device_code": {deviceCode},
+	}
+	code, content, err := r.postDeviceRequest(conf.Endpoint.TokenURL, values, "device_token")
+
+	if err != nil {
+		r.log.Error("unable to request the device token", zap.Error(err))
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// authorization_pending, slow_down, access_denied and expired_token are for the device
+	if code != http.StatusOK {
+		writeDeviceResponse(wrt, code, content)
+		return
+	}
+
+	token := &deviceTokenResponse{}
+
+	if err := json.Unmarshal(content, token); err != nil || token.AccessToken == "" {
+		r.log.Error(
+			"invalid response from token endpoint to the device",
+			zap.Error(err),
+		)
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := tokenResponse{
+		IDToken:      token.IDToken,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		ExpiresIn:    token.ExpiresIn,
+		Scope:        token.Scope,
+	}
+
+	// step: are we encrypting the tokens?
+	if r.config.EnableEncryptedToken {
+		for _, value := range []*string{&resp.IDToken, &resp.AccessToken, &resp.RefreshToken} {
+			if *value == "" {
+				continue
+			}
+
+			if *value, err = encryption.EncodeText(*value, r.config.EncryptionKey); err != nil {
+				r.log.Error("unable to encode the device tokens", zap.Error(err))
+				wrt.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	// @metric a token has been issued
+	oauthTokensMetric.WithLabelValues("device").Inc()
+
+	content, err = json.Marshal(resp)
+
+	if err != nil {
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeDeviceResponse(wrt, http.StatusOK, content)
+}
@@ -0,0 +1,187 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestDeviceFlow(t *testing.T) {
+	deviceForm := map[string]string{"device_code": fakeDeviceCode}
+
+	testCases := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name:          "TestDeviceAuthorization",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:          "/oauth/device",
+					Method:       http.MethodPost,
+					ExpectedCode: http.StatusOK,
+					ExpectedContent: func(body string, testNum int) {
+						resp := &deviceAuthorizationResponse{}
+						assert.NoError(t, json.Unmarshal([]byte(body), resp))
+						assert.Equal(t, fakeDeviceCode, resp.DeviceCode)
+						assert.Equal(t, fakeUserCode, resp.UserCode)
+						assert.Contains(t, resp.VerificationURI, "/device")
+						assert.Contains(t, resp.VerificationURIComplete, fakeUserCode)
+						assert.Equal(t, int64(600), resp.ExpiresIn)
+						assert.Equal(t, int64(5), resp.Interval)
+					},
+				},
+			},
+		},
+		{
+			Name: "TestDeviceAuthorizationRefusedByProvider",
+			ProxySettings: func(c *Config) {
+				c.ClientSecret = "wrong"
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:                     "/oauth/device",
+					Method:                  http.MethodPost,
+					ExpectedCode:            http.StatusUnauthorized,
+					ExpectedContentContains: "invalid_client",
+				},
+			},
+		},
+		{
+			Name:          "TestDeviceTokenPolling",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:                     "/oauth/device/token",
+					Method:                  http.MethodPost,
+					FormValues:              deviceForm,
+					ExpectedCode:            http.StatusBadRequest,
+					ExpectedContentContains: "authorization_pending",
+				},
+				{
+					URI:          "/oauth/device/token",
+					Method:       http.MethodPost,
+					FormValues:   deviceForm,
+					ExpectedCode: http.StatusOK,
+					ExpectedContent: func(body string, testNum int) {
+						resp := &tokenResponse{}
+						assert.NoError(t, json.Unmarshal([]byte(body), resp))
+						assert.NotEmpty(t, resp.RefreshToken)
+						assert.NotEmpty(t, resp.IDToken)
+						assert.Equal(t, "openid", resp.Scope)
+
+						_, err := jwt.ParseSigned(resp.AccessToken)
+						assert.NoError(t, err)
+					},
+				},
+			},
+		},
+		{
+			Name: "TestDeviceTokenEncrypted",
+			ProxySettings: func(c *Config) {
+				c.EnableEncryptedToken = true
+				c.EncryptionKey = testEncryptionKey
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:          "/oauth/device/token",
+					Method:       http.MethodPost,
+					FormValues:   deviceForm,
+					ExpectedCode: http.StatusBadRequest,
+				},
+				{
+					URI:          "/oauth/device/token",
+					Method:       http.MethodPost,
+					FormValues:   deviceForm,
+					ExpectedCode: http.StatusOK,
+					ExpectedContent: func(body string, testNum int) {
+						resp := &tokenResponse{}
+						assert.NoError(t, json.Unmarshal([]byte(body), resp))
+
+						accessToken, err := encryption.DecodeText(resp.AccessToken, testEncryptionKey)
+						assert.NoError(t, err)
+
+						_, err = jwt.ParseSigned(accessToken)
+						assert.NoError(t, err)
+					},
+				},
+			},
+		},
+		{
+			Name:          "TestDeviceTokenWithExpiredCode",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:                     "/oauth/device/token",
+					Method:                  http.MethodPost,
+					FormValues:              map[string]string{"device_code": "expired"},
+					ExpectedCode:            http.StatusBadRequest,
+					ExpectedContentContains: "expired_token",
+				},
+			},
+		},
+		{
+			Name:          "TestDeviceTokenWithoutCode",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:                     "/oauth/device/token",
+					Method:                  http.MethodPost,
+					ExpectedCode:            http.StatusBadRequest,
+					ExpectedContentContains: "invalid_request",
+				},
+			},
+		},
+		{
+			Name: "TestDeviceFlowDisabled",
+			ProxySettings: func(c *Config) {
+				c.EnableDeviceFlow = false
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:          "/oauth/device",
+					Method:       http.MethodPost,
+					ExpectedCode: http.StatusNotFound,
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeKeycloakConfig()
+				cfg.EnableDeviceFlow = true
+				testCase.ProxySettings(cfg)
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+				proxy.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
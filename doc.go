@@ -68,6 +68,33 @@ var (
 		},
 		[]string{"code", "method"},
 	)
+	storeLatencyMetric = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name: "proxy_store_request_latency",
+			Help: "A summary of the store operations latency, in seconds",
+		},
+		[]string{"action"},
+	)
+	storeErrorsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_store_errors_total",
+			Help: "The failed store operations partitioned by action",
+		},
+		[]string{"action"},
+	)
+	verifiedTokenCacheMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_verified_token_cache_total",
+			Help: "The lookups of the verified token cache partitioned by result, hit or miss",
+		},
+		[]string{"result"},
+	)
+	storeBreakerOpenMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "proxy_store_circuit_breaker_open",
+			Help: "Indicates if the store circuit breaker is open",
+		},
+	)
 )
 
 // Config is the configuration for the proxy
@@ -92,6 +119,10 @@ type Config struct {
 	RedirectionURL string `json:"redirection-url" yaml:"redirection-url" usage:"redirection url for the oauth callback url, defaults to host header if absent" env:"REDIRECTION_URL"`
 	// RevocationEndpoint is the token revocation endpoint to revoke refresh tokens
 	RevocationEndpoint string `json:"revocation-url" yaml:"revocation-url" usage:"url for the revocation endpoint to revoke refresh token" env:"REVOCATION_URL"`
+	// IntrospectionEndpoint is the token introspection endpoint to validate opaque tokens
+	IntrospectionEndpoint string `json:"introspection-url" yaml:"introspection-url" usage:"url for the introspection endpoint to validate opaque access tokens, defaults to the one advertised by the provider" env:"INTROSPECTION_URL"`
+	// DeviceAuthorizationEndpoint is the endpoint starting the device authorization flow
+	DeviceAuthorizationEndpoint string `json:"device-authorization-url" yaml:"device-authorization-url" usage:"url for the device authorization endpoint, defaults to the one advertised by the provider" env:"DEVICE_AUTHORIZATION_URL"`
 	// SkipOpenIDProviderTLSVerify skips the tls verification for openid provider communication
 	SkipOpenIDProviderTLSVerify bool `json:"skip-openid-provider-tls-verify" yaml:"skip-openid-provider-tls-verify" usage:"skip the verification of any TLS communication with the openid provider" env:"SKIP_OPENID_PROVIDER_TLSVERIFY"`
 	// OpenIDProviderProxy proxy for openid provider communication
@@ -108,6 +139,10 @@ type Config struct {
 	Upstream string `json:"upstream-url" yaml:"upstream-url" usage:"url for the upstream endpoint you wish to proxy" env:"UPSTREAM_URL"`
 	// UpstreamCA is the path to a CA certificate in PEM format to validate the upstream certificate
 	UpstreamCA string `json:"upstream-ca" yaml:"upstream-ca" usage:"the path to a file container a CA certificate to validate the upstream tls endpoint" env:"UPSTREAM_CA"`
+	// TokenExchangeAudience is the audience the user token is exchanged for before forwarding to the upstream
+	TokenExchangeAudience string `json:"token-exchange-audience" yaml:"token-exchange-audience" usage:"exchanges the user token for token with this audience before forwarding to the upstream, resources can override it" env:"TOKEN_EXCHANGE_AUDIENCE"`
+	// TokenExchangeScopes are the scopes requested for the exchanged token
+	TokenExchangeScopes []string `json:"token-exchange-scopes" yaml:"token-exchange-scopes" usage:"scopes requested for the token exchanged for the upstream"`
 	// Resources is a list of protected resources
 	Resources []*authorization.Resource `json:"resources" yaml:"resources" usage:"list of resources 'uri=/admin*|methods=GET,PUT|roles=role1,role2'"`
 	// Headers permits adding customs headers across the board
@@ -132,6 +167,8 @@ type Config struct {
 	EnableRequestID bool `json:"enable-request-id" yaml:"enable-request-id" usage:"indicates we should add a request id if none found" env:"ENABLE_REQUEST_ID"`
 	// EnableLogoutRedirect indicates we should redirect to the identity provider for logging out
 	EnableLogoutRedirect bool `json:"enable-logout-redirect" yaml:"enable-logout-redirect" usage:"indicates we should redirect to the identity provider for logging out" env:"ENABLE_LOGOUT_REDIRECT"`
+	// PostLogoutRedirectURIs is a list of urls permitted as redirect after logout at identity provider
+	PostLogoutRedirectURIs []string `json:"post-logout-redirect-uris" yaml:"post-logout-redirect-uris" usage:"list of urls permitted as post_logout_redirect_uri when redirecting to the identity provider for logging out"`
 	// EnableDefaultDeny indicates we should deny by default all unauthenticated requests
 	EnableDefaultDeny bool `json:"enable-default-deny" yaml:"enable-default-deny" usage:"enables a default denial on all unauthenticated requests, you have to explicitly say what is permitted, although be aware that it allows any valid token" env:"ENABLE_DEFAULT_DENY"`
 	// EnableDefaultDenyStrict indicates we should deny by default all requests
@@ -150,10 +187,60 @@ type Config struct {
 	EnableSecurityFilter bool `json:"enable-security-filter" yaml:"enable-security-filter" usage:"enables the security filter handler" env:"ENABLE_SECURITY_FILTER"`
 	// EnableRefreshTokens indicate's you wish to ignore using refresh tokens and re-auth on expiration of access token
 	EnableRefreshTokens bool `json:"enable-refresh-tokens" yaml:"enable-refresh-tokens" usage:"enables the handling of the refresh tokens" env:"ENABLE_REFRESH_TOKEN"`
+	// ProactiveRefreshPercent is the percentage of the access token lifetime after which the token is refreshed
+	ProactiveRefreshPercent int `json:"proactive-refresh-percent" yaml:"proactive-refresh-percent" usage:"refreshes the access token in the background once given percentage of its lifetime has passed, zero refreshes only expired tokens" env:"PROACTIVE_REFRESH_PERCENT"`
+	// EnableTokenIntrospection indicates opaque bearer tokens are validated through the introspection endpoint
+	EnableTokenIntrospection bool `json:"enable-token-introspection" yaml:"enable-token-introspection" usage:"validates opaque bearer tokens through the provider introspection endpoint" env:"ENABLE_TOKEN_INTROSPECTION"`
+	// IntrospectionCacheTTL is how long the introspection results are cached
+	IntrospectionCacheTTL time.Duration `json:"introspection-cache-ttl" yaml:"introspection-cache-ttl" usage:"time the introspection results are cached for, active tokens at most until they expire, zero disables caching" env:"INTROSPECTION_CACHE_TTL"`
+	// VerifiedTokenCacheSize is the number of verified tokens the identities are cached for
+	VerifiedTokenCacheSize int `json:"verified-token-cache-size" yaml:"verified-token-cache-size" usage:"number of verified tokens the identities are cached for until the tokens expire, zero disables the cache" env:"VERIFIED_TOKEN_CACHE_SIZE"`
+	// EnableDPoP indicates the DPoP bound tokens are accepted with the proof of possession
+	EnableDPoP bool `json:"enable-dpop" yaml:"enable-dpop" usage:"accepts DPoP bound access tokens in the DPoP authorization scheme with the DPoP proof header" env:"ENABLE_DPOP"`
+	// DPoPProofMaxAge is how far the issued at time of the proof can be from now
+	DPoPProofMaxAge time.Duration `json:"dpop-proof-max-age" yaml:"dpop-proof-max-age" usage:"how far the issued at time of the DPoP proof can be from now" env:"DPOP_PROOF_MAX_AGE"`
+	// EnableAPIKeys indicates the static api keys are accepted as identity of the callers
+	EnableAPIKeys bool `json:"enable-api-keys" yaml:"enable-api-keys" usage:"accepts static api keys as identity of the callers which cannot use oauth" env:"ENABLE_API_KEYS"`
+	// APIKeyHeader is the request header holding the api key
+	APIKeyHeader string `json:"api-key-header" yaml:"api-key-header" usage:"request header holding the api key" env:"API_KEY_HEADER"`
+	// APIKeysFile is the file of the hashed api keys and their identities
+	APIKeysFile string `json:"api-keys-file" yaml:"api-keys-file" usage:"path to file with sha256 hashes of the api keys and their identities, reloaded on change, keys are looked up in the store otherwise" env:"API_KEYS_FILE"`
+	// RolesClaims are the claim paths the roles are taken from
+	RolesClaims []string `json:"roles-claims" yaml:"roles-claims" usage:"dot separated paths of the claims holding the roles, defaults to realm_access.roles"`
+	// ClientRolesClaims are the claim paths the client roles are taken from
+	ClientRolesClaims []string `json:"client-roles-claims" yaml:"client-roles-claims" usage:"dot separated paths of the claims holding the client roles, * matches any client and prefixes the roles with client name, defaults to resource_access.*.roles"`
+	// ClientRolesPrefix is the prefix of client roles found at paths without wildcard
+	ClientRolesPrefix string `json:"client-roles-prefix" yaml:"client-roles-prefix" usage:"prefix of the client roles found at paths without wildcard, the roles become prefix:role" env:"CLIENT_ROLES_PREFIX"`
+	// GroupsClaims are the claim paths the groups are taken from
+	GroupsClaims []string `json:"groups-claims" yaml:"groups-claims" usage:"dot separated paths of the claims holding the groups, defaults to groups"`
+	// UsernameClaims are the claim paths the username is taken from, first found is used
+	UsernameClaims []string `json:"username-claims" yaml:"username-claims" usage:"dot separated paths of the claims holding the username, first found is used, defaults to preferred_username or email"`
+	// EmailClaims are the claim paths the email is taken from, first found is used
+	EmailClaims []string `json:"email-claims" yaml:"email-claims" usage:"dot separated paths of the claims holding the email, first found is used, defaults to email"`
+	// Issuers are the additional trusted token issuers
+	Issuers []*IssuerConfig `json:"issuers" yaml:"issuers" usage:"additional trusted token issuers, json objects with name, discovery-url, client-id, client-secret, audience, hosts, paths and claim mapping options"`
+	// EnablePKCE enables the proof key for code exchange in the authorization code flow
+	EnablePKCE bool `json:"enable-pkce" yaml:"enable-pkce" usage:"enables proof key for code exchange (S256) in the authorization code flow, the code verifier is kept in encrypted cookie" env:"ENABLE_PKCE"`
+	// EnableNonce enables the nonce binding the id token to the browser which started the login
+	EnableNonce bool `json:"enable-nonce" yaml:"enable-nonce" usage:"sends the nonce in the authorization request and rejects id tokens with other nonce, the nonce is kept in encrypted cookie" env:"ENABLE_NONCE"`
+	// EnableServerSessions indicates the tokens are kept in the store and cookie holds only session id
+	EnableServerSessions bool `json:"enable-server-sessions" yaml:"enable-server-sessions" usage:"keeps the tokens in the store, the browser gets only an opaque session id cookie" env:"ENABLE_SERVER_SESSIONS"`
+	// EnableBackchannelLogout indicates the openid connect back-channel logout endpoint is enabled
+	EnableBackchannelLogout bool `json:"enable-backchannel-logout" yaml:"enable-backchannel-logout" usage:"enables the openid connect back-channel logout endpoint, which invalidates sessions kept in the store" env:"ENABLE_BACKCHANNEL_LOGOUT"`
+	// SessionIdleTimeout is the time without any request after which the session ends
+	SessionIdleTimeout time.Duration `json:"session-idle-timeout" yaml:"session-idle-timeout" usage:"ends the session after given time without any request from the user, zero disables it" env:"SESSION_IDLE_TIMEOUT"`
+	// SessionMaxLifetime is the maximum age of the session measured from the login
+	SessionMaxLifetime time.Duration `json:"session-max-lifetime" yaml:"session-max-lifetime" usage:"ends the session after given time from the login regardless of token refreshes, zero disables it" env:"SESSION_MAX_LIFETIME"`
+	// EnableSessionsAdmin indicates the admin api for listing and revoking user sessions is enabled
+	EnableSessionsAdmin bool `json:"enable-sessions-admin" yaml:"enable-sessions-admin" usage:"enables the admin api for listing and revoking user sessions kept in the store" env:"ENABLE_SESSIONS_ADMIN"`
+	// SessionsAdminRoles are the roles required in bearer token for access to sessions admin api
+	SessionsAdminRoles []string `json:"sessions-admin-roles" yaml:"sessions-admin-roles" usage:"roles required in the bearer token for access to sessions admin api"`
 	// EnableSessionCookies indicates the cookies, both token and refresh should not be persisted
 	EnableSessionCookies bool `json:"enable-session-cookies" yaml:"enable-session-cookies" usage:"access and refresh tokens are session only i.e. removed browser close" env:"ENABLE_SESSION_COOKIES"`
 	// EnableLoginHandler indicates we want the login handler enabled
 	EnableLoginHandler bool `json:"enable-login-handler" yaml:"enable-login-handler" usage:"enables the handling of the refresh tokens" env:"ENABLE_LOGIN_HANDLER"`
+	// EnableDeviceFlow enables the device authorization grant endpoints
+	EnableDeviceFlow bool `json:"enable-device-flow" yaml:"enable-device-flow" usage:"enables the device authorization grant endpoints for clients without browser" env:"ENABLE_DEVICE_FLOW"`
 	// EnableTokenHeader adds the JWT token to the upstream authentication headers
 	EnableTokenHeader bool `json:"enable-token-header" yaml:"enable-token-header" usage:"enables the token authentication header X-Auth-Token to upstream" env:"ENABLE_TOKEN_HEADER"`
 	// EnableAuthorizationHeader indicates we should pass the authorization header to the upstream endpoint
@@ -195,10 +282,20 @@ type Config struct {
 	CookieAccessName string `json:"cookie-access-name" yaml:"cookie-access-name" usage:"name of the cookie use to hold the access token" env:"COOKIE_ACCESS_NAME"`
 	// CookieRefreshName is the name of the refresh cookie
 	CookieRefreshName string `json:"cookie-refresh-name" yaml:"cookie-refresh-name" usage:"name of the cookie used to hold the encrypted refresh token" env:"COOKIE_REFRESH_NAME"`
+	// CookieSessionName is the name of the cookie holding the server side session id
+	CookieSessionName string `json:"cookie-session-name" yaml:"cookie-session-name" usage:"name of the cookie used to hold the server side session id" env:"COOKIE_SESSION_NAME"`
+	// CookieIDTokenName is the name of the cookie holding the encrypted id token
+	CookieIDTokenName string `json:"cookie-id-token-name" yaml:"cookie-id-token-name" usage:"name of the cookie used to hold the encrypted id token, sent as id_token_hint on logout" env:"COOKIE_ID_TOKEN_NAME"`
+	// CookieSessionTimestampName is the name of the cookie holding the encrypted session timestamps
+	CookieSessionTimestampName string `json:"cookie-session-timestamp-name" yaml:"cookie-session-timestamp-name" usage:"name of the cookie used to hold the encrypted login and last seen time of the session" env:"COOKIE_SESSION_TIMESTAMP_NAME"`
 	// CookieOAuthStateName is the name of the Oauth Token request state
 	CookieOAuthStateName string `json:"cookie-oauth-state-name" yaml:"cookie-oauth-state-name" usage:"name of the cookie used to hold the Oauth request state" env:"COOKIE_OAUTH_STATE_NAME"`
 	// CookieRequestURIName is the name of the Request Uri cookie
 	CookieRequestURIName string `json:"cookie-request-uri-name" yaml:"cookie-request-uri-name" usage:"name of the cookie used to hold the request uri" env:"COOKIE_REQUEST_URI_NAME"`
+	// CookiePKCEName is the name of the cookie holding the encrypted pkce code verifier
+	CookiePKCEName string `json:"cookie-pkce-name" yaml:"cookie-pkce-name" usage:"name of the cookie used to hold the encrypted pkce code verifier" env:"COOKIE_PKCE_NAME"`
+	// CookieNonceName is the name of the cookie holding the encrypted nonce of the login
+	CookieNonceName string `json:"cookie-nonce-name" yaml:"cookie-nonce-name" usage:"name of the cookie used to hold the encrypted nonce of the login" env:"COOKIE_NONCE_NAME"`
 	// SecureCookie enforces the cookie as secure
 	SecureCookie bool `json:"secure-cookie" yaml:"secure-cookie" usage:"enforces the cookie to be secure" env:"SECURE_COOKIE"`
 	// HTTPOnlyCookie enforces the cookie as http only
@@ -225,6 +322,8 @@ type Config struct {
 	SkipUpstreamTLSVerify bool `json:"skip-upstream-tls-verify" yaml:"skip-upstream-tls-verify" usage:"skip the verification of any upstream TLS" env:"SKIP_UPSTREAM_TLS_VERIFY"`
 	// TLSMinVersion specifies server minimal TLS version
 	TLSMinVersion string `json:"tls-min-version" yaml:"tls-min-version" usage:"specify server minimal TLS version one of tlsv1.0,tlsv1.1,tlsv1.2,tlsv1.3" env:"TLS_MIN_VERSION"`
+	// EnableCertificateBoundTokens requires the bearer tokens to be bound to the client certificate
+	EnableCertificateBoundTokens bool `json:"enable-certificate-bound-tokens" yaml:"enable-certificate-bound-tokens" usage:"requires the bearer tokens to be bound to the client certificate of the mutual tls connection through the cnf.x5t#S256 claim" env:"ENABLE_CERTIFICATE_BOUND_TOKENS"`
 
 	// TLSAdminCertificate is the location for a tls certificate for admin https endpoint. Defaults to TLSCertificate.
 	TLSAdminCertificate string `json:"tls-admin-cert" yaml:"tls-admin-cert" usage:"path to ths TLS certificate" env:"TLS_ADMIN_CERTIFICATE"`
@@ -251,7 +350,17 @@ type Config struct {
 	Hostnames []string `json:"hostnames" yaml:"hostnames" usage:"list of hostnames the service will respond to"`
 
 	// Store is a url for a store resource, used to hold the refresh tokens
-	StoreURL string `json:"store-url" yaml:"store-url" usage:"url for the storage subsystem, e.g redis://127.0.0.1:6379, file:///etc/tokens.file" env:"STORE_URL"`
+	StoreURL string `json:"store-url" yaml:"store-url" usage:"url for the storage subsystem, e.g redis://127.0.0.1:6379, rediss://, redis-sentinel://, redis-cluster://, memory://, file:///etc/tokens.file" env:"STORE_URL"`
+	// StoreKeyPrefix is prepended to all keys written to the store
+	StoreKeyPrefix string `json:"store-key-prefix" yaml:"store-key-prefix" usage:"prefix prepended to all store keys, allows multiple deployments to share one store" env:"STORE_KEY_PREFIX"`
+	// StoreEncryptionKey is the key used to envelope encrypt all values in the store
+	StoreEncryptionKey string `json:"store-encryption-key" yaml:"store-encryption-key" usage:"dedicated key used to envelope encrypt all values written to the store" env:"STORE_ENCRYPTION_KEY"`
+	// StoreTimeout is the timeout of a single store operation
+	StoreTimeout time.Duration `json:"store-timeout" yaml:"store-timeout" usage:"timeout of a single store operation, zero disables it" env:"STORE_TIMEOUT"`
+	// StoreBreakerThreshold is the number of consecutive store failures opening the circuit breaker
+	StoreBreakerThreshold int `json:"store-breaker-threshold" yaml:"store-breaker-threshold" usage:"number of consecutive store failures opening the circuit breaker, zero disables it" env:"STORE_BREAKER_THRESHOLD"`
+	// StoreBreakerCooldown is the time the circuit breaker stays open before store is tried again
+	StoreBreakerCooldown time.Duration `json:"store-breaker-cooldown" yaml:"store-breaker-cooldown" usage:"time the store circuit breaker stays open before the store is tried again" env:"STORE_BREAKER_COOLDOWN"`
 	// EncryptionKey is the encryption key used to encrypt the refresh token
 	EncryptionKey string `json:"encryption-key" yaml:"encryption-key" usage:"encryption key used to encryption the session state" env:"ENCRYPTION_KEY"`
 
@@ -329,6 +438,39 @@ type Config struct {
 	IsDiscoverURILegacy bool
 }
 
+// IssuerConfig is the configuration of the additional trusted token issuer, tokens are
+// routed to the issuer by their iss claim
+type IssuerConfig struct {
+	// Name identifies the issuer
+	Name string `json:"name" yaml:"name"`
+	// DiscoveryURL is the url of the issuer openid configuration
+	DiscoveryURL string `json:"discovery-url" yaml:"discovery-url"`
+	// ClientID is the client id in the issuer
+	ClientID string `json:"client-id" yaml:"client-id"`
+	// ClientSecret is the secret of the client in the issuer
+	ClientSecret string `json:"client-secret" yaml:"client-secret"`
+	// SkipAccessTokenClientIDCheck skips the audience check of the access tokens
+	SkipAccessTokenClientIDCheck bool `json:"skip-access-token-clientid-check" yaml:"skip-access-token-clientid-check"`
+	// Audience is the audience required in the access tokens, the client id when empty
+	Audience string `json:"audience" yaml:"audience"`
+	// Hosts are the request hosts the browser logins are sent to the issuer from
+	Hosts []string `json:"hosts" yaml:"hosts"`
+	// Paths are the request path prefixes the browser logins are sent to the issuer from
+	Paths []string `json:"paths" yaml:"paths"`
+	// RolesClaims are the claim paths the roles are taken from
+	RolesClaims []string `json:"roles-claims" yaml:"roles-claims"`
+	// ClientRolesClaims are the claim paths the client roles are taken from
+	ClientRolesClaims []string `json:"client-roles-claims" yaml:"client-roles-claims"`
+	// ClientRolesPrefix is the prefix of client roles found at paths without wildcard
+	ClientRolesPrefix string `json:"client-roles-prefix" yaml:"client-roles-prefix"`
+	// GroupsClaims are the claim paths the groups are taken from
+	GroupsClaims []string `json:"groups-claims" yaml:"groups-claims"`
+	// UsernameClaims are the claim paths the username is taken from, first found is used
+	UsernameClaims []string `json:"username-claims" yaml:"username-claims"`
+	// EmailClaims are the claim paths the email is taken from, first found is used
+	EmailClaims []string `json:"email-claims" yaml:"email-claims"`
+}
+
 // getVersion returns the proxy version
 func getVersion() string {
 	if version == "" {
@@ -373,6 +515,8 @@ type userContext struct {
 	email string
 	// the expiration of the access token
 	expiresAt time.Time
+	// the time the access token was issued at
+	issuedAt time.Time
 	// groups is a collection of groups the user in in
 	groups []string
 	// a name of the user
@@ -381,8 +525,24 @@ type userContext struct {
 	preferredName string
 	// roles is a collection of roles the users holds
 	roles []string
+	// scopes are the oauth scopes granted to the token
+	scopes []string
 	// rawToken
 	rawToken string
+	// sessionID is the id of the server side session the token comes from
+	sessionID string
+	// sessionState is the provider session the token belongs to (sid claim)
+	sessionState string
+	// introspected indicates the token was validated through the introspection endpoint
+	introspected bool
+	// verified indicates the identity comes from the cache of verified tokens
+	verified bool
+	// apiKey indicates the identity is of the api key, not of a token
+	apiKey bool
+	// issuerURL is the iss claim of the token
+	issuerURL string
+	// issuer is the additional trusted issuer of the token, nil for the default one
+	issuer *trustedIssuer
 	// claims
 	claims map[string]interface{}
 	// permissions
@@ -0,0 +1,215 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/constant"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	jose2 "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// dpopKeyPrefix is the prefix of store keys holding the jti of the used proofs
+	dpopKeyPrefix = "dpop:"
+	// dpopProofType is the type of the proof jwt
+	// https://www.rfc-editor.org/rfc/rfc9449#section-4.2
+	dpopProofType = "dpop+jwt"
+)
+
+// dpopProofClaims are the claims of the proof bound to the request and the access token
+type dpopProofClaims struct {
+	HTTPMethod      string `json:"htm"`
+	HTTPURI         string `json:"htu"`
+	AccessTokenHash string `json:"ath"`
+}
+
+// getTokenInDPoP returns the access token of the DPoP authorization scheme, reports false
+// when the request uses other scheme
+func getTokenInDPoP(req *http.Request) (string, bool) {
+	items := strings.Split(req.Header.Get(constant.AuthorizationHeader), " ")
+
+	if len(items) != 2 || !strings.EqualFold(items[0], constant.DPoPAuthorizationType) {
+		return "", false
+	}
+
+	return items[1], true
+}
+
+// getDPoPThumbprint returns the jwk thumbprint the token is bound to through the cnf claim
+// https://www.rfc-editor.org/rfc/rfc9449#section-6.1
+func getDPoPThumbprint(user *userContext) string {
+	cnf, found := user.claims["cnf"].(map[string]interface{})
+
+	if !found {
+		return ""
+	}
+
+	jkt, _ := cnf["jkt"].(string)
+
+	return jkt
+}
+
+// getRequestURI returns the uri of the request without query and fragment as the client
+// sees it, the forwarded headers are respected
+func getRequestURI(req *http.Request) string {
+	scheme := "http"
+
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	host := utils.DefaultTo(req.Header.Get("X-Forwarded-Host"), req.Host)
+
+	return fmt.Sprintf("%s://%s%s", scheme, host, req.URL.Path)
+}
+
+// isSameURI compares the htu claim with the request uri, scheme and host are case insensitive
+func isSameURI(htu, requestURI string) bool {
+	proofURI, err := url.Parse(htu)
+
+	if err != nil {
+		return false
+	}
+
+	expectedURI, err := url.Parse(requestURI)
+
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(proofURI.Scheme, expectedURI.Scheme) &&
+		strings.EqualFold(proofURI.Host, expectedURI.Host) &&
+		proofURI.Path == expectedURI.Path
+}
+
+// verifyDPoPProof checks the proof of possession of the DPoP bound access token
+// https://www.rfc-editor.org/rfc/rfc9449#section-4.3
+//
+//nolint:cyclop
+func (r *oauthProxy) verifyDPoPProof(req *http.Request, user *userContext, accessToken string) error {
+	proofs := req.Header.Values(constant.DPoPHeader)
+
+	if len(proofs) != 1 {
+		return fmt.Errorf("%w: request must have exactly one proof", apperrors.ErrInvalidDPoPProof)
+	}
+
+	proof, err := jwt.ParseSigned(proofs[0])
+
+	if err != nil {
+		return fmt.Errorf("%w: %s", apperrors.ErrInvalidDPoPProof, err)
+	}
+
+	if len(proof.Headers) != 1 {
+		return fmt.Errorf("%w: proof must have single signature", apperrors.ErrInvalidDPoPProof)
+	}
+
+	header := proof.Headers[0]
+
+	if typ, _ := header.ExtraHeaders[jose2.HeaderType].(string); typ != dpopProofType {
+		return fmt.Errorf("%w: invalid proof type %q", apperrors.ErrInvalidDPoPProof, typ)
+	}
+
+	if header.JSONWebKey == nil || !header.JSONWebKey.IsPublic() || strings.HasPrefix(header.Algorithm, "HS") {
+		return fmt.Errorf("%w: proof must be signed with asymmetric key in jwk header", apperrors.ErrInvalidDPoPProof)
+	}
+
+	stdClaims := &jwt.Claims{}
+	proofClaims := &dpopProofClaims{}
+
+	if err := proof.Claims(header.JSONWebKey, stdClaims, proofClaims); err != nil {
+		return fmt.Errorf("%w: %s", apperrors.ErrInvalidDPoPProof, err)
+	}
+
+	if stdClaims.ID == "" || stdClaims.IssuedAt == nil {
+		return fmt.Errorf("%w: proof must have jti and iat", apperrors.ErrInvalidDPoPProof)
+	}
+
+	if proofClaims.HTTPMethod != req.Method {
+		return fmt.Errorf("%w: proof is for other method", apperrors.ErrInvalidDPoPProof)
+	}
+
+	if !isSameURI(proofClaims.HTTPURI, getRequestURI(req)) {
+		return fmt.Errorf("%w: proof is for other uri", apperrors.ErrInvalidDPoPProof)
+	}
+
+	if age := time.Since(stdClaims.IssuedAt.Time()); age > r.config.DPoPProofMaxAge || age < -r.config.DPoPProofMaxAge {
+		return fmt.Errorf("%w: proof is outside of the acceptable time window", apperrors.ErrInvalidDPoPProof)
+	}
+
+	sum := sha256.Sum256([]byte(accessToken))
+
+	if subtle.ConstantTimeCompare(
+		[]byte(proofClaims.AccessTokenHash),
+		[]byte(base64.RawURLEncoding.EncodeToString(sum[:])),
+	) != 1 {
+		return fmt.Errorf("%w: proof is for other access token", apperrors.ErrInvalidDPoPProof)
+	}
+
+	thumbprint, err := header.JSONWebKey.Thumbprint(crypto.SHA256)
+
+	if err != nil {
+		return fmt.Errorf("%w: %s", apperrors.ErrInvalidDPoPProof, err)
+	}
+
+	if subtle.ConstantTimeCompare(
+		[]byte(getDPoPThumbprint(user)),
+		[]byte(base64.RawURLEncoding.EncodeToString(thumbprint)),
+	) != 1 {
+		return fmt.Errorf("%w: access token is not bound to the proof key", apperrors.ErrInvalidDPoPProof)
+	}
+
+	// the jti is remembered for as long as the proof is acceptable, the proofs are single use
+	fresh, err := r.dpopReplayCache.SetNX(
+		dpopKeyPrefix+utils.GetHashKey(stdClaims.ID),
+		"true",
+		2*r.config.DPoPProofMaxAge,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if !fresh {
+		return fmt.Errorf("%w: proof has been used already", apperrors.ErrInvalidDPoPProof)
+	}
+
+	return nil
+}
+
+// dpopChallenge rejects the request with the DPoP authentication challenge
+// https://www.rfc-editor.org/rfc/rfc9449#section-7.1
+func (r *oauthProxy) dpopChallenge(wrt http.ResponseWriter, req *http.Request) context.Context {
+	wrt.Header().Set(
+		"WWW-Authenticate",
+		fmt.Sprintf(`%s error="invalid_dpop_proof"`, constant.DPoPAuthorizationType),
+	)
+	wrt.WriteHeader(http.StatusUnauthorized)
+
+	return r.revokeProxy(wrt, req)
+}
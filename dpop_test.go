@@ -0,0 +1,229 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/gogatekeeper/gatekeeper/pkg/constant"
+	"github.com/stretchr/testify/assert"
+	jose2 "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// newDPoPProof signs the proof of possession of the access token for the request
+func newDPoPProof(t *testing.T, key *ecdsa.PrivateKey, method, uri, accessToken string, issuedAt time.Time) string {
+	signer, err := jose2.NewSigner(
+		jose2.SigningKey{Algorithm: jose2.ES256, Key: key},
+		(&jose2.SignerOptions{EmbedJWK: true}).WithType(dpopProofType),
+	)
+	assert.NoError(t, err)
+
+	jti, err := uuid.NewV4()
+	assert.NoError(t, err)
+
+	sum := sha256.Sum256([]byte(accessToken))
+	proof, err := jwt.Signed(signer).
+		Claims(jwt.Claims{ID: jti.String(), IssuedAt: jwt.NewNumericDate(issuedAt)}).
+		Claims(map[string]interface{}{
+			"htm": method,
+			"htu": uri,
+			"ath": base64.RawURLEncoding.EncodeToString(sum[:]),
+		}).
+		CompactSerialize()
+	assert.NoError(t, err)
+
+	return proof
+}
+
+// getDPoPKeyThumbprint returns the jkt of the public key
+func getDPoPKeyThumbprint(t *testing.T, key *ecdsa.PrivateKey) string {
+	thumbprint, err := (&jose2.JSONWebKey{Key: key.Public()}).Thumbprint(crypto.SHA256)
+	assert.NoError(t, err)
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint)
+}
+
+func TestDPoP(t *testing.T) {
+	testCases := []struct {
+		Name             string
+		Scheme           string
+		ProofMethod      string
+		ProofPath        string
+		ProofAge         time.Duration
+		WithoutProof     bool
+		BoundToOtherKey  bool
+		OtherAccessToken bool
+		Replay           bool
+		ExpectedCode     int
+	}{
+		{
+			Name:         "TestValidProof",
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Name:         "TestReplayedProof",
+			Replay:       true,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			Name:         "TestProofForOtherMethod",
+			ProofMethod:  http.MethodPost,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			Name:         "TestProofForOtherURI",
+			ProofPath:    "/auth_all/other",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			Name:         "TestExpiredProof",
+			ProofAge:     5 * time.Minute,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			Name:         "TestProofFromFuture",
+			ProofAge:     -5 * time.Minute,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			Name:             "TestProofForOtherAccessToken",
+			OtherAccessToken: true,
+			ExpectedCode:     http.StatusUnauthorized,
+		},
+		{
+			Name:            "TestTokenBoundToOtherKey",
+			BoundToOtherKey: true,
+			ExpectedCode:    http.StatusUnauthorized,
+		},
+		{
+			Name:         "TestWithoutProof",
+			WithoutProof: true,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			Name:         "TestBoundTokenAsBearer",
+			Scheme:       constant.AuthorizationType,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeKeycloakConfig()
+				cfg.EnableDPoP = true
+				cfg.DPoPProofMaxAge = time.Minute
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+				key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				assert.NoError(t, err)
+
+				boundKey := key
+
+				if testCase.BoundToOtherKey {
+					boundKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+					assert.NoError(t, err)
+				}
+
+				token, err := newTestToken(proxy.idp.getLocation()).getToken(map[string]interface{}{
+					"cnf": map[string]interface{}{"jkt": getDPoPKeyThumbprint(t, boundKey)},
+				})
+				assert.NoError(t, err)
+
+				uri := "/auth_all/test"
+				method := testCase.ProofMethod
+
+				if method == "" {
+					method = http.MethodGet
+				}
+
+				proofPath := testCase.ProofPath
+
+				if proofPath == "" {
+					proofPath = uri
+				}
+
+				proofToken := token
+
+				if testCase.OtherAccessToken {
+					proofToken = "other"
+				}
+
+				scheme := testCase.Scheme
+
+				if scheme == "" {
+					scheme = constant.DPoPAuthorizationType
+				}
+
+				headers := map[string]string{
+					constant.AuthorizationHeader: scheme + " " + token,
+				}
+
+				if !testCase.WithoutProof {
+					headers[constant.DPoPHeader] = newDPoPProof(
+						t,
+						key,
+						method,
+						proxy.getServiceURL()+proofPath,
+						proofToken,
+						time.Now().Add(-testCase.ProofAge),
+					)
+				}
+
+				requests := []fakeRequest{}
+
+				if testCase.Replay {
+					requests = append(requests, fakeRequest{
+						URI:           uri,
+						Headers:       headers,
+						ExpectedProxy: true,
+						ExpectedCode:  http.StatusOK,
+					})
+				}
+
+				request := fakeRequest{
+					URI:           uri,
+					Headers:       headers,
+					ExpectedProxy: testCase.ExpectedCode == http.StatusOK,
+					ExpectedCode:  testCase.ExpectedCode,
+				}
+
+				if testCase.ExpectedCode == http.StatusUnauthorized {
+					request.ExpectedHeaders = map[string]string{
+						"WWW-Authenticate": `DPoP error="invalid_dpop_proof"`,
+					}
+				}
+
+				proxy.RunTests(t, append(requests, request))
+			},
+		)
+	}
+}
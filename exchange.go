@@ -0,0 +1,215 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/constant"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// exchangeKeyPrefix is the prefix of cache keys holding the exchanged tokens
+	exchangeKeyPrefix = "exchange:"
+	// tokenTypeAccessToken is the type of the exchanged and requested tokens
+	// https://www.rfc-editor.org/rfc/rfc8693#section-3
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	// exchangeExpiryDelta is subtracted from the lifetime of the exchanged tokens in the cache,
+	// so the upstream never gets the token about to expire, same as the oauth2 token refresh
+	exchangeExpiryDelta = 10 * time.Second
+)
+
+// exchangedToken is the response of the token endpoint to the token exchange
+// https://www.rfc-editor.org/rfc/rfc8693#section-2.2.1
+type exchangedToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// getExchangedToken returns the token of the user exchanged for the audience and scopes, the
+// exchanged tokens are cached until they expire, concurrent exchanges of the same token are
+// collapsed into single provider call, the identities without access token, such as the
+// identities of the api keys, have nothing to exchange
+func (r *oauthProxy) getExchangedToken(user *userContext, audience string, scopes []string) (string, error) {
+	if user.rawToken == "" {
+		return "", apperrors.ErrNoTokenToExchange
+	}
+
+	key := exchangeKeyPrefix + utils.GetHashKey(
+		strings.Join(append([]string{user.rawToken, audience}, scopes...), "|"),
+	)
+
+	if r.exchangeCache != nil {
+		token, err := r.exchangeCache.Get(key)
+
+		if err != nil {
+			r.log.Warn("unable to retrieve the exchanged token from cache", zap.Error(err))
+		} else if token != "" {
+			return token, nil
+		}
+	}
+
+	result, err, _ := r.exchangeGroup.Do(key, func() (interface{}, error) {
+		token, err := r.exchangeToken(user, audience, scopes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		expiration := time.Duration(token.ExpiresIn)*time.Second - exchangeExpiryDelta
+
+		if r.exchangeCache != nil && expiration > 0 {
+			if err := r.exchangeCache.Set(key, token.AccessToken, expiration); err != nil {
+				r.log.Warn("unable to cache the exchanged token", zap.Error(err))
+			}
+		}
+
+		return token.AccessToken, nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return result.(string), nil
+}
+
+// exchangeToken exchanges the token of the user at the token endpoint of its issuer
+// https://www.rfc-editor.org/rfc/rfc8693#section-2.1
+func (r *oauthProxy) exchangeToken(user *userContext, audience string, scopes []string) (*exchangedToken, error) {
+	conf := r.newOAuth2Config(user.issuer, "")
+	values := url.Values{
+		"grant_type":           {GrantTypeTokenExchange},
+		"subject_token":        {user.rawToken},
+		"subject_token_type":   {tokenTypeAccessToken},
+		"requested_token_type": {tokenTypeAccessToken},
+		"audience":             {audience},
+	}
+
+	if len(scopes) > 0 {
+		values.Set("scope", strings.Join(scopes, " "))
+	}
+
+	request, err := http.NewRequest(http.MethodPost, conf.Endpoint.TokenURL, strings.NewReader(values.Encode()))
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct the token exchange request: %w", err)
+	}
+
+	request.SetBasicAuth(url.QueryEscape(conf.ClientID), url.QueryEscape(conf.ClientSecret))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+	response, err := r.providerClient.Do(request)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to post to token endpoint: %w", err)
+	}
+
+	defer response.Body.Close()
+
+	oauthLatencyMetric.WithLabelValues("exchange").
+		Observe(time.Since(start).Seconds())
+
+	content, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"%w, status: %d, response: %s",
+			apperrors.ErrTokenExchangeRefused,
+			response.StatusCode,
+			string(content),
+		)
+	}
+
+	token := &exchangedToken{}
+
+	if err := json.Unmarshal(content, token); err != nil {
+		return nil, fmt.Errorf("invalid response from token endpoint to the exchange: %w", err)
+	}
+
+	if token.AccessToken == "" {
+		return nil, apperrors.ErrTokenExchangeRefused
+	}
+
+	// @metric a token has been issued
+	oauthTokensMetric.WithLabelValues("exchange").Inc()
+
+	return token, nil
+}
+
+// tokenExchangeMiddleware forwards the token of the user exchanged for the audience instead
+// of the user token in the identity headers, the request is denied when the exchange fails
+func (r *oauthProxy) tokenExchangeMiddleware(audience string, scopes []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+			scope, assertOk := req.Context().Value(constant.ContextScopeName).(*RequestScope)
+
+			if !assertOk {
+				r.log.Error(
+					"assertion failed",
+				)
+				return
+			}
+
+			if scope.AccessDenied || scope.Identity == nil {
+				next.ServeHTTP(wrt, req)
+				return
+			}
+
+			token, err := r.getExchangedToken(scope.Identity, audience, scopes)
+
+			// step: the identities of the api keys are forwarded as they are
+			if errors.Is(err, apperrors.ErrNoTokenToExchange) {
+				next.ServeHTTP(wrt, req)
+				return
+			}
+
+			if err != nil {
+				scope.Logger.Error(
+					"unable to exchange the token",
+					zap.Error(err),
+					zap.String("audience", audience),
+				)
+				//nolint:contextcheck
+				next.ServeHTTP(wrt, req.WithContext(r.accessForbidden(wrt, req)))
+				return
+			}
+
+			// step: the identity headers carry the exchanged token instead of the user token
+			identity := *scope.Identity
+			identity.rawToken = token
+			scope.Identity = &identity
+
+			next.ServeHTTP(wrt, req)
+		})
+	}
+}
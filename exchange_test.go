@@ -0,0 +1,265 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// getExchangedAudience returns the audience of the token forwarded in the authorization header
+func getExchangedAudience(t *testing.T, header string) string {
+	token, err := jwt.ParseSigned(strings.TrimPrefix(header, "Bearer "))
+
+	if !assert.NoError(t, err) {
+		return ""
+	}
+
+	claims := &jwt.Claims{}
+	assert.NoError(t, token.UnsafeClaimsWithoutVerification(claims))
+
+	return strings.Join(claims.Audience, ",")
+}
+
+func TestTokenExchange(t *testing.T) {
+	testCases := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+		ExpectedExchanges int32
+	}{
+		{
+			Name: "TestExchangeForUpstreamAudience",
+			ProxySettings: func(c *Config) {
+				c.TokenExchangeAudience = "upstream"
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
+						"Authorization": func(t *testing.T, c *Config, value string) {
+							assert.Equal(t, "upstream", getExchangedAudience(t, value))
+						},
+					},
+				},
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
+						"Authorization": func(t *testing.T, c *Config, value string) {
+							assert.Equal(t, "upstream", getExchangedAudience(t, value))
+						},
+					},
+				},
+			},
+			ExpectedExchanges: 1,
+		},
+		{
+			Name: "TestExchangeForResourceAudience",
+			ProxySettings: func(c *Config) {
+				c.TokenExchangeAudience = "upstream"
+				c.EnableTokenHeader = true
+				c.Resources = append(
+					[]*authorization.Resource{
+						{
+							URL:              "/orders/*",
+							Methods:          []string{http.MethodGet},
+							ExchangeAudience: "orders",
+							ExchangeScopes:   []string{"orders:read"},
+						},
+					},
+					c.Resources...,
+				)
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/orders/1",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
+						"Authorization": func(t *testing.T, c *Config, value string) {
+							assert.Equal(t, "orders", getExchangedAudience(t, value))
+						},
+						"X-Auth-Token": func(t *testing.T, c *Config, value string) {
+							assert.Equal(t, "orders", getExchangedAudience(t, value))
+						},
+					},
+				},
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
+						"Authorization": func(t *testing.T, c *Config, value string) {
+							assert.Equal(t, "upstream", getExchangedAudience(t, value))
+						},
+					},
+				},
+			},
+			ExpectedExchanges: 2,
+		},
+		{
+			Name: "TestExchangedTokenOnlyInEnabledHeaders",
+			ProxySettings: func(c *Config) {
+				c.TokenExchangeAudience = "upstream"
+				c.EnableAuthorizationHeader = false
+				c.EnableTokenHeader = true
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
+						"Authorization": func(t *testing.T, c *Config, value string) {
+							assert.NotEqual(t, "upstream", getExchangedAudience(t, value))
+						},
+						"X-Auth-Token": func(t *testing.T, c *Config, value string) {
+							assert.Equal(t, "upstream", getExchangedAudience(t, value))
+						},
+					},
+				},
+			},
+			ExpectedExchanges: 1,
+		},
+		{
+			Name: "TestExchangeRefused",
+			ProxySettings: func(c *Config) {
+				c.TokenExchangeAudience = fakeForbiddenAudience
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusForbidden,
+				},
+			},
+			ExpectedExchanges: 1,
+		},
+		{
+			Name: "TestNoExchangeForWhitelisted",
+			ProxySettings: func(c *Config) {
+				c.TokenExchangeAudience = "upstream"
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/white_listed/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+			ExpectedExchanges: 0,
+		},
+		{
+			Name:          "TestNoExchange",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+			ExpectedExchanges: 0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeKeycloakConfig()
+				cfg.EnableAuthorizationHeader = true
+				testCase.ProxySettings(cfg)
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+				token, err := newTestToken(proxy.idp.getLocation()).getToken()
+				assert.NoError(t, err)
+
+				for idx := range testCase.ExecutionSettings {
+					testCase.ExecutionSettings[idx].RawToken = token
+				}
+
+				proxy.RunTests(t, testCase.ExecutionSettings)
+				assert.Equal(t, testCase.ExpectedExchanges, atomic.LoadInt32(&proxy.idp.exchangeRequests))
+			},
+		)
+	}
+}
+
+func TestTokenExchangeShortLivedTokenNotCached(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.TokenExchangeAudience = "upstream"
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{Expiration: exchangeExpiryDelta})
+
+	token, err := newTestToken(proxy.idp.getLocation()).getToken()
+	assert.NoError(t, err)
+
+	proxy.RunTests(t, []fakeRequest{
+		{
+			URI:           "/auth_all/test",
+			RawToken:      token,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/auth_all/test",
+			RawToken:      token,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	})
+
+	// step: the exchanged token expiring within the delta is exchanged on every request
+	assert.Equal(t, int32(2), atomic.LoadInt32(&proxy.idp.exchangeRequests))
+}
+
+func TestTokenExchangeWithAPIKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "api-keys.yaml")
+	writeAPIKeysFile(t, file, fakeAPIKey)
+
+	cfg := newFakeKeycloakConfig()
+	cfg.TokenExchangeAudience = "upstream"
+	cfg.EnableAPIKeys = true
+	cfg.APIKeyHeader = "X-API-Key"
+	cfg.APIKeysFile = file
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	proxy.RunTests(t, []fakeRequest{
+		{
+			URI:           "/auth_all/test",
+			Headers:       map[string]string{"X-API-Key": fakeAPIKey},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	})
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&proxy.idp.exchangeRequests))
+}
@@ -16,14 +16,12 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 
 	"net/http"
@@ -35,6 +33,7 @@ import (
 
 	oidc3 "github.com/coreos/go-oidc/v3/oidc"
 	"github.com/go-chi/chi/v5"
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
 	"github.com/gogatekeeper/gatekeeper/pkg/constant"
 	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
 	"github.com/gogatekeeper/gatekeeper/pkg/utils"
@@ -104,7 +103,7 @@ func (r *oauthProxy) oauthAuthorizationHandler(wrt http.ResponseWriter, req *htt
 		return
 	}
 
-	conf := r.newOAuth2Config(r.getRedirectionURL(wrt, req))
+	conf := r.newOAuth2Config(r.getLoginIssuer(req), r.getRedirectionURL(wrt, req))
 	// step: set the access type of the session
 	accessType := oauth2.AccessTypeOnline
 
@@ -112,7 +111,35 @@ func (r *oauthProxy) oauthAuthorizationHandler(wrt http.ResponseWriter, req *htt
 		accessType = oauth2.AccessTypeOffline
 	}
 
-	authURL := conf.AuthCodeURL(req.URL.Query().Get("state"), accessType)
+	authOptions := []oauth2.AuthCodeOption{accessType}
+
+	// step: every authorization request gets its own code verifier, leftovers of the
+	// unfinished logins are replaced
+	if r.config.EnablePKCE {
+		verifier, err := r.writePKCECookie(req, wrt)
+
+		if err != nil {
+			scope.Logger.Error("unable to write the pkce cookie", zap.Error(err))
+			wrt.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		authOptions = append(authOptions, getPKCEChallengeOptions(verifier)...)
+	}
+
+	if r.config.EnableNonce {
+		nonce, err := r.writeNonceCookie(req, wrt)
+
+		if err != nil {
+			scope.Logger.Error("unable to write the nonce cookie", zap.Error(err))
+			wrt.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		authOptions = append(authOptions, oidc3.Nonce(nonce))
+	}
+
+	authURL := conf.AuthCodeURL(req.URL.Query().Get("state"), authOptions...)
 	clientIP := utils.RealIP(req)
 
 	scope.Logger.Debug(
@@ -167,12 +194,29 @@ func (r *oauthProxy) oauthCallbackHandler(writer http.ResponseWriter, req *http.
 		return
 	}
 
-	conf := r.newOAuth2Config(r.getRedirectionURL(writer, req))
+	issuer := r.getLoginIssuer(req)
+	conf := r.newOAuth2Config(issuer, r.getRedirectionURL(writer, req))
+
+	var codeVerifier string
+
+	if r.config.EnablePKCE {
+		verifier, err := r.getPKCECodeVerifier(req)
+
+		if err != nil {
+			scope.Logger.Error("unable to retrieve the pkce code verifier", zap.Error(err))
+			r.accessForbidden(writer, req)
+			return
+		}
+
+		codeVerifier = verifier
+		r.clearPKCECookie(req, writer)
+	}
 
 	//nolint:contextcheck
 	resp, err := exchangeAuthenticationCode(
 		conf,
 		code,
+		codeVerifier,
 		r.config.SkipOpenIDProviderTLSVerify,
 	)
 
@@ -196,7 +240,7 @@ func (r *oauthProxy) oauthCallbackHandler(writer http.ResponseWriter, req *http.
 
 	rawToken = rawIDToken
 
-	verifier := r.provider.Verifier(&oidc3.Config{ClientID: r.config.ClientID})
+	verifier := r.getIssuerProvider(issuer).Verifier(&oidc3.Config{ClientID: conf.ClientID})
 
 	var idToken *oidc3.IDToken
 
@@ -216,6 +260,16 @@ func (r *oauthProxy) oauthCallbackHandler(writer http.ResponseWriter, req *http.
 		return
 	}
 
+	if r.config.EnableNonce {
+		if err = r.verifyNonce(req, idToken.Nonce); err != nil {
+			scope.Logger.Error("unable to verify the nonce of the id token", zap.Error(err))
+			r.accessForbidden(writer, req)
+			return
+		}
+
+		r.clearNonceCookie(req, writer)
+	}
+
 	token, err := jwt.ParseSigned(rawIDToken)
 
 	if err != nil {
@@ -227,7 +281,9 @@ func (r *oauthProxy) oauthCallbackHandler(writer http.ResponseWriter, req *http.
 	stdClaims := &jwt.Claims{}
 	// Extract custom claims
 	var customClaims struct {
-		Email string `json:"email"`
+		Email        string `json:"email"`
+		Sid          string `json:"sid"`
+		SessionState string `json:"session_state"`
 	}
 
 	err = token.UnsafeClaimsWithoutVerification(stdClaims, &customClaims)
@@ -274,6 +330,7 @@ func (r *oauthProxy) oauthCallbackHandler(writer http.ResponseWriter, req *http.
 	}
 
 	accessToken := rawToken
+	sessionState := utils.DefaultTo(customClaims.Sid, customClaims.SessionState)
 
 	// step: are we encrypting the access token?
 	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie {
@@ -305,7 +362,26 @@ func (r *oauthProxy) oauthCallbackHandler(writer http.ResponseWriter, req *http.
 	oauthTokensMetric.WithLabelValues("issued").Inc()
 
 	// step: does the response have a refresh token and we do NOT ignore refresh tokens?
-	if r.config.EnableRefreshTokens && resp.RefreshToken != "" {
+	if r.config.EnableServerSessions {
+		session, expiration := r.newServerSession(
+			rawToken,
+			resp.RefreshToken,
+			rawIDToken,
+			time.Until(stdClaims.Expiry.Time()),
+		)
+
+		if err = r.createServerSession(req, writer, stdClaims.Subject, sessionState, session, expiration); err != nil {
+			scope.Logger.Error(
+				"failed to create the server session",
+				zap.Error(err),
+				zap.String("sub", stdClaims.Subject),
+				zap.String("email", customClaims.Email),
+			)
+
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	} else if r.config.EnableRefreshTokens && resp.RefreshToken != "" {
 		var encrypted string
 		encrypted, err = encryption.EncodeText(resp.RefreshToken, r.config.EncryptionKey)
 
@@ -356,7 +432,7 @@ func (r *oauthProxy) oauthCallbackHandler(writer http.ResponseWriter, req *http.
 			expiration = time.Until(stdRefreshClaims.Expiry.Time())
 		}
 
-		switch r.useStore() {
+		switch r.useStoreForRefreshTokens() {
 		case true:
 			if err = r.StoreRefreshToken(rawToken, encrypted, expiration); err != nil {
 				scope.Logger.Warn(
@@ -365,6 +441,12 @@ func (r *oauthProxy) oauthCallbackHandler(writer http.ResponseWriter, req *http.
 					zap.String("sub", stdClaims.Subject),
 					zap.String("email", customClaims.Email),
 				)
+			} else if err = r.addSessionToIndex(stdClaims.Subject, sessionState, sessionKindRefresh, utils.GetHashKey(rawToken), expiration); err != nil {
+				scope.Logger.Warn(
+					"failed to add the session to the subject index",
+					zap.Error(err),
+					zap.String("sub", stdClaims.Subject),
+				)
 			}
 		default:
 			r.dropRefreshTokenCookie(req, writer, encrypted, expiration)
@@ -378,6 +460,35 @@ func (r *oauthProxy) oauthCallbackHandler(writer http.ResponseWriter, req *http.
 		)
 	}
 
+	if r.useSessionTimestamps() {
+		if err = r.startSessionTimestamps(req, writer, stdClaims.Subject, sessionState); err != nil {
+			scope.Logger.Error(
+				"failed to encrypt the session timestamps",
+				zap.Error(err),
+				zap.String("sub", stdClaims.Subject),
+			)
+
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.useIDTokenCookie() {
+		err = r.keepIDTokenInCookie(req, writer, rawIDToken, resp.RefreshToken, time.Until(stdClaims.Expiry.Time()))
+
+		if err != nil {
+			scope.Logger.Error(
+				"failed to encrypt the id token",
+				zap.Error(err),
+				zap.String("sub", stdClaims.Subject),
+				zap.String("email", customClaims.Email),
+			)
+
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// step: decode the request variable
 	redirectURI := "/"
 
@@ -459,7 +570,7 @@ func (r *oauthProxy) loginHandler(writer http.ResponseWriter, req *http.Request)
 				errors.New("no credentials")
 		}
 
-		conf := r.newOAuth2Config(r.getRedirectionURL(writer, req))
+		conf := r.newOAuth2Config(nil, r.getRedirectionURL(writer, req))
 
 		start := time.Now()
 		token, err := conf.PasswordCredentialsToken(ctx, username, password)
@@ -493,6 +604,8 @@ func (r *oauthProxy) loginHandler(writer http.ResponseWriter, req *http.Request)
 				err
 		}
 
+		r.mapIdentityClaims(identity)
+
 		writer.Header().Set("Content-Type", "application/json")
 		idToken, assertOk := token.Extra("id_token").(string)
 
@@ -502,6 +615,7 @@ func (r *oauthProxy) loginHandler(writer http.ResponseWriter, req *http.Request)
 				fmt.Errorf("token response does not contain an id_token")
 		}
 
+		rawIDToken := idToken
 		expiresIn, assertOk := token.Extra("expires_in").(float64)
 
 		if !assertOk {
@@ -539,7 +653,21 @@ func (r *oauthProxy) loginHandler(writer http.ResponseWriter, req *http.Request)
 		}
 
 		// step: does the response have a refresh token and we do NOT ignore refresh tokens?
-		if r.config.EnableRefreshTokens && token.RefreshToken != "" {
+		if r.config.EnableServerSessions {
+			session, expiration := r.newServerSession(
+				token.AccessToken,
+				token.RefreshToken,
+				rawIDToken,
+				time.Until(identity.expiresAt),
+			)
+
+			if err = r.createServerSession(req, writer, identity.id, identity.sessionState, session, expiration); err != nil {
+				scope.Logger.Error("failed to create the server session", zap.Error(err))
+				return "failed to create the server session",
+					http.StatusInternalServerError,
+					err
+			}
+		} else if r.config.EnableRefreshTokens && token.RefreshToken != "" {
 			var encrypted string
 			encrypted, err = encryption.EncodeText(token.RefreshToken, r.config.EncryptionKey)
 
@@ -580,13 +708,18 @@ func (r *oauthProxy) loginHandler(writer http.ResponseWriter, req *http.Request)
 				expiration = time.Until(stdRefreshClaims.Expiry.Time())
 			}
 
-			switch r.useStore() {
+			switch r.useStoreForRefreshTokens() {
 			case true:
 				if err = r.StoreRefreshToken(token.AccessToken, encrypted, expiration); err != nil {
 					scope.Logger.Warn(
 						"failed to save the refresh token in the store",
 						zap.Error(err),
 					)
+				} else if err = r.addSessionToIndex(identity.id, identity.sessionState, sessionKindRefresh, utils.GetHashKey(token.AccessToken), expiration); err != nil {
+					scope.Logger.Warn(
+						"failed to add the session to the subject index",
+						zap.Error(err),
+					)
 				}
 			default:
 				r.dropRefreshTokenCookie(req, writer, encrypted, expiration)
@@ -600,6 +733,26 @@ func (r *oauthProxy) loginHandler(writer http.ResponseWriter, req *http.Request)
 			)
 		}
 
+		if r.useSessionTimestamps() {
+			if err = r.startSessionTimestamps(req, writer, identity.id, identity.sessionState); err != nil {
+				scope.Logger.Error("failed to encrypt the session timestamps", zap.Error(err))
+				return "failed to encrypt the session timestamps",
+					http.StatusInternalServerError,
+					err
+			}
+		}
+
+		if r.useIDTokenCookie() {
+			err = r.keepIDTokenInCookie(req, writer, rawIDToken, token.RefreshToken, time.Until(identity.expiresAt))
+
+			if err != nil {
+				scope.Logger.Error("failed to encrypt the id token", zap.Error(err))
+				return "failed to encrypt the id token",
+					http.StatusInternalServerError,
+					err
+			}
+		}
+
 		// @metric a token has been issued
 		oauthTokensMetric.WithLabelValues("login").Inc()
 		tokenScope := token.Extra("scope")
@@ -700,6 +853,25 @@ func (r *oauthProxy) logoutHandler(writer http.ResponseWriter, req *http.Request
 		return
 	}
 
+	r.forgetVerifiedIdentity(utils.GetHashKey(user.rawToken))
+
+	if r.config.EnableLogoutRedirect && redirectURL != "" && !r.isPostLogoutRedirectPermitted(redirectURL) {
+		scope.Logger.Warn(
+			"post logout redirect is not permitted",
+			zap.String("redirect", redirectURL),
+		)
+
+		r.accessError(writer, req)
+		return
+	}
+
+	// step: the id token is sent as hint when logging out at the provider
+	var idTokenHint string
+
+	if r.config.EnableLogoutRedirect {
+		idTokenHint = r.getIDTokenHint(req, user)
+	}
+
 	// step: can either use the id token or the refresh token
 	identityToken := user.rawToken
 
@@ -713,121 +885,72 @@ func (r *oauthProxy) logoutHandler(writer http.ResponseWriter, req *http.Request
 	oauthTokensMetric.WithLabelValues("logout").Inc()
 
 	// step: check if the user has a state session and if so revoke it
-	if r.useStore() {
+	if user.sessionID != "" {
+		if err = r.deleteServerSession(user.sessionID); err != nil {
+			scope.Logger.Error(
+				"unable to remove the server session from store",
+				zap.Error(err),
+			)
+		}
+
+		if err = r.removeSessionFromIndex(user.id, getSessionKey(user.sessionID)); err != nil {
+			scope.Logger.Warn("unable to remove the session from subject index", zap.Error(err))
+		}
+	} else if r.useStore() {
 		go func() {
-			if err = r.DeleteRefreshToken(user.rawToken); err != nil {
+			if err := r.DeleteRefreshToken(user.rawToken); err != nil {
 				scope.Logger.Error(
 					"unable to remove the refresh token from store",
 					zap.Error(err),
 				)
 			}
+
+			if err := r.removeSessionFromIndex(user.id, utils.GetHashKey(user.rawToken)); err != nil {
+				scope.Logger.Warn("unable to remove the session from subject index", zap.Error(err))
+			}
 		}()
 	}
 
 	// @check if we should redirect to the provider
 	if r.config.EnableLogoutRedirect {
-		sendTo := fmt.Sprintf(
-			"%s/protocol/openid-connect/logout",
-			strings.TrimSuffix(
-				r.config.DiscoveryURL,
-				"/.well-known/openid-configuration",
-			),
-		)
+		endSessionEndpoint := r.getProviderEndpoints(user.issuer).EndSessionEndpoint
 
-		r.redirectToURL(
-			sendTo,
-			writer,
-			req,
-			http.StatusSeeOther,
-		)
-
-		return
-	}
-
-	// set the default revocation url
-	revokeDefault := fmt.Sprintf(
-		"%s/protocol/openid-connect/revoke",
-		strings.TrimSuffix(
-			r.config.DiscoveryURL,
-			"/.well-known/openid-configuration",
-		),
-	)
-
-	revocationURL := utils.DefaultTo(r.config.RevocationEndpoint, revokeDefault)
-
-	// step: do we have a revocation endpoint?
-	if revocationURL != "" {
-		client := &http.Client{
-			Timeout: r.config.OpenIDProviderTimeout,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: r.config.SkipOpenIDProviderTLSVerify,
-				},
-			},
-		}
+		if endSessionEndpoint != "" {
+			sendTo, err := r.getEndSessionURL(user.issuer, endSessionEndpoint, idTokenHint, redirectURL)
 
-		if err != nil {
-			scope.Logger.Error("unable to retrieve the openid client", zap.Error(err))
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		// step: add the authentication headers
-		encodedID := url.QueryEscape(r.config.ClientID)
-		encodedSecret := url.QueryEscape(r.config.ClientSecret)
+			if err != nil {
+				scope.Logger.Error("unable to construct the end session url", zap.Error(err))
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 
-		// step: construct the url for revocation
-		request, err := http.NewRequest(
-			http.MethodPost,
-			revocationURL,
-			bytes.NewBufferString(
-				fmt.Sprintf("token=%s", identityToken),
-			),
-		)
+			r.redirectToURL(
+				sendTo,
+				writer,
+				req,
+				http.StatusSeeOther,
+			)
 
-		if err != nil {
-			scope.Logger.Error("unable to construct the revocation request", zap.Error(err))
-			writer.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		// step: add the authentication headers and content-type
-		request.SetBasicAuth(encodedID, encodedSecret)
-		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		scope.Logger.Warn("provider does not advertise end_session_endpoint, skipping logout at the provider")
+	}
 
-		start := time.Now()
-		response, err := client.Do(request)
+	revocationURL := r.getRevocationURL(user.issuer)
 
-		if err != nil {
-			scope.Logger.Error("unable to post to revocation endpoint", zap.Error(err))
+	// step: do we have a revocation endpoint?
+	if revocationURL != "" {
+		if err := r.revokeToken(user.issuer, revocationURL, identityToken); err != nil {
+			scope.Logger.Error("unable to revoke the token", zap.Error(err))
 			writer.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		defer response.Body.Close()
-
-		oauthLatencyMetric.WithLabelValues("revocation").
-			Observe(time.Since(start).Seconds())
-
-		// step: check the response
-		switch response.StatusCode {
-		case http.StatusOK:
-			scope.Logger.Info(
-				"successfully logged out of the endpoint",
-				zap.String("email", user.email),
-			)
-		default:
-			content, _ := ioutil.ReadAll(response.Body)
-
-			scope.Logger.Error(
-				"invalid response from revocation endpoint",
-				zap.Int("status", response.StatusCode),
-				zap.String("response", string(content)),
-			)
-
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		scope.Logger.Info(
+			"successfully logged out of the endpoint",
+			zap.String("email", user.email),
+		)
 	}
 
 	// step: should we redirect the user
@@ -952,9 +1075,30 @@ func (r *oauthProxy) retrieveRefreshToken(req *http.Request, user *userContext)
 	var token string
 	var err error
 
+	// server side session holds the refresh token unencrypted within encrypted session
+	if user.sessionID != "" {
+		session, err := r.loadServerSession(user.sessionID)
+
+		if err != nil {
+			return "", "", err
+		}
+
+		if session.RefreshToken == "" {
+			return "", "", apperrors.ErrNoSessionStateFound
+		}
+
+		return session.RefreshToken, "", nil
+	}
+
 	switch r.useStore() {
 	case true:
 		token, err = r.GetRefreshToken(user.rawToken)
+		// refresh token might have been dropped into cookie while store was unavailable
+		if err != nil {
+			if cookieToken, cookieErr := utils.GetRefreshTokenFromCookie(req, r.config.CookieRefreshName); cookieErr == nil {
+				token, err = cookieToken, nil
+			}
+		}
 	default:
 		token, err = utils.GetRefreshTokenFromCookie(req, r.config.CookieRefreshName)
 	}
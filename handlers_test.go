@@ -27,6 +27,7 @@ import (
 
 	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
 	"github.com/gogatekeeper/gatekeeper/pkg/constant"
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/square/go-jose.v2/jwt"
@@ -609,6 +610,85 @@ func TestLogoutHandlerGood(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name: "TestLogoutWithEnabledLogoutRedirectPermittedRedirect",
+			ProxySettings: func(c *Config) {
+				c.EnableLogoutRedirect = true
+				c.PostLogoutRedirectURIs = []string{"http://example.com"}
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:              cfg.WithOAuthURI(constant.LogoutURL) + "?redirect=http://example.com",
+					HasToken:         true,
+					ExpectedCode:     http.StatusSeeOther,
+					ExpectedLocation: "post_logout_redirect_uri=http%3A%2F%2Fexample.com",
+				},
+			},
+		},
+		{
+			Name: "TestLogoutWithEnabledLogoutRedirectNotPermittedRedirect",
+			ProxySettings: func(c *Config) {
+				c.EnableLogoutRedirect = true
+				c.PostLogoutRedirectURIs = []string{"http://example.com"}
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:          cfg.WithOAuthURI(constant.LogoutURL) + "?redirect=http://evil.com",
+					HasToken:     true,
+					ExpectedCode: http.StatusBadRequest,
+				},
+			},
+		},
+		{
+			Name: "TestLogoutWithEnabledLogoutRedirectIDTokenHint",
+			ProxySettings: func(c *Config) {
+				c.EnableLogoutRedirect = true
+				c.EncryptionKey = testEncryptionKey
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           fakeAuthAllURL,
+					HasLogin:      true,
+					Redirects:     true,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						cfg.CookieIDTokenName: func(t *testing.T, c *Config, value string) bool {
+							idToken, err := encryption.DecodeText(value, testEncryptionKey)
+							return assert.NoError(t, err) && assert.Len(t, strings.Split(idToken, "."), 3)
+						},
+					},
+				},
+				{
+					URI:              cfg.WithOAuthURI(constant.LogoutURL),
+					ExpectedCode:     http.StatusSeeOther,
+					ExpectedLocation: "id_token_hint=",
+				},
+			},
+		},
+		{
+			Name: "TestLogoutWithServerSessionIDTokenHint",
+			ProxySettings: func(c *Config) {
+				c.EnableLogoutRedirect = true
+				c.EnableServerSessions = true
+				c.EncryptionKey = testEncryptionKey
+				c.StoreURL = "memory://"
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           fakeAuthAllURL,
+					HasLogin:      true,
+					Redirects:     true,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+				{
+					URI:              cfg.WithOAuthURI(constant.LogoutURL),
+					ExpectedCode:     http.StatusSeeOther,
+					ExpectedLocation: "id_token_hint=",
+				},
+			},
+		},
 		{
 			Name:          "TestLogoutWithEmptyRedirectQueryParam",
 			ProxySettings: func(c *Config) {},
@@ -0,0 +1,204 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// introspectionKeyPrefix is the prefix of cache keys holding the introspection results
+	introspectionKeyPrefix = "introspection:"
+	// introspectionInactive is the cached result of inactive token, the claims of the response
+	// are not kept
+	introspectionInactive = `{"active":false}`
+)
+
+// getIntrospectionURL returns the introspection endpoint, configured one takes precedence
+// over the one advertised by the provider
+func (r *oauthProxy) getIntrospectionURL() string {
+	return utils.DefaultTo(r.config.IntrospectionEndpoint, r.getProviderEndpoints(nil).IntrospectionEndpoint)
+}
+
+// getIntrospectedIdentity validates the opaque token through the provider introspection
+// endpoint and constructs the user identity from the introspection response
+func (r *oauthProxy) getIntrospectedIdentity(token string) (*userContext, error) {
+	claims := r.getCachedIntrospection(token)
+
+	if claims == nil {
+		var err error
+
+		if claims, err = r.introspectToken(token); err != nil {
+			return nil, err
+		}
+	}
+
+	// https://www.rfc-editor.org/rfc/rfc7662#section-2.2
+	if active, _ := claims["active"].(bool); !active {
+		return nil, apperrors.ErrTokenInactive
+	}
+
+	stdClaims, err := getStandardClaims(claims)
+
+	if err != nil {
+		return nil, err
+	}
+
+	customClaims, err := getCustomClaims(claims)
+
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := newUserContext(stdClaims, customClaims, claims)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if user.name == "" {
+		user.name = customClaims.Username
+		user.preferredName = customClaims.Username
+	}
+
+	user.introspected = true
+
+	return user, nil
+}
+
+// getCachedIntrospection retrieves the claims of the cached introspection response of the
+// token, nil when there is none, cache failures only cause the token to be introspected again
+func (r *oauthProxy) getCachedIntrospection(token string) map[string]interface{} {
+	if r.introspectionCache == nil || r.config.IntrospectionCacheTTL <= 0 {
+		return nil
+	}
+
+	content, err := r.introspectionCache.Get(introspectionKeyPrefix + utils.GetHashKey(token))
+
+	if err != nil {
+		r.log.Warn("unable to retrieve the cached introspection result", zap.Error(err))
+		return nil
+	}
+
+	if content == "" {
+		return nil
+	}
+
+	claims := make(map[string]interface{})
+
+	if err := json.Unmarshal([]byte(content), &claims); err != nil {
+		r.log.Warn("unable to parse the cached introspection result", zap.Error(err))
+		return nil
+	}
+
+	return claims
+}
+
+// introspectToken calls the introspection endpoint with the client credentials and returns
+// the claims of the response, the result is cached, active tokens no longer than until
+// they expire
+func (r *oauthProxy) introspectToken(token string) (map[string]interface{}, error) {
+	introspectionURL := r.getIntrospectionURL()
+
+	if introspectionURL == "" {
+		return nil, apperrors.ErrNoIntrospectionEndpoint
+	}
+
+	request, err := http.NewRequest(
+		http.MethodPost,
+		introspectionURL,
+		strings.NewReader(url.Values{"token": {token}, "token_type_hint": {"access_token"}}.Encode()),
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct the introspection request: %w", err)
+	}
+
+	request.SetBasicAuth(url.QueryEscape(r.config.ClientID), url.QueryEscape(r.config.ClientSecret))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+	response, err := r.providerClient.Do(request)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to post to introspection endpoint: %w", err)
+	}
+
+	defer response.Body.Close()
+
+	oauthLatencyMetric.WithLabelValues("introspection").
+		Observe(time.Since(start).Seconds())
+
+	body, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"invalid response from introspection endpoint, status: %d, response: %s",
+			response.StatusCode,
+			string(body),
+		)
+	}
+
+	claims := make(map[string]interface{})
+
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("invalid response from introspection endpoint: %w", err)
+	}
+
+	content := string(body)
+	expiration := r.config.IntrospectionCacheTTL
+
+	if active, _ := claims["active"].(bool); !active {
+		content = introspectionInactive
+	} else {
+		stdClaims, err := getStandardClaims(claims)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if stdClaims.Expiry != nil {
+			if remaining := time.Until(stdClaims.Expiry.Time()); remaining < expiration {
+				expiration = remaining
+			}
+		}
+	}
+
+	if r.introspectionCache != nil && expiration > 0 {
+		key := introspectionKeyPrefix + utils.GetHashKey(token)
+
+		if err := r.introspectionCache.Set(key, content, expiration); err != nil {
+			r.log.Warn("unable to cache the introspection result", zap.Error(err))
+		}
+	}
+
+	return claims, nil
+}
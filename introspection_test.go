@@ -0,0 +1,220 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeIntrospectionConfig() *Config {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableTokenIntrospection = true
+	cfg.IntrospectionCacheTTL = time.Minute
+	cfg.NoRedirects = true
+
+	return cfg
+}
+
+func TestTokenIntrospection(t *testing.T) {
+	testCases := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name:          "TestActiveOpaqueToken",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					RawToken:      fakeOpaqueToken,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeaders: map[string]string{
+						"X-Auth-Email":   "opaque@example.com",
+						"X-Auth-Subject": fakeSessionsSubject,
+						"X-Auth-Userid":  "opaque@example.com",
+					},
+				},
+			},
+		},
+		{
+			Name:          "TestOpaqueTokenWithRequiredRole",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/admin/test",
+					RawToken:      fakeOpaqueToken,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+		{
+			Name:          "TestOpaqueTokenWithoutRequiredRole",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           fakeTestRoleURL,
+					RawToken:      fakeOpaqueToken,
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusForbidden,
+				},
+			},
+		},
+		{
+			Name:          "TestInactiveOpaqueToken",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					RawToken:      "revoked-opaque-token",
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			Name: "TestOpaqueTokenWithIntrospectionDisabled",
+			ProxySettings: func(c *Config) {
+				c.EnableTokenIntrospection = false
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					RawToken:      fakeOpaqueToken,
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			Name: "TestOpaqueTokenWithWrongClientCredentials",
+			ProxySettings: func(c *Config) {
+				c.ClientSecret = "wrong"
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					RawToken:      fakeOpaqueToken,
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			Name:          "TestJWTIsVerifiedLocally",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					HasToken:      true,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeIntrospectionConfig()
+				testCase.ProxySettings(cfg)
+				p := newFakeProxy(cfg, &fakeAuthConfig{})
+				p.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
+
+func TestTokenIntrospectionCache(t *testing.T) {
+	testCases := []struct {
+		Name             string
+		Token            string
+		CacheTTL         time.Duration
+		ExpectedRequests int32
+	}{
+		{
+			Name:             "TestActiveTokenIsCached",
+			Token:            fakeOpaqueToken,
+			CacheTTL:         time.Minute,
+			ExpectedRequests: 1,
+		},
+		{
+			Name:             "TestInactiveTokenIsCached",
+			Token:            "revoked-opaque-token",
+			CacheTTL:         time.Minute,
+			ExpectedRequests: 1,
+		},
+		{
+			Name:             "TestCacheDisabled",
+			Token:            fakeOpaqueToken,
+			ExpectedRequests: 3,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeIntrospectionConfig()
+				cfg.IntrospectionCacheTTL = testCase.CacheTTL
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+				defer proxy.idp.Close()
+
+				for i := 0; i < 3; i++ {
+					_, _ = proxy.proxy.getIntrospectedIdentity(testCase.Token)
+				}
+
+				assert.Equal(t, testCase.ExpectedRequests, atomic.LoadInt32(&proxy.idp.introspectionRequests))
+			},
+		)
+	}
+}
+
+func TestGetIntrospectedIdentity(t *testing.T) {
+	cfg := newFakeIntrospectionConfig()
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	user, err := proxy.proxy.getIntrospectedIdentity(fakeOpaqueToken)
+	assert.NoError(t, err)
+	assert.True(t, user.introspected)
+	assert.Equal(t, fakeSessionsSubject, user.id)
+	assert.Equal(t, "opaque@example.com", user.email)
+	assert.Equal(t, []string{fakeAdminRole}, user.roles)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), user.expiresAt, time.Minute)
+
+	_, err = proxy.proxy.getIntrospectedIdentity("revoked-opaque-token")
+	assert.ErrorIs(t, err, apperrors.ErrTokenInactive)
+
+	proxy.proxy.config.IntrospectionEndpoint = proxy.idp.getLocation() + "/missing"
+	_, err = proxy.proxy.getIntrospectedIdentity("other-opaque-token")
+	assert.Error(t, err)
+}
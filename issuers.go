@@ -0,0 +1,197 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	oidc3 "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// trustedIssuer is the additional openid provider the tokens are accepted from
+type trustedIssuer struct {
+	config   *IssuerConfig
+	provider *oidc3.Provider
+	// issuerURL is the issuer advertised by the provider, matched against the iss claim
+	issuerURL string
+}
+
+// newTrustedIssuers retrieves the openid configuration of the additional issuers
+func (r *oauthProxy) newTrustedIssuers() ([]*trustedIssuer, error) {
+	issuers := make([]*trustedIssuer, 0, len(r.config.Issuers))
+
+	for _, config := range r.config.Issuers {
+		r.log.Info(
+			"attempting to retrieve configuration of the trusted issuer",
+			zap.String("issuer", config.Name),
+			zap.String("url", config.DiscoveryURL),
+		)
+
+		provider, err := r.newIssuerProvider(config.DiscoveryURL)
+
+		if err != nil {
+			return nil, fmt.Errorf("issuer %s: %w", config.Name, err)
+		}
+
+		var discovery struct {
+			Issuer string `json:"issuer"`
+		}
+
+		if err := provider.Claims(&discovery); err != nil {
+			return nil, fmt.Errorf("issuer %s: %w", config.Name, err)
+		}
+
+		issuers = append(issuers, &trustedIssuer{
+			config:    config,
+			provider:  provider,
+			issuerURL: discovery.Issuer,
+		})
+	}
+
+	return issuers, nil
+}
+
+// newIssuerProvider retrieves the openid configuration from the discovery url with the
+// shared provider client
+func (r *oauthProxy) newIssuerProvider(discoveryURL string) (*oidc3.Provider, error) {
+	ctx := oidc3.ClientContext(context.Background(), r.providerClient)
+	provider, err := oidc3.NewProvider(ctx, strings.TrimSuffix(discoveryURL, "/.well-known/openid-configuration"))
+
+	if err != nil {
+		return nil, fmt.Errorf(
+			"failed to retrieve the provider configuration from discovery url: %w",
+			err,
+		)
+	}
+
+	return provider, nil
+}
+
+// getIssuerByURL returns the additional issuer of the iss claim, nil when the token comes from
+// the default issuer or an unknown one, which the default verification rejects
+func (r *oauthProxy) getIssuerByURL(issuerURL string) *trustedIssuer {
+	for _, issuer := range r.issuers {
+		if issuer.issuerURL == issuerURL {
+			return issuer
+		}
+	}
+
+	return nil
+}
+
+// getTokenIssuer returns the additional issuer of the unverified token
+func (r *oauthProxy) getTokenIssuer(token string) *trustedIssuer {
+	if len(r.issuers) == 0 {
+		return nil
+	}
+
+	webToken, err := jwt.ParseSigned(token)
+
+	if err != nil {
+		return nil
+	}
+
+	claims := &jwt.Claims{}
+
+	if err := webToken.UnsafeClaimsWithoutVerification(claims); err != nil {
+		return nil
+	}
+
+	return r.getIssuerByURL(claims.Issuer)
+}
+
+// getLoginIssuer returns the additional issuer the browser login is sent to, chosen by the
+// request host or by the path of the request which started the login
+func (r *oauthProxy) getLoginIssuer(req *http.Request) *trustedIssuer {
+	if len(r.issuers) == 0 {
+		return nil
+	}
+
+	host := req.Host
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	for _, issuer := range r.issuers {
+		if utils.ContainedIn(host, issuer.config.Hosts) {
+			return issuer
+		}
+	}
+
+	requestPath := req.URL.Path
+
+	if cookie, err := req.Cookie(r.config.CookieRequestURIName); err == nil {
+		unescaped, _ := url.PathUnescape(cookie.Value)
+
+		if decoded, err := base64.StdEncoding.DecodeString(unescaped); err == nil {
+			if requestURI, err := url.ParseRequestURI(string(decoded)); err == nil {
+				requestPath = requestURI.Path
+			}
+		}
+	}
+
+	for _, issuer := range r.issuers {
+		for _, prefix := range issuer.config.Paths {
+			if strings.HasPrefix(requestPath, prefix) {
+				return issuer
+			}
+		}
+	}
+
+	return nil
+}
+
+// getIssuerConfig returns the configuration of the issuer, the default one for nil
+func (r *oauthProxy) getIssuerConfig(issuer *trustedIssuer) *IssuerConfig {
+	if issuer == nil {
+		return r.config.getDefaultIssuerConfig()
+	}
+
+	return issuer.config
+}
+
+// getIssuerProvider returns the openid provider of the issuer, the default one for nil
+func (r *oauthProxy) getIssuerProvider(issuer *trustedIssuer) *oidc3.Provider {
+	if issuer == nil {
+		return r.provider
+	}
+
+	return issuer.provider
+}
+
+// newAccessTokenVerifier returns the access token verifier of the issuer, the audience of the
+// issuer is required in the tokens, the client id when the issuer has none
+func (r *oauthProxy) newAccessTokenVerifier(issuer *trustedIssuer) *oidc3.IDTokenVerifier {
+	config := r.getIssuerConfig(issuer)
+
+	return r.getIssuerProvider(issuer).Verifier(
+		&oidc3.Config{
+			ClientID:          utils.DefaultTo(config.Audience, config.ClientID),
+			SkipClientIDCheck: config.SkipAccessTokenClientIDCheck,
+			SkipIssuerCheck:   issuer == nil && r.config.SkipAccessTokenIssuerCheck,
+		},
+	)
+}
@@ -0,0 +1,364 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/constant"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func newFakePartnerIssuer(partner *fakeAuthServer) *IssuerConfig {
+	return &IssuerConfig{
+		Name:              "partner",
+		DiscoveryURL:      partner.getLocation(),
+		ClientID:          fakeClientID,
+		ClientSecret:      fakeSecret,
+		Paths:             []string{"/partner"},
+		ClientRolesClaims: []string{"roles"},
+		ClientRolesPrefix: "role",
+	}
+}
+
+func TestTrustedIssuers(t *testing.T) {
+	testCases := []struct {
+		Name              string
+		Issuer            string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name:          "TestPartnerTokenWithPartnerClaimMapping",
+			Issuer:        "partner",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/admin/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedProxyHeaders: map[string]string{
+						"X-Auth-Roles": "default,role:admin",
+					},
+				},
+			},
+		},
+		{
+			Name:          "TestDefaultTokenKeepsDefaultClaimMapping",
+			Issuer:        "default",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/admin/test",
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusForbidden,
+				},
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+		{
+			Name:   "TestPartnerTokenWithWrongAudience",
+			Issuer: "partner",
+			ProxySettings: func(c *Config) {
+				c.Issuers[0].ClientID = "other"
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusForbidden,
+				},
+			},
+		},
+		{
+			Name:   "TestPartnerTokenWithSkippedAudienceCheck",
+			Issuer: "partner",
+			ProxySettings: func(c *Config) {
+				c.Issuers[0].ClientID = "other"
+				c.Issuers[0].SkipAccessTokenClientIDCheck = true
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+		{
+			Name:   "TestPartnerTokenWithIssuerAudience",
+			Issuer: "partner",
+			ProxySettings: func(c *Config) {
+				c.Issuers[0].ClientID = "other"
+				c.Issuers[0].Audience = defTestTokenClaims.Aud
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+		{
+			Name:   "TestPartnerTokenWithoutIssuerAudience",
+			Issuer: "partner",
+			ProxySettings: func(c *Config) {
+				c.Issuers[0].Audience = "partner-api"
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusForbidden,
+				},
+			},
+		},
+		{
+			Name:          "TestUnknownIssuerToken",
+			Issuer:        "https://unknown.example.com/realms/hod-test",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusForbidden,
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				partner := newFakeAuthServer(&fakeAuthConfig{})
+				defer partner.Close()
+
+				cfg := newFakeKeycloakConfig()
+				cfg.Issuers = []*IssuerConfig{newFakePartnerIssuer(partner)}
+				testCase.ProxySettings(cfg)
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+				issuer := testCase.Issuer
+
+				switch issuer {
+				case "partner":
+					issuer = partner.getLocation()
+				case "default":
+					issuer = proxy.idp.getLocation()
+				}
+
+				token, err := newTestToken(issuer).getToken(
+					map[string]interface{}{"roles": []interface{}{"admin"}},
+				)
+				assert.NoError(t, err)
+
+				for idx := range testCase.ExecutionSettings {
+					testCase.ExecutionSettings[idx].RawToken = token
+				}
+
+				proxy.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
+
+func TestTrustedIssuerLogin(t *testing.T) {
+	partner := newFakeAuthServer(&fakeAuthConfig{})
+	defer partner.Close()
+
+	testCases := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name:          "TestAuthorizationRoutedByPath",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI: "/oauth/authorize?state=d0bf1b8e-2a2c-4c3a-9b4c-1f4b6f3e0a11",
+					Cookies: []*http.Cookie{
+						{
+							Name:  constant.RequestURICookie,
+							Value: base64.StdEncoding.EncodeToString([]byte("/partner/page?id=1")),
+						},
+					},
+					ExpectedCode:     http.StatusSeeOther,
+					ExpectedLocation: partner.getLocation(),
+				},
+			},
+		},
+		{
+			Name:          "TestAuthorizationToDefaultIssuer",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI: "/oauth/authorize?state=d0bf1b8e-2a2c-4c3a-9b4c-1f4b6f3e0a11",
+					Cookies: []*http.Cookie{
+						{
+							Name:  constant.RequestURICookie,
+							Value: base64.StdEncoding.EncodeToString([]byte("/internal/page")),
+						},
+					},
+					ExpectedCode:     http.StatusSeeOther,
+					ExpectedLocation: "/realms/hod-test/protocol/openid-connect/auth",
+				},
+			},
+		},
+		{
+			Name: "TestLoginRoutedByHost",
+			ProxySettings: func(c *Config) {
+				c.Issuers[0].Hosts = []string{"127.0.0.1"}
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/auth_all/test",
+					HasLogin:      true,
+					Redirects:     true,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						constant.AccessCookie: func(t *testing.T, c *Config, value string) bool {
+							token, err := jwt.ParseSigned(value)
+
+							if err != nil {
+								return false
+							}
+
+							claims := &jwt.Claims{}
+
+							if err := token.UnsafeClaimsWithoutVerification(claims); err != nil {
+								return false
+							}
+
+							return claims.Issuer == partner.getLocation()
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeKeycloakConfig()
+				cfg.CookieRequestURIName = constant.RequestURICookie
+				cfg.Issuers = []*IssuerConfig{newFakePartnerIssuer(partner)}
+				testCase.ProxySettings(cfg)
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+				proxy.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
+
+func TestGetLoginIssuer(t *testing.T) {
+	partner := newFakeAuthServer(&fakeAuthConfig{})
+	defer partner.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.CookieRequestURIName = constant.RequestURICookie
+	cfg.Issuers = []*IssuerConfig{newFakePartnerIssuer(partner)}
+	cfg.Issuers[0].Hosts = []string{"partner.example.com"}
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	testCases := []struct {
+		Name       string
+		Host       string
+		Path       string
+		RequestURI string
+		Expected   bool
+	}{
+		{
+			Name:     "TestHost",
+			Host:     "partner.example.com",
+			Path:     "/",
+			Expected: true,
+		},
+		{
+			Name:     "TestHostWithPort",
+			Host:     "partner.example.com:8443",
+			Path:     "/",
+			Expected: true,
+		},
+		{
+			Name:     "TestPath",
+			Host:     "internal.example.com",
+			Path:     "/partner/page",
+			Expected: true,
+		},
+		{
+			Name:       "TestPathOfRequestURICookie",
+			Host:       "internal.example.com",
+			Path:       "/oauth/callback",
+			RequestURI: "/partner/page?id=1",
+			Expected:   true,
+		},
+		{
+			Name:       "TestDefaultIssuer",
+			Host:       "internal.example.com",
+			Path:       "/oauth/callback",
+			RequestURI: "/internal/page",
+			Expected:   false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, testCase.Path, nil)
+				req.Host = testCase.Host
+
+				if testCase.RequestURI != "" {
+					req.AddCookie(&http.Cookie{
+						Name:  cfg.CookieRequestURIName,
+						Value: base64.StdEncoding.EncodeToString([]byte(testCase.RequestURI)),
+					})
+				}
+
+				issuer := proxy.proxy.getLoginIssuer(req)
+
+				if testCase.Expected {
+					if assert.NotNil(t, issuer) {
+						assert.Equal(t, "partner", issuer.config.Name)
+					}
+				} else {
+					assert.Nil(t, issuer)
+				}
+			},
+		)
+	}
+}
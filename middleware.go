@@ -17,6 +17,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -26,11 +27,9 @@ import (
 	uuid "github.com/gofrs/uuid"
 	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
 	"github.com/gogatekeeper/gatekeeper/pkg/constant"
-	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
 	"github.com/gogatekeeper/gatekeeper/pkg/utils"
 
 	"github.com/PuerkitoBio/purell"
-	oidc3 "github.com/coreos/go-oidc/v3/oidc"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
 	"github.com/unrolled/secure"
@@ -175,6 +174,30 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 			// grab the user identity from the request
 			user, err := r.getIdentity(req)
 
+			if errors.Is(err, apperrors.ErrInvalidDPoPProof) {
+				scope.Logger.Error(
+					"invalid dpop proof of possession",
+					zap.String("client_ip", clientIP),
+					zap.Error(err),
+				)
+
+				//nolint:contextcheck
+				next.ServeHTTP(wrt, req.WithContext(r.dpopChallenge(wrt, req)))
+				return
+			}
+
+			if errors.Is(err, apperrors.ErrInvalidAPIKey) {
+				scope.Logger.Error(
+					"invalid api key",
+					zap.String("client_ip", clientIP),
+				)
+
+				wrt.WriteHeader(http.StatusUnauthorized)
+				//nolint:contextcheck
+				next.ServeHTTP(wrt, req.WithContext(r.revokeProxy(wrt, req)))
+				return
+			}
+
 			if err != nil {
 				scope.Logger.Error(
 					"no session found in request, redirecting for authorization",
@@ -186,6 +209,72 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 				return
 			}
 
+			// step: api keys are not tokens, there is nothing to verify or refresh
+			if user.apiKey {
+				// the key is a credential of the caller, it is not passed to the upstream
+				req.Header.Del(r.config.APIKeyHeader)
+				scope.Identity = user
+
+				//nolint:contextcheck
+				next.ServeHTTP(wrt, req.WithContext(context.WithValue(req.Context(), constant.ContextScopeName, scope)))
+				return
+			}
+
+			// step: bearer tokens must be bound to the client certificate of the connection
+			if r.config.EnableCertificateBoundTokens && user.bearerToken {
+				if err := verifyCertificateBinding(req, user); err != nil {
+					scope.Logger.Error(
+						"access token failed the certificate binding",
+						zap.String("client_ip", clientIP),
+						zap.String("sub", user.id),
+						zap.Error(err),
+					)
+
+					wrt.WriteHeader(http.StatusUnauthorized)
+					//nolint:contextcheck
+					next.ServeHTTP(wrt, req.WithContext(r.revokeProxy(wrt, req)))
+					return
+				}
+			}
+
+			if r.useSessionIndex() {
+				revoked, err := r.isTokenRevoked(user.rawToken)
+
+				switch {
+				case err != nil:
+					scope.Logger.Warn("unable to check if the token was revoked", zap.Error(err))
+				case revoked:
+					scope.Logger.Warn(
+						"access token was revoked, redirecting for authorization",
+						zap.String("client_ip", clientIP),
+						zap.String("sub", user.id),
+					)
+
+					r.clearAllCookies(req, wrt)
+					//nolint:contextcheck
+					next.ServeHTTP(wrt, req.WithContext(r.redirectToAuthorization(wrt, req)))
+					return
+				}
+			}
+
+			// step: enforce the session limits before the tokens are verified or refreshed
+			if r.useSessionTimestamps() && !user.bearerToken {
+				if err := r.touchSessionTimestamps(req, wrt, user); err != nil {
+					scope.Logger.Info(
+						"session has ended, redirecting for authorization",
+						zap.Error(err),
+						zap.String("client_ip", clientIP),
+						zap.String("sub", user.id),
+					)
+
+					r.clearAllCookies(req, wrt)
+					r.removeSessionState(user, scope.Logger)
+					//nolint:contextcheck
+					next.ServeHTTP(wrt, req.WithContext(r.redirectToAuthorization(wrt, req)))
+					return
+				}
+			}
+
 			scope.Identity = user
 			ctx := context.WithValue(req.Context(), constant.ContextScopeName, scope)
 
@@ -210,17 +299,19 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 					next.ServeHTTP(wrt, req.WithContext(r.redirectToAuthorization(wrt, req)))
 					return
 				}
-			} else { //nolint:gocritic
-				verifier := r.provider.Verifier(
-					&oidc3.Config{
-						ClientID:          r.config.ClientID,
-						SkipClientIDCheck: r.config.SkipAccessTokenClientIDCheck,
-						SkipIssuerCheck:   r.config.SkipAccessTokenIssuerCheck,
-					},
-				)
+			} else if !user.introspected { //nolint:gocritic
+				// introspected tokens have been validated by the provider already
+				var err error
 
-				//nolint:contextcheck
-				_, err := verifier.Verify(context.Background(), user.rawToken)
+				// step: cached identities are of the tokens verified by the previous requests
+				if !user.verified {
+					verifier := r.newAccessTokenVerifier(user.issuer)
+
+					//nolint:contextcheck
+					if _, err = verifier.Verify(context.Background(), user.rawToken); err == nil {
+						r.cacheVerifiedIdentity(user)
+					}
+				}
 
 				if err != nil {
 					// step: if the error post verification is anything other than a token
@@ -288,8 +379,6 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 					//
 					// exp: expiration of the access token
 					// expiresIn: expiration of the ID token
-					conf := r.newOAuth2Config(r.config.RedirectionURL)
-
 					scope.Logger.Debug(
 						"Issuing refresh token request",
 						zap.String("current access token", user.rawToken),
@@ -298,8 +387,10 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 						zap.String("sub", user.id),
 					)
 
+					// concurrent requests of the session share single refresh, as with refresh
+					// token rotation only the first refresh would succeed
 					//nolint:contextcheck
-					_, newRawAccToken, newRefreshToken, accessExpiresAt, refreshExpiresIn, err := getRefreshedToken(conf, r.config, refresh)
+					tokens, err := r.refreshTokens(user.issuer, refresh)
 
 					if err != nil {
 						switch err {
@@ -313,6 +404,16 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 							)
 
 							r.clearAllCookies(req.WithContext(ctx), wrt)
+
+							if user.sessionID != "" {
+								if err := r.deleteServerSession(user.sessionID); err != nil {
+									scope.Logger.Error("failed to remove the server session", zap.Error(err))
+								}
+
+								if err := r.removeSessionFromIndex(user.id, getSessionKey(user.sessionID)); err != nil {
+									scope.Logger.Warn("failed to remove the session from subject index", zap.Error(err))
+								}
+							}
 						default:
 							scope.Logger.Debug(
 								"failed to refresh the access token",
@@ -334,97 +435,18 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 						return
 					}
 
-					scope.Logger.Debug(
-						"info about tokens after refreshing",
-						zap.String("new access token", newRawAccToken),
-						zap.String("new refresh token", newRefreshToken),
-						zap.String("email", user.email),
-						zap.String("sub", user.id),
-					)
-
-					accessExpiresIn := time.Until(accessExpiresAt)
-
-					// get the expiration of the new refresh token
-					if newRefreshToken != "" {
-						refresh = newRefreshToken
-					}
-
-					if refreshExpiresIn == 0 {
-						// refresh token expiry claims not available: try to parse refresh token
-						refreshExpiresIn = r.getAccessCookieExpiration(refresh)
-					}
-
-					scope.Logger.Info(
-						"injecting the refreshed access token cookie",
-						zap.String("client_ip", clientIP),
-						zap.String("remote_addr", req.RemoteAddr),
-						zap.String("cookie_name", r.config.CookieAccessName),
-						zap.String("email", user.email),
-						zap.String("sub", user.id),
-						zap.Duration("refresh_expires_in", refreshExpiresIn),
-						zap.Duration("expires_in", accessExpiresIn),
-					)
-
-					accessToken := newRawAccToken
-
-					if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie {
-						if accessToken, err = encryption.EncodeText(accessToken, r.config.EncryptionKey); err != nil {
-							scope.Logger.Error(
-								"unable to encode the access token", zap.Error(err),
-								zap.String("email", user.email),
-								zap.String("sub", user.id),
-							)
-
-							wrt.WriteHeader(http.StatusInternalServerError)
-							return
-						}
-					}
-
-					// step: inject the refreshed access token
-					r.dropAccessTokenCookie(req.WithContext(ctx), wrt, accessToken, accessExpiresIn)
-
-					// step: inject the renewed refresh token
-					if newRefreshToken != "" {
-						scope.Logger.Debug(
-							"renew refresh cookie with new refresh token",
-							zap.Duration("refresh_expires_in", refreshExpiresIn),
-							zap.String("email", user.email),
-							zap.String("sub", user.id),
-						)
-
-						encryptedRefreshToken, err := encryption.EncodeText(newRefreshToken, r.config.EncryptionKey)
-
-						if err != nil {
-							scope.Logger.Error(
-								"failed to encrypt the refresh token",
-								zap.Error(err),
-								zap.String("email", user.email),
-								zap.String("sub", user.id),
-							)
-
-							wrt.WriteHeader(http.StatusInternalServerError)
-							return
-						}
-
-						if r.useStore() {
-							go func(old, newToken string, encrypted string) {
-								if err := r.DeleteRefreshToken(old); err != nil {
-									scope.Logger.Error("failed to remove old token", zap.Error(err))
-								}
-
-								if err := r.StoreRefreshToken(newToken, encrypted, refreshExpiresIn); err != nil {
-									scope.Logger.Error("failed to store refresh token", zap.Error(err))
-									return
-								}
-							}(user.rawToken, newRawAccToken, encryptedRefreshToken)
-						} else {
-							r.dropRefreshTokenCookie(req.WithContext(ctx), wrt, encryptedRefreshToken, refreshExpiresIn)
-						}
+					if err := r.injectRefreshedTokens(req.WithContext(ctx), wrt, scope.Logger, user, refresh, tokens); err != nil {
+						wrt.WriteHeader(http.StatusInternalServerError)
+						return
 					}
 
 					// update the with the new access token and inject into the context
-					user.rawToken = newRawAccToken
+					user.rawToken = tokens.AccessToken
 					ctx = context.WithValue(req.Context(), constant.ContextScopeName, scope)
+				} else if r.isRefreshDue(user, time.Now()) {
+					// step: the still valid token is proxied while it is being refreshed,
+					// the refreshed cookies are added to a later response of the session
+					r.refreshInBackground(req.WithContext(ctx), wrt, scope.Logger, user)
 				}
 			}
 
@@ -759,6 +781,19 @@ func (r *oauthProxy) admissionMiddleware(resource *authorization.Resource) func(
 				return
 			}
 
+			// @step: check the token was granted the scopes of the resource
+			if !utils.HasAccess(resource.Scopes, user.scopes, !resource.RequireAnyScope) {
+				scope.Logger.Warn("access denied, insufficient scopes",
+					zap.String("access", "denied"),
+					zap.String("email", user.email),
+					zap.String("resource", resource.URL),
+					zap.String("scopes", resource.GetScopes()))
+
+				//nolint:contextcheck
+				next.ServeHTTP(wrt, req.WithContext(r.insufficientScope(wrt, req, resource.Scopes)))
+				return
+			}
+
 			// step: if we have any claim matching, lets validate the tokens has the claims
 			for claimName, match := range claimMatches {
 				if !r.checkClaim(user, claimName, match, resource.URL) {
@@ -827,20 +862,27 @@ func (r *oauthProxy) identityHeadersMiddleware(custom []string) func(http.Handle
 				user := scope.Identity
 				req.Header.Set("X-Auth-Audience", strings.Join(user.audiences, ","))
 				req.Header.Set("X-Auth-Email", user.email)
-				req.Header.Set("X-Auth-ExpiresIn", user.expiresAt.String())
 				req.Header.Set("X-Auth-Groups", strings.Join(user.groups, ","))
 				req.Header.Set("X-Auth-Roles", strings.Join(user.roles, ","))
 				req.Header.Set("X-Auth-Subject", user.id)
 				req.Header.Set("X-Auth-Userid", user.name)
 				req.Header.Set("X-Auth-Username", user.name)
 
-				// should we add the token header?
-				if r.config.EnableTokenHeader {
-					req.Header.Set("X-Auth-Token", user.rawToken)
-				}
-				// add the authorization header if requested
-				if r.config.EnableAuthorizationHeader {
-					req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.rawToken))
+				// the identities of the api keys have neither token nor expiration
+				if !user.apiKey {
+					req.Header.Set("X-Auth-ExpiresIn", user.expiresAt.String())
+
+					// should we add the token header?
+					if r.config.EnableTokenHeader {
+						req.Header.Set("X-Auth-Token", user.rawToken)
+					}
+					// add the authorization header if requested
+					if r.config.EnableAuthorizationHeader {
+						req.Header.Set(
+							constant.AuthorizationHeader,
+							fmt.Sprintf("%s %s", constant.AuthorizationType, user.rawToken),
+						)
+					}
 				}
 				// are we filtering out the cookies
 				if !r.config.EnableAuthorizationCookies {
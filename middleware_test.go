@@ -726,6 +726,72 @@ func TestRequireAnyRoles(t *testing.T) {
 	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
 }
 
+func TestResourceScopes(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*authorization.Resource{
+		{
+			URL:     "/require_all_scopes/*",
+			Methods: utils.AllHTTPMethods,
+			Scopes:  []string{"orders:read", "orders:write"},
+		},
+		{
+			URL:             "/require_any_scope/*",
+			Methods:         utils.AllHTTPMethods,
+			RequireAnyScope: true,
+			Scopes:          []string{"orders:read", "orders:write"},
+		},
+	}
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	getScopedToken := func(claims map[string]interface{}) string {
+		token, err := newTestToken(proxy.idp.getLocation()).getToken(claims)
+		assert.NoError(t, err)
+
+		return token
+	}
+
+	allScopes := getScopedToken(map[string]interface{}{"scope": "openid orders:read orders:write"})
+	readScope := getScopedToken(map[string]interface{}{"scope": "openid orders:read"})
+	scpClaim := getScopedToken(map[string]interface{}{"scp": []string{"orders:read", "orders:write"}})
+	noScopes := getScopedToken(map[string]interface{}{})
+	insufficientScope := map[string]string{
+		"WWW-Authenticate": `Bearer error="insufficient_scope", scope="orders:read orders:write"`,
+	}
+
+	proxy.RunTests(t, []fakeRequest{
+		{
+			URI:           "/require_all_scopes/test",
+			RawToken:      allScopes,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/require_all_scopes/test",
+			RawToken:      scpClaim,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:             "/require_all_scopes/test",
+			RawToken:        readScope,
+			ExpectedCode:    http.StatusForbidden,
+			ExpectedHeaders: insufficientScope,
+		},
+		{
+			URI:           "/require_any_scope/test",
+			RawToken:      readScope,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:             "/require_any_scope/test",
+			RawToken:        noScopes,
+			ExpectedCode:    http.StatusForbidden,
+			ExpectedHeaders: insufficientScope,
+		},
+	})
+}
+
 //nolint:funlen
 func TestHeaderPermissionsMiddleware(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
@@ -2580,7 +2646,13 @@ func TestEnableUmaWithCache(t *testing.T) {
 
 				fProxy.RunTests(t, exSettings)
 
-				redisStoreInstance, assertOk := fProxy.proxy.store.(storage.RedisStore)
+				resilientStoreInstance, assertOk := fProxy.proxy.store.(*resilientStore)
+
+				if !assertOk {
+					t.Fatalf("assertion failed")
+				}
+
+				redisStoreInstance, assertOk := resilientStoreInstance.store.(storage.RedisStore)
 
 				if !assertOk {
 					t.Fatalf("assertion failed")
@@ -99,6 +99,22 @@ func (r *oauthProxy) accessForbidden(wrt http.ResponseWriter, req *http.Request)
 	return r.revokeProxy(wrt, req)
 }
 
+// insufficientScope denies the request of the token without the scopes required by the
+// resource, the challenge tells the client which scopes are required
+// https://www.rfc-editor.org/rfc/rfc6750#section-3.1
+func (r *oauthProxy) insufficientScope(wrt http.ResponseWriter, req *http.Request, scopes []string) context.Context {
+	wrt.Header().Set(
+		"WWW-Authenticate",
+		fmt.Sprintf(
+			`%s error="insufficient_scope", scope="%s"`,
+			constant.AuthorizationType,
+			strings.Join(scopes, " "),
+		),
+	)
+
+	return r.accessForbidden(wrt, req)
+}
+
 // accessError redirects the user to the error page
 func (r *oauthProxy) accessError(wrt http.ResponseWriter, req *http.Request) context.Context {
 	wrt.WriteHeader(http.StatusBadRequest)
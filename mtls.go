@@ -0,0 +1,76 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+var (
+	errNoPeerCertificate        = errors.New("no client certificate presented")
+	errNoCertificateThumbprint  = errors.New("access token is not bound to any certificate")
+	errCertificateBindingFailed = errors.New("access token is bound to other certificate")
+)
+
+// getCertificateThumbprint returns the certificate thumbprint the token is bound to through
+// the cnf claim
+// https://www.rfc-editor.org/rfc/rfc8705#section-3.1
+func getCertificateThumbprint(user *userContext) string {
+	cnf, found := user.claims["cnf"].(map[string]interface{})
+
+	if !found {
+		return ""
+	}
+
+	thumbprint, _ := cnf["x5t#S256"].(string)
+
+	return thumbprint
+}
+
+// getPeerCertificateThumbprint returns the base64url encoded sha256 of the client certificate
+func getPeerCertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// verifyCertificateBinding checks the bearer token is bound to the client certificate of the
+// tls connection the token is presented on
+func verifyCertificateBinding(req *http.Request, user *userContext) error {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return errNoPeerCertificate
+	}
+
+	thumbprint := getCertificateThumbprint(user)
+
+	if thumbprint == "" {
+		return errNoCertificateThumbprint
+	}
+
+	if subtle.ConstantTimeCompare(
+		[]byte(thumbprint),
+		[]byte(getPeerCertificateThumbprint(req.TLS.PeerCertificates[0])),
+	) != 1 {
+		return errCertificateBindingFailed
+	}
+
+	return nil
+}
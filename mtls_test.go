@@ -0,0 +1,165 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestPeerCertificate creates self signed client certificate
+func newTestPeerCertificate(t *testing.T, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	content, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(content)
+	assert.NoError(t, err)
+
+	return cert
+}
+
+func TestCertificateBoundTokens(t *testing.T) {
+	clientCert := newTestPeerCertificate(t, "client")
+	otherCert := newTestPeerCertificate(t, "other")
+
+	testCases := []struct {
+		Name            string
+		Enabled         bool
+		BoundCert       *x509.Certificate
+		PeerCert        *x509.Certificate
+		ExpectedCode    int
+		ExpectedAllowed bool
+	}{
+		{
+			Name:            "TestBoundToPeerCertificate",
+			Enabled:         true,
+			BoundCert:       clientCert,
+			PeerCert:        clientCert,
+			ExpectedCode:    http.StatusOK,
+			ExpectedAllowed: true,
+		},
+		{
+			Name:         "TestBoundToOtherCertificate",
+			Enabled:      true,
+			BoundCert:    otherCert,
+			PeerCert:     clientCert,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			Name:         "TestWithoutPeerCertificate",
+			Enabled:      true,
+			BoundCert:    clientCert,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			Name:         "TestNotBoundToCertificate",
+			Enabled:      true,
+			PeerCert:     clientCert,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			Name:            "TestBindingDisabled",
+			Enabled:         false,
+			BoundCert:       otherCert,
+			PeerCert:        clientCert,
+			ExpectedCode:    http.StatusOK,
+			ExpectedAllowed: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeKeycloakConfig()
+				cfg.EnableCertificateBoundTokens = testCase.Enabled
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+				defer proxy.idp.Close()
+
+				claims := map[string]interface{}{}
+
+				if testCase.BoundCert != nil {
+					claims["cnf"] = map[string]interface{}{
+						"x5t#S256": getPeerCertificateThumbprint(testCase.BoundCert),
+					}
+				}
+
+				token, err := newTestToken(proxy.idp.getLocation()).getToken(claims)
+				assert.NoError(t, err)
+
+				req := httptest.NewRequest(http.MethodGet, "/auth_all/test", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+
+				if testCase.PeerCert != nil {
+					req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{testCase.PeerCert}}
+				}
+
+				resp := httptest.NewRecorder()
+				proxy.proxy.router.ServeHTTP(resp, req)
+
+				assert.Equal(t, testCase.ExpectedCode, resp.Code)
+
+				if testCase.ExpectedAllowed {
+					assert.Equal(t, "true", resp.Header().Get(testProxyAccepted))
+				} else {
+					assert.Empty(t, resp.Header().Get(testProxyAccepted))
+				}
+			},
+		)
+	}
+}
+
+func TestCookieSessionNotCertificateBound(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableCertificateBoundTokens = true
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	proxy.RunTests(t, []fakeRequest{
+		{
+			URI:           "/auth_all/test",
+			HasLogin:      true,
+			Redirects:     true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	})
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+)
+
+// nonceSize is the entropy of the nonce sent in the authorization request
+const nonceSize = 32
+
+var (
+	errNonceNotFound = errors.New("nonce of the login not found")
+	errNonceMismatch = errors.New("nonce of the id token does not match the login")
+)
+
+// newNonce generates the random nonce of the authorization request
+// https://openid.net/specs/openid-connect-core-1_0.html#NonceNotes
+func newNonce() (string, error) {
+	content := make([]byte, nonceSize)
+
+	if _, err := rand.Read(content); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(content), nil
+}
+
+// writeNonceCookie generates new nonce for the authorization request and binds it to the
+// browser with the encrypted cookie
+func (r *oauthProxy) writeNonceCookie(req *http.Request, wrt http.ResponseWriter) (string, error) {
+	nonce, err := newNonce()
+
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := encryption.EncodeText(nonce, r.config.EncryptionKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	r.dropCookie(wrt, req.Host, r.config.CookieNonceName, encrypted, 0)
+
+	return nonce, nil
+}
+
+// verifyNonce checks the nonce of the id token against the one kept in the cookie
+func (r *oauthProxy) verifyNonce(req *http.Request, idTokenNonce string) error {
+	cookie := utils.FindCookie(r.config.CookieNonceName, req.Cookies())
+
+	if cookie == nil || cookie.Value == "" {
+		return errNonceNotFound
+	}
+
+	nonce, err := encryption.DecodeText(cookie.Value, r.config.EncryptionKey)
+
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(idTokenNonce)) != 1 {
+		return errNonceMismatch
+	}
+
+	return nil
+}
+
+// clearNonceCookie clears the nonce cookie once the id token is verified
+func (r *oauthProxy) clearNonceCookie(req *http.Request, wrt http.ResponseWriter) {
+	r.dropCookie(wrt, req.Host, r.config.CookieNonceName, "", -10*time.Hour)
+}
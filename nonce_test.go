@@ -0,0 +1,157 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"testing"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/constant"
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeNonceConfig() *Config {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableNonce = true
+	cfg.CookieNonceName = constant.NonceCookie
+	cfg.CookieOAuthStateName = constant.RequestStateCookie
+	cfg.CookieRequestURIName = constant.RequestURICookie
+	cfg.EncryptionKey = testEncryptionKey
+	cfg.NoRedirects = false
+
+	return cfg
+}
+
+func TestNonceLogin(t *testing.T) {
+	testCases := []struct {
+		Name         string
+		ReplaceNonce bool
+		ExpectedCode int
+	}{
+		{
+			Name:         "TestLoginWithNonce",
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Name:         "TestLoginWithOtherNonce",
+			ReplaceNonce: true,
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				proxy := newFakeProxy(newFakeNonceConfig(), &fakeAuthConfig{})
+				defer proxy.idp.Close()
+
+				jar, err := cookiejar.New(nil)
+				assert.NoError(t, err)
+
+				client := &http.Client{
+					Jar: jar,
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						if testCase.ReplaceNonce && req.URL.Path == "/oauth/callback" {
+							other, err := encryption.EncodeText("other-nonce", testEncryptionKey)
+							assert.NoError(t, err)
+
+							jar.SetCookies(req.URL, []*http.Cookie{{Name: constant.NonceCookie, Value: other, Path: "/"}})
+						}
+
+						return nil
+					},
+				}
+
+				resp, err := client.Get(proxy.getServiceURL() + "/auth_all/test")
+				assert.NoError(t, err)
+				defer resp.Body.Close()
+
+				assert.Equal(t, testCase.ExpectedCode, resp.StatusCode)
+
+				if testCase.ExpectedCode == http.StatusOK {
+					for _, cookie := range jar.Cookies(resp.Request.URL) {
+						assert.NotEqual(t, constant.NonceCookie, cookie.Name, "nonce cookie not cleared after login")
+					}
+				}
+			},
+		)
+	}
+}
+
+func TestNonceAuthorizationAndCallback(t *testing.T) {
+	testCases := []struct {
+		Name              string
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name: "TestAuthorizationSendsNonce",
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:              "/oauth/authorize?state=d0bf1b8e-2a2c-4c3a-9b4c-1f4b6f3e0a11",
+					ExpectedCode:     http.StatusSeeOther,
+					ExpectedLocation: "nonce=",
+					ExpectedCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						constant.NonceCookie: func(t *testing.T, c *Config, value string) bool {
+							return value != ""
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "TestCallbackWithoutNonceCookie",
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:          "/oauth/callback?code=test&state=d0bf1b8e-2a2c-4c3a-9b4c-1f4b6f3e0a11",
+					ExpectedCode: http.StatusForbidden,
+				},
+			},
+		},
+		{
+			Name: "TestCallbackWithCorruptedNonceCookie",
+			ExecutionSettings: []fakeRequest{
+				{
+					URI: "/oauth/callback?code=test&state=d0bf1b8e-2a2c-4c3a-9b4c-1f4b6f3e0a11",
+					Cookies: []*http.Cookie{
+						{
+							Name:  constant.NonceCookie,
+							Value: "corrupted",
+						},
+					},
+					ExpectedCode: http.StatusForbidden,
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				proxy := newFakeProxy(newFakeNonceConfig(), &fakeAuthConfig{})
+				proxy.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
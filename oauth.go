@@ -16,12 +16,19 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 
@@ -29,23 +36,27 @@ import (
 )
 
 const (
-	GrantTypeAuthCode     = "authorization_code"
-	GrantTypeUserCreds    = "password"
-	GrantTypeRefreshToken = "refresh_token"
-	GrantTypeClientCreds  = "client_credentials"
-	GrantTypeUmaTicket    = "urn:ietf:params:oauth:grant-type:uma-ticket"
+	GrantTypeAuthCode      = "authorization_code"
+	GrantTypeUserCreds     = "password"
+	GrantTypeRefreshToken  = "refresh_token"
+	GrantTypeClientCreds   = "client_credentials"
+	GrantTypeUmaTicket     = "urn:ietf:params:oauth:grant-type:uma-ticket"
+	GrantTypeDeviceCode    = "urn:ietf:params:oauth:grant-type:device_code"
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
 )
 
-// newOAuth2Config returns a oauth2 config
-func (r *oauthProxy) newOAuth2Config(redirectionURL string) *oauth2.Config {
+// newOAuth2Config returns a oauth2 config of the issuer, the default one for nil
+func (r *oauthProxy) newOAuth2Config(issuer *trustedIssuer, redirectionURL string) *oauth2.Config {
 	defaultScope := []string{"openid"}
+	issuerConfig := r.getIssuerConfig(issuer)
+	provider := r.getIssuerProvider(issuer)
 
 	conf := &oauth2.Config{
-		ClientID:     r.config.ClientID,
-		ClientSecret: r.config.ClientSecret,
+		ClientID:     issuerConfig.ClientID,
+		ClientSecret: issuerConfig.ClientSecret,
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  r.provider.Endpoint().AuthURL,
-			TokenURL: r.provider.Endpoint().TokenURL,
+			AuthURL:  provider.Endpoint().AuthURL,
+			TokenURL: provider.Endpoint().TokenURL,
 		},
 		RedirectURL: redirectionURL,
 		Scopes:      append(r.config.Scopes, defaultScope...),
@@ -161,12 +172,18 @@ func getRefreshedToken(conf *oauth2.Config, proxyConfig *Config, oldRefreshToken
 }
 
 // exchangeAuthenticationCode exchanges the authentication code with the oauth server for a access token
-func exchangeAuthenticationCode(client *oauth2.Config, code string, skipOpenIDProviderTLSVerify bool) (*oauth2.Token, error) {
-	return getToken(client, GrantTypeAuthCode, code, skipOpenIDProviderTLSVerify)
+func exchangeAuthenticationCode(client *oauth2.Config, code, codeVerifier string, skipOpenIDProviderTLSVerify bool) (*oauth2.Token, error) {
+	var options []oauth2.AuthCodeOption
+
+	if codeVerifier != "" {
+		options = append(options, oauth2.SetAuthURLParam("code_verifier", codeVerifier))
+	}
+
+	return getToken(client, GrantTypeAuthCode, code, skipOpenIDProviderTLSVerify, options...)
 }
 
 // getToken retrieves a code from the provider, extracts and verified the token
-func getToken(config *oauth2.Config, grantType, code string, skipOpenIDProviderTLSVerify bool) (*oauth2.Token, error) {
+func getToken(config *oauth2.Config, grantType, code string, skipOpenIDProviderTLSVerify bool, options ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	ctx := context.Background()
 
 	if skipOpenIDProviderTLSVerify {
@@ -181,7 +198,7 @@ func getToken(config *oauth2.Config, grantType, code string, skipOpenIDProviderT
 	}
 
 	start := time.Now()
-	token, err := config.Exchange(ctx, code)
+	token, err := config.Exchange(ctx, code, options...)
 
 	if err != nil {
 		return token, err
@@ -200,3 +217,173 @@ func getToken(config *oauth2.Config, grantType, code string, skipOpenIDProviderT
 
 	return token, err
 }
+
+// providerEndpoints are the optional endpoints advertised in the discovery document
+type providerEndpoints struct {
+	EndSessionEndpoint          string `json:"end_session_endpoint"`
+	RevocationEndpoint          string `json:"revocation_endpoint"`
+	IntrospectionEndpoint       string `json:"introspection_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+// getProviderEndpoints returns the optional endpoints from the discovery document of the issuer,
+// the default one for nil
+func (r *oauthProxy) getProviderEndpoints(issuer *trustedIssuer) *providerEndpoints {
+	endpoints := &providerEndpoints{}
+
+	if provider := r.getIssuerProvider(issuer); provider != nil {
+		if err := provider.Claims(endpoints); err != nil {
+			r.log.Warn("unable to parse the provider discovery document", zap.Error(err))
+		}
+	}
+
+	return endpoints
+}
+
+// getRevocationURL returns the revocation endpoint of the issuer, configured one takes precedence
+// over the one advertised by the default provider
+func (r *oauthProxy) getRevocationURL(issuer *trustedIssuer) string {
+	if issuer != nil {
+		return r.getProviderEndpoints(issuer).RevocationEndpoint
+	}
+
+	return utils.DefaultTo(r.config.RevocationEndpoint, r.getProviderEndpoints(nil).RevocationEndpoint)
+}
+
+// getEndSessionURL builds the rp-initiated logout url of the provider the session comes from
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html#RPLogout
+func (r *oauthProxy) getEndSessionURL(issuer *trustedIssuer, endSessionEndpoint, idTokenHint, postLogoutRedirectURI string) (string, error) {
+	sendTo, err := url.Parse(endSessionEndpoint)
+
+	if err != nil {
+		return "", err
+	}
+
+	query := sendTo.Query()
+	query.Set("client_id", r.getIssuerConfig(issuer).ClientID)
+
+	if idTokenHint != "" {
+		query.Set("id_token_hint", idTokenHint)
+	}
+
+	if postLogoutRedirectURI != "" {
+		query.Set("post_logout_redirect_uri", postLogoutRedirectURI)
+	}
+
+	sendTo.RawQuery = query.Encode()
+
+	return sendTo.String(), nil
+}
+
+// isPostLogoutRedirectPermitted checks the redirect is the default one or among the permitted ones
+func (r *oauthProxy) isPostLogoutRedirectPermitted(redirectURL string) bool {
+	if redirectURL == strings.TrimSuffix(r.config.RedirectionURL, "/oauth/callback") {
+		return true
+	}
+
+	return utils.ContainedIn(redirectURL, r.config.PostLogoutRedirectURIs)
+}
+
+// keepIDTokenInCookie drops the encrypted id token cookie, it lives as long as the refresh
+// token if we have one, otherwise as long as the access token
+func (r *oauthProxy) keepIDTokenInCookie(req *http.Request, wrt http.ResponseWriter, idToken, refreshToken string, accessExpiration time.Duration) error {
+	encrypted, err := encryption.EncodeText(idToken, r.config.EncryptionKey)
+
+	if err != nil {
+		return err
+	}
+
+	expiration := accessExpiration
+
+	if r.config.EnableRefreshTokens && refreshToken != "" {
+		expiration = r.getAccessCookieExpiration(refreshToken)
+	}
+
+	r.dropIDTokenCookie(req, wrt, encrypted, expiration)
+
+	return nil
+}
+
+// getIDTokenHint retrieves the id token of the user from the server side session
+// or from the encrypted id token cookie
+func (r *oauthProxy) getIDTokenHint(req *http.Request, user *userContext) string {
+	if user.sessionID != "" {
+		session, err := r.loadServerSession(user.sessionID)
+
+		if err != nil {
+			r.log.Debug("unable to load the id token from server session", zap.Error(err))
+			return ""
+		}
+
+		return session.IDToken
+	}
+
+	if !r.useIDTokenCookie() {
+		return ""
+	}
+
+	encrypted, err := utils.GetTokenInCookie(req, r.config.CookieIDTokenName)
+
+	if err != nil {
+		return ""
+	}
+
+	idToken, err := encryption.DecodeText(encrypted, r.config.EncryptionKey)
+
+	if err != nil {
+		r.log.Debug("unable to decrypt the id token cookie", zap.Error(err))
+		return ""
+	}
+
+	return idToken
+}
+
+// revokeToken invalidates the token at the revocation endpoint of the issuer
+func (r *oauthProxy) revokeToken(issuer *trustedIssuer, revocationURL string, token string) error {
+	// step: add the authentication headers
+	issuerConfig := r.getIssuerConfig(issuer)
+	encodedID := url.QueryEscape(issuerConfig.ClientID)
+	encodedSecret := url.QueryEscape(issuerConfig.ClientSecret)
+
+	// step: construct the url for revocation
+	request, err := http.NewRequest(
+		http.MethodPost,
+		revocationURL,
+		bytes.NewBufferString(
+			fmt.Sprintf("token=%s", token),
+		),
+	)
+
+	if err != nil {
+		return fmt.Errorf("unable to construct the revocation request: %w", err)
+	}
+
+	// step: add the authentication headers and content-type
+	request.SetBasicAuth(encodedID, encodedSecret)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	start := time.Now()
+	response, err := r.providerClient.Do(request)
+
+	if err != nil {
+		return fmt.Errorf("unable to post to revocation endpoint: %w", err)
+	}
+
+	defer response.Body.Close()
+
+	oauthLatencyMetric.WithLabelValues("revocation").
+		Observe(time.Since(start).Seconds())
+
+	// step: check the response
+	if response.StatusCode != http.StatusOK {
+		content, _ := ioutil.ReadAll(response.Body)
+
+		return fmt.Errorf(
+			"invalid response from revocation endpoint, status: %d, response: %s",
+			response.StatusCode,
+			string(content),
+		)
+	}
+
+	return nil
+}
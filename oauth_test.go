@@ -20,6 +20,7 @@ package main
 
 import (
 	"context"
+	"net/url"
 	"testing"
 	"time"
 
@@ -89,3 +90,38 @@ func TestTokenExpired(t *testing.T) {
 		}
 	}
 }
+
+func TestGetEndSessionURL(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	proxy := &oauthProxy{config: cfg}
+	partner := &trustedIssuer{config: &IssuerConfig{Name: "partner", ClientID: "partner-client"}}
+
+	testCases := []struct {
+		Issuer   *trustedIssuer
+		ClientID string
+	}{
+		{
+			ClientID: cfg.ClientID,
+		},
+		{
+			Issuer:   partner,
+			ClientID: "partner-client",
+		},
+	}
+
+	for _, testCase := range testCases {
+		sendTo, err := proxy.getEndSessionURL(
+			testCase.Issuer,
+			"https://sso.example.com/logout?ui_locales=en",
+			"hint",
+			"https://app.example.com",
+		)
+		assert.NoError(t, err)
+
+		location, err := url.Parse(sendTo)
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.ClientID, location.Query().Get("client_id"))
+		assert.Equal(t, "hint", location.Query().Get("id_token_hint"))
+		assert.Equal(t, "en", location.Query().Get("ui_locales"))
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// pkceVerifierSize is the entropy of the code verifier, encodes to 43 characters
+	// https://www.rfc-editor.org/rfc/rfc7636#section-4.1
+	pkceVerifierSize = 32
+	// pkceMethodS256 is the code challenge method
+	pkceMethodS256 = "S256"
+)
+
+var errPKCEVerifierNotFound = errors.New("pkce code verifier not found")
+
+// newPKCECodeVerifier generates the random code verifier of the login
+func newPKCECodeVerifier() (string, error) {
+	content := make([]byte, pkceVerifierSize)
+
+	if _, err := rand.Read(content); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(content), nil
+}
+
+// getPKCECodeChallenge returns the S256 code challenge of the code verifier
+func getPKCECodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// getPKCEChallengeOptions returns the authorization request parameters of the code verifier
+func getPKCEChallengeOptions(verifier string) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", getPKCECodeChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", pkceMethodS256),
+	}
+}
+
+// writePKCECookie generates new code verifier for the login and keeps it in the
+// encrypted cookie till the authorization code is exchanged
+func (r *oauthProxy) writePKCECookie(req *http.Request, wrt http.ResponseWriter) (string, error) {
+	verifier, err := newPKCECodeVerifier()
+
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := encryption.EncodeText(verifier, r.config.EncryptionKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	r.dropCookie(wrt, req.Host, r.config.CookiePKCEName, encrypted, 0)
+
+	return verifier, nil
+}
+
+// getPKCECodeVerifier retrieves the code verifier of the login from the cookie
+func (r *oauthProxy) getPKCECodeVerifier(req *http.Request) (string, error) {
+	cookie := utils.FindCookie(r.config.CookiePKCEName, req.Cookies())
+
+	if cookie == nil || cookie.Value == "" {
+		return "", errPKCEVerifierNotFound
+	}
+
+	return encryption.DecodeText(cookie.Value, r.config.EncryptionKey)
+}
+
+// clearPKCECookie clears the code verifier cookie once the code is exchanged
+func (r *oauthProxy) clearPKCECookie(req *http.Request, wrt http.ResponseWriter) {
+	r.dropCookie(wrt, req.Host, r.config.CookiePKCEName, "", -10*time.Hour)
+}
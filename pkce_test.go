@@ -0,0 +1,187 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/constant"
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPKCECodeChallenge(t *testing.T) {
+	// https://www.rfc-editor.org/rfc/rfc7636#appendix-B
+	assert.Equal(
+		t,
+		"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		getPKCECodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"),
+	)
+
+	verifier, err := newPKCECodeVerifier()
+	assert.NoError(t, err)
+	assert.Len(t, verifier, 43)
+
+	other, err := newPKCECodeVerifier()
+	assert.NoError(t, err)
+	assert.NotEqual(t, verifier, other)
+}
+
+func TestPKCELogin(t *testing.T) {
+	testCases := []struct {
+		Name                  string
+		EnablePKCE            bool
+		ExpectedPKCEExchanges int32
+	}{
+		{
+			Name:                  "TestLoginWithPKCE",
+			EnablePKCE:            true,
+			ExpectedPKCEExchanges: 1,
+		},
+		{
+			Name:                  "TestLoginWithoutPKCE",
+			EnablePKCE:            false,
+			ExpectedPKCEExchanges: 0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeKeycloakConfig()
+				cfg.EnablePKCE = testCase.EnablePKCE
+				cfg.CookiePKCEName = constant.PKCECookie
+				cfg.EncryptionKey = testEncryptionKey
+				cfg.CookieOAuthStateName = constant.RequestStateCookie
+				cfg.CookieRequestURIName = constant.RequestURICookie
+				cfg.NoRedirects = false
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+				defer proxy.idp.Close()
+
+				jar, err := cookiejar.New(nil)
+				assert.NoError(t, err)
+
+				client := &http.Client{Jar: jar}
+				resp, err := client.Get(proxy.getServiceURL() + "/auth_all/test")
+				assert.NoError(t, err)
+				defer resp.Body.Close()
+
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, "true", resp.Header.Get(testProxyAccepted))
+				assert.Equal(t, testCase.ExpectedPKCEExchanges, atomic.LoadInt32(&proxy.idp.pkceExchanges))
+
+				for _, cookie := range jar.Cookies(resp.Request.URL) {
+					assert.NotEqual(t, constant.PKCECookie, cookie.Name, "pkce cookie not cleared after login")
+				}
+			},
+		)
+	}
+}
+
+func TestPKCEAuthorizationAndCallback(t *testing.T) {
+	leftoverVerifier, err := encryption.EncodeText("leftover-verifier", testEncryptionKey)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		Name              string
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name: "TestAuthorizationSendsCodeChallenge",
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:              "/oauth/authorize?state=d0bf1b8e-2a2c-4c3a-9b4c-1f4b6f3e0a11",
+					ExpectedCode:     http.StatusSeeOther,
+					ExpectedLocation: "code_challenge_method=S256",
+					ExpectedCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						constant.PKCECookie: func(t *testing.T, c *Config, value string) bool {
+							return value != ""
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "TestAuthorizationReplacesLeftoverCodeVerifier",
+			ExecutionSettings: []fakeRequest{
+				{
+					URI: "/oauth/authorize?state=d0bf1b8e-2a2c-4c3a-9b4c-1f4b6f3e0a11",
+					Cookies: []*http.Cookie{
+						{
+							Name:  constant.PKCECookie,
+							Value: leftoverVerifier,
+						},
+					},
+					ExpectedCode:     http.StatusSeeOther,
+					ExpectedLocation: "code_challenge_method=S256",
+					ExpectedCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						constant.PKCECookie: func(t *testing.T, c *Config, value string) bool {
+							verifier, err := encryption.DecodeText(value, c.EncryptionKey)
+							return err == nil && verifier != "leftover-verifier"
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "TestCallbackWithoutCodeVerifier",
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:          "/oauth/callback?code=test&state=d0bf1b8e-2a2c-4c3a-9b4c-1f4b6f3e0a11",
+					ExpectedCode: http.StatusForbidden,
+				},
+			},
+		},
+		{
+			Name: "TestCallbackWithCorruptedCodeVerifier",
+			ExecutionSettings: []fakeRequest{
+				{
+					URI: "/oauth/callback?code=test&state=d0bf1b8e-2a2c-4c3a-9b4c-1f4b6f3e0a11",
+					Cookies: []*http.Cookie{
+						{
+							Name:  constant.PKCECookie,
+							Value: "corrupted",
+						},
+					},
+					ExpectedCode: http.StatusForbidden,
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeKeycloakConfig()
+				cfg.EnablePKCE = true
+				cfg.CookiePKCEName = constant.PKCECookie
+				cfg.EncryptionKey = testEncryptionKey
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+				proxy.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
@@ -21,5 +21,15 @@ var (
 	ErrDefaultDenyWhitelistConflict    = errors.New("you've asked for a default denial but whitelisted everything")
 	ErrDefaultDenyUserDefinedConflict  = errors.New("you've enabled default deny and at the same time defined own rules for /*")
 	ErrBadDiscoveryURIFormat           = errors.New("bad discovery url format")
+	ErrStoreTimeout                    = errors.New("store operation timed out")
+	ErrStoreCircuitOpen                = errors.New("store circuit breaker is open")
 	ErrForwardAuthMissingHeaders       = errors.New("seems you are using gatekeeper as forward-auth, but you don't forward X-FORWARDED-* headers from front proxy")
+	ErrTokenInactive                   = errors.New("token is not active according to introspection")
+	ErrNoIntrospectionEndpoint         = errors.New("no introspection endpoint configured or advertised by the provider")
+	ErrNoDeviceAuthorizationEndpoint   = errors.New("no device authorization endpoint configured or advertised by the provider")
+	ErrTokenExchangeRefused            = errors.New("token exchange refused by the provider")
+	ErrNoTokenToExchange               = errors.New("identity has no access token to exchange")
+	ErrInvalidDPoPProof                = errors.New("invalid dpop proof")
+	ErrInvalidAPIKey                   = errors.New("invalid api key")
+	ErrInvalidBasicCredentials         = errors.New("invalid basic credentials")
 )
@@ -41,6 +41,16 @@ type Resource struct {
 	Roles []string `json:"roles" yaml:"roles"`
 	// Groups is a list of groups the user is in
 	Groups []string `json:"groups" yaml:"groups"`
+	// Scopes the oauth scopes of the token required to access this url
+	Scopes []string `json:"scopes" yaml:"scopes"`
+	// RequireAnyScope indicates that ANY of the scopes are required, the default is all
+	RequireAnyScope bool `json:"require-any-scope" yaml:"require-any-scope"`
+	// ExchangeAudience is the audience the user token is exchanged for before forwarding
+	ExchangeAudience string `json:"exchange-audience" yaml:"exchange-audience"`
+	// ExchangeScopes are the scopes requested for the exchanged token
+	ExchangeScopes []string `json:"exchange-scopes" yaml:"exchange-scopes"`
+	// BasicAuth indicates the basic credentials are exchanged for token with the password grant
+	BasicAuth bool `json:"basic-auth" yaml:"basic-auth"`
 }
 
 func NewResource() *Resource {
@@ -102,6 +112,28 @@ func (r *Resource) Parse(resource string) (*Resource, error) {
 			}
 		case "groups":
 			r.Groups = strings.Split(keyPair[1], ",")
+		case "scopes":
+			r.Scopes = strings.Split(keyPair[1], ",")
+		case "require-any-scope":
+			val, err := strconv.ParseBool(keyPair[1])
+
+			if err != nil {
+				return nil, err
+			}
+
+			r.RequireAnyScope = val
+		case "exchange-audience":
+			r.ExchangeAudience = keyPair[1]
+		case "exchange-scopes":
+			r.ExchangeScopes = strings.Split(keyPair[1], ",")
+		case "basic-auth":
+			val, err := strconv.ParseBool(keyPair[1])
+
+			if err != nil {
+				return nil, err
+			}
+
+			r.BasicAuth = val
 		case "white-listed":
 			value, err := strconv.ParseBool(keyPair[1])
 
@@ -144,6 +176,14 @@ func (r *Resource) Valid() error {
 		)
 	}
 
+	if len(r.ExchangeScopes) > 0 && r.ExchangeAudience == "" {
+		return errors.New("the resource exchange scopes require exchange audience")
+	}
+
+	if r.BasicAuth && r.WhiteListed {
+		return errors.New("the white listed resource cannot use basic auth")
+	}
+
 	// step: add any of no methods
 	if len(r.Methods) == 0 {
 		r.Methods = utils.AllHTTPMethods
@@ -163,6 +203,11 @@ func (r Resource) GetRoles() string {
 	return strings.Join(r.Roles, ",")
 }
 
+// GetScopes returns a list of scopes for this resource
+func (r Resource) GetScopes() string {
+	return strings.Join(r.Scopes, ",")
+}
+
 // GetHeaders returns a list of headers for this resource
 func (r Resource) GetHeaders() string {
 	return strings.Join(r.Headers, ",")
@@ -185,5 +230,15 @@ func (r Resource) String() string {
 		methods = strings.Join(r.Methods, ",")
 	}
 
-	return fmt.Sprintf("uri: %s, methods: %s, required: %s", r.URL, methods, roles)
+	description := fmt.Sprintf("uri: %s, methods: %s, required: %s", r.URL, methods, roles)
+
+	if len(r.Scopes) > 0 {
+		description += fmt.Sprintf(", scopes: %s", strings.Join(r.Scopes, ","))
+
+		if r.RequireAnyScope {
+			description += ", require-any-scope"
+		}
+	}
+
+	return description
 }
@@ -36,6 +36,8 @@ func TestDecodeResourceBad(t *testing.T) {
 		{Option: "uri=hello"},
 		{Option: "uri=/|white-listed=ERROR"},
 		{Option: "uri=/|require-any-role=BAD"},
+		{Option: "uri=/|basic-auth=BAD"},
+		{Option: "uri=/|require-any-scope=BAD"},
 	}
 	for i, testCase := range testCases {
 		if _, err := NewResource().Parse(testCase.Option); err == nil {
@@ -156,6 +158,35 @@ func TestResourceParseOk(t *testing.T) {
 			},
 			Ok: true,
 		},
+		{
+			Option: "uri=/orders/*|exchange-audience=orders|exchange-scopes=orders:read,orders:write",
+			Resource: &Resource{
+				URL:              "/orders/*",
+				Methods:          utils.AllHTTPMethods,
+				ExchangeAudience: "orders",
+				ExchangeScopes:   []string{"orders:read", "orders:write"},
+			},
+			Ok: true,
+		},
+		{
+			Option: "uri=/partner/*|scopes=partner:read,partner:write|require-any-scope=true",
+			Resource: &Resource{
+				URL:             "/partner/*",
+				Methods:         utils.AllHTTPMethods,
+				Scopes:          []string{"partner:read", "partner:write"},
+				RequireAnyScope: true,
+			},
+			Ok: true,
+		},
+		{
+			Option: "uri=/legacy/*|basic-auth=true",
+			Resource: &Resource{
+				URL:       "/legacy/*",
+				Methods:   utils.AllHTTPMethods,
+				BasicAuth: true,
+			},
+			Ok: true,
+		},
 	}
 	for i, testCase := range testCases {
 		r, err := NewResource().Parse(testCase.Option)
@@ -209,6 +240,34 @@ func TestIsValid(t *testing.T) {
 			CustomHTTPMethods: []string{"PROPFIND"},
 			Ok:                true,
 		},
+		{
+			Resource: &Resource{
+				URL:              "/orders",
+				ExchangeAudience: "orders",
+				ExchangeScopes:   []string{"orders:read"},
+			},
+			Ok: true,
+		},
+		{
+			Resource: &Resource{
+				URL:            "/orders",
+				ExchangeScopes: []string{"orders:read"},
+			},
+		},
+		{
+			Resource: &Resource{
+				URL:       "/legacy",
+				BasicAuth: true,
+			},
+			Ok: true,
+		},
+		{
+			Resource: &Resource{
+				URL:         "/legacy",
+				BasicAuth:   true,
+				WhiteListed: true,
+			},
+		},
 	}
 
 	for idx, testCase := range testCases {
@@ -236,6 +295,19 @@ func TestResourceString(t *testing.T) {
 	if s := resource.String(); s == "" {
 		t.Error("we should have received a string")
 	}
+
+	resource = &Resource{
+		URL:             "/reports/*",
+		Methods:         []string{"GET"},
+		Roles:           expectedRoles,
+		Scopes:          []string{"reports:read", "reports:write"},
+		RequireAnyScope: true,
+	}
+	expected := "uri: /reports/*, methods: GET, required: 1,2,3, scopes: reports:read,reports:write, require-any-scope"
+
+	if s := resource.String(); s != expected {
+		t.Errorf("expected: %s, got: %s", expected, s)
+	}
 }
 
 func TestGetRoles(t *testing.T) {
@@ -247,3 +319,13 @@ func TestGetRoles(t *testing.T) {
 		t.Error("the resource roles not as expected")
 	}
 }
+
+func TestGetScopes(t *testing.T) {
+	resource := &Resource{
+		Scopes: []string{"partner:read", "partner:write"},
+	}
+
+	if resource.GetScopes() != "partner:read,partner:write" {
+		t.Error("the resource scopes not as expected")
+	}
+}
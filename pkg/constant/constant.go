@@ -8,28 +8,41 @@ const (
 	Email       = ""
 	Description = "is a proxy using the keycloak service for auth and authorization"
 
-	AuthorizationHeader = "Authorization"
-	AuthorizationType   = "Bearer"
-	EnvPrefix           = "PROXY_"
-	HeaderUpgrade       = "Upgrade"
-	VersionHeader       = "X-Auth-Proxy-Version"
-
-	AuthorizationURL = "/authorize"
-	CallbackURL      = "/callback"
-	ExpiredURL       = "/expired"
-	HealthURL        = "/health"
-	LoginURL         = "/login"
-	LogoutURL        = "/logout"
-	MetricsURL       = "/metrics"
-	TokenURL         = "/token"
-	DebugURL         = "/debug/pprof"
-	DiscoveryURL     = "/discovery"
+	AuthorizationHeader   = "Authorization"
+	AuthorizationType     = "Bearer"
+	DPoPAuthorizationType = "DPoP"
+	DPoPHeader            = "DPoP"
+	EnvPrefix             = "PROXY_"
+	HeaderUpgrade         = "Upgrade"
+	VersionHeader         = "X-Auth-Proxy-Version"
+
+	AuthorizationURL     = "/authorize"
+	CallbackURL          = "/callback"
+	ExpiredURL           = "/expired"
+	HealthURL            = "/health"
+	LoginURL             = "/login"
+	LogoutURL            = "/logout"
+	MetricsURL           = "/metrics"
+	TokenURL             = "/token"
+	DebugURL             = "/debug/pprof"
+	DiscoveryURL         = "/discovery"
+	SessionsURL          = "/sessions"
+	BackchannelLogoutURL = "/backchannel-logout"
+	DeviceURL            = "/device"
+	DeviceTokenURL       = "/device/token"
 
 	ClaimResourceRoles = "roles"
+	ClaimScope         = "scope"
+	ClaimScp           = "scp"
 
 	AccessCookie       = "kc-access"
 	RefreshCookie      = "kc-state"
+	SessionCookie      = "kc-session"
+	IDTokenCookie      = "id_token"
+	SessionTimeCookie  = "kc-session-time"
 	RequestURICookie   = "request_uri"
+	PKCECookie         = "kc-pkce"
+	NonceCookie        = "kc-nonce"
 	RequestStateCookie = "OAuth_Token_Request_State"
 	UnsecureScheme     = "http"
 	SecureScheme       = "https"
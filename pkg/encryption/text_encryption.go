@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"io"
+	"strings"
 
 	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
 )
@@ -86,3 +87,66 @@ func DecodeText(state, key string) (string, error) {
 
 	return string(encoded), nil
 }
+
+// envelopeDataKeySize is the size of random data key generated for each value
+const envelopeDataKeySize = 32
+
+// EncodeEnvelope encrypts the plaintext with a random data key, the data key itself
+// is encrypted with the key and stored along with the value, i.e. wrappedkey.ciphertext
+func EncodeEnvelope(plaintext string, key string) (string, error) {
+	dataKey := make([]byte, envelopeDataKeySize)
+
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := EncryptDataBlock(dataKey, []byte(key))
+
+	if err != nil {
+		return "", err
+	}
+
+	cipherText, err := EncryptDataBlock([]byte(plaintext), dataKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawStdEncoding.EncodeToString(wrappedKey) + "." +
+		base64.RawStdEncoding.EncodeToString(cipherText), nil
+}
+
+// DecodeEnvelope unwraps the data key with the key and decrypts the value
+func DecodeEnvelope(envelope string, key string) (string, error) {
+	parts := strings.SplitN(envelope, ".", 2)
+
+	if len(parts) != 2 {
+		return "", apperrors.ErrDecryption
+	}
+
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return "", apperrors.ErrDecryption
+	}
+
+	cipherText, err := base64.RawStdEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return "", apperrors.ErrDecryption
+	}
+
+	dataKey, err := DecryptDataBlock(wrappedKey, []byte(key))
+
+	if err != nil {
+		return "", apperrors.ErrDecryption
+	}
+
+	plaintext, err := DecryptDataBlock(cipherText, dataKey)
+
+	if err != nil {
+		return "", apperrors.ErrDecryption
+	}
+
+	return string(plaintext), nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"testing"
 
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -129,3 +130,28 @@ func TestDecryptDataBlock(t *testing.T) {
 		}
 	}
 }
+
+func TestEnvelope(t *testing.T) {
+	key := "1gjrlcjQ8RyKANngp9607txr5fF5fhf1"
+
+	envelope, err := EncodeEnvelope("12245325632323263762", key)
+	require.NoError(t, err)
+	assert.NotContains(t, envelope, "12245325632323263762")
+
+	// every value is encrypted with its own data key
+	other, err := EncodeEnvelope("12245325632323263762", key)
+	require.NoError(t, err)
+	assert.NotEqual(t, envelope, other)
+
+	plaintext, err := DecodeEnvelope(envelope, key)
+	require.NoError(t, err)
+	assert.Equal(t, "12245325632323263762", plaintext)
+
+	_, err = DecodeEnvelope(envelope, "u3K0eKsmGl76jY1buzexwYoRRLLQrQck")
+	assert.ErrorIs(t, err, apperrors.ErrDecryption)
+
+	for _, invalid := range []string{"", "plain", "a.b", envelope[:len(envelope)-4]} {
+		_, err = DecodeEnvelope(invalid, key)
+		assert.ErrorIs(t, err, apperrors.ErrDecryption, invalid)
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"time"
@@ -11,6 +12,8 @@ import (
 type Storage interface {
 	// Set the token to the store
 	Set(string, string, time.Duration) error
+	// SetNX sets the token only if the key doesn't exist yet, reports if it was set
+	SetNX(string, string, time.Duration) (bool, error)
 	// Get retrieves a token from the store
 	Get(string) (string, error)
 	// Exists checks if key exists in store
@@ -21,6 +24,23 @@ type Storage interface {
 	Close() error
 }
 
+// ContextStorage is implemented by the stores which can abandon the calls once the context
+// is done, e.g. when the caller has stopped waiting for the result. The redis client has no
+// support for the cancellation, its calls are bounded by the read and write timeouts instead
+type ContextStorage interface {
+	// WithContext returns the store with all calls bound to the context
+	WithContext(context.Context) Storage
+}
+
+// WithContext binds the store to the context, stores without support are returned as they are
+func WithContext(ctx context.Context, store Storage) Storage {
+	if aware, ok := store.(ContextStorage); ok {
+		return aware.WithContext(ctx)
+	}
+
+	return store
+}
+
 // createStorage creates the store client for use
 func CreateStorage(location string) (Storage, error) {
 	var store Storage
@@ -33,8 +53,12 @@ func CreateStorage(location string) (Storage, error) {
 	}
 
 	switch uri.Scheme {
-	case "redis":
+	case "redis", "rediss", "redis-sentinel", "redis-cluster":
 		store, err = newRedisStore(uri)
+	case "memory":
+		store, err = newMemoryStore(uri)
+	case "file":
+		store, err = newBoltStore(uri)
 	default:
 		return nil, fmt.Errorf("unsupport store: %s", uri.Scheme)
 	}
@@ -0,0 +1,372 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DefaultBoltStoreCompactionInterval is the default interval of expired keys removal
+	DefaultBoltStoreCompactionInterval = 5 * time.Minute
+	// boltOpenTimeout is the time we wait for file lock when opening database
+	boltOpenTimeout = 5 * time.Second
+	// boltExpirationSize is the size of expiration prefix stored with each value
+	boltExpirationSize = 8
+)
+
+var (
+	boltBucket = []byte("gatekeeper")
+
+	ErrBoltCorruptedValue = errors.New("corrupted value in file store")
+)
+
+var (
+	_ Storage        = (*BoltStore)(nil)
+	_ ContextStorage = (*BoltStore)(nil)
+)
+
+// BoltStore is a persistent embedded store backed by bbolt file
+type BoltStore struct {
+	Client *bolt.DB
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newBoltStore creates a new file store, options are taken from the url query:
+// file:///var/lib/gatekeeper/tokens.db?compaction-interval=5m
+func newBoltStore(location *url.URL) (Storage, error) {
+	path := location.Host + location.Path
+
+	if path == "" {
+		return nil, errors.New("file store requires a path, e.g. file:///etc/tokens.file")
+	}
+
+	compactionInterval := DefaultBoltStoreCompactionInterval
+
+	if val := location.Query().Get("compaction-interval"); val != "" {
+		interval, err := time.ParseDuration(val)
+
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid file store compaction-interval: %s", val)
+		}
+
+		compactionInterval = interval
+	}
+
+	return NewBoltStore(path, compactionInterval)
+}
+
+// NewBoltStore opens or creates the database file and starts the background compaction
+func NewBoltStore(path string, compactionInterval time.Duration) (*BoltStore, error) {
+	client, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file store %s: %w", path, err)
+	}
+
+	err = client.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	store := &BoltStore{
+		Client: client,
+		done:   make(chan struct{}),
+	}
+
+	go store.compactor(compactionInterval)
+
+	return store, nil
+}
+
+// WithContext returns the file store with all calls bound to the context
+func (b *BoltStore) WithContext(ctx context.Context) Storage {
+	return &boltContextStore{store: b, ctx: ctx}
+}
+
+// Set adds a token to the store
+func (b *BoltStore) Set(key, value string, expiration time.Duration) error {
+	return b.set(context.Background(), key, value, expiration)
+}
+
+// SetNX adds a token to the store only if the key doesn't exist yet
+func (b *BoltStore) SetNX(key, value string, expiration time.Duration) (bool, error) {
+	return b.setNX(context.Background(), key, value, expiration)
+}
+
+// Checks if key exists in store
+func (b *BoltStore) Exists(key string) (bool, error) {
+	return b.exists(context.Background(), key)
+}
+
+// Get retrieves a token from the store, missing key returns empty value
+func (b *BoltStore) Get(key string) (string, error) {
+	return b.get(context.Background(), key)
+}
+
+// Delete remove the key
+func (b *BoltStore) Delete(key string) error {
+	return b.delete(context.Background(), key)
+}
+
+func (b *BoltStore) set(ctx context.Context, key, value string, expiration time.Duration) error {
+	content := encodeBoltValue(value, expiration)
+
+	return b.update(ctx, func(bucket *bolt.Bucket) error {
+		return bucket.Put([]byte(key), content)
+	})
+}
+
+func (b *BoltStore) setNX(ctx context.Context, key, value string, expiration time.Duration) (bool, error) {
+	var added bool
+
+	content := encodeBoltValue(value, expiration)
+
+	err := b.update(ctx, func(bucket *bolt.Bucket) error {
+		if current := bucket.Get([]byte(key)); current != nil {
+			_, expired, err := decodeBoltValue(current, time.Now())
+
+			if err != nil || !expired {
+				return err
+			}
+		}
+
+		added = true
+
+		return bucket.Put([]byte(key), content)
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return added, nil
+}
+
+func (b *BoltStore) exists(ctx context.Context, key string) (bool, error) {
+	var found bool
+
+	err := b.view(ctx, func(bucket *bolt.Bucket) error {
+		content := bucket.Get([]byte(key))
+
+		if content == nil {
+			return nil
+		}
+
+		_, expired, err := decodeBoltValue(content, time.Now())
+		found = !expired
+
+		return err
+	})
+
+	return found, err
+}
+
+func (b *BoltStore) get(ctx context.Context, key string) (string, error) {
+	var value string
+
+	err := b.view(ctx, func(bucket *bolt.Bucket) error {
+		content := bucket.Get([]byte(key))
+
+		if content == nil {
+			return nil
+		}
+
+		val, expired, err := decodeBoltValue(content, time.Now())
+
+		if err != nil || expired {
+			return err
+		}
+
+		// value returned by bolt is valid only during transaction
+		value = string(val)
+
+		return nil
+	})
+
+	return value, err
+}
+
+func (b *BoltStore) delete(ctx context.Context, key string) error {
+	return b.update(ctx, func(bucket *bolt.Bucket) error {
+		return bucket.Delete([]byte(key))
+	})
+}
+
+// update runs the writable transaction, the transaction is rolled back when the context
+// is done before it commits, so the abandoned writes are never applied
+func (b *BoltStore) update(ctx context.Context, operation func(*bolt.Bucket) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return b.Client.Update(func(tx *bolt.Tx) error {
+		if err := operation(tx.Bucket(boltBucket)); err != nil {
+			return err
+		}
+
+		return ctx.Err()
+	})
+}
+
+// view runs the read only transaction, unless the context is already done
+func (b *BoltStore) view(ctx context.Context, operation func(*bolt.Bucket) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return b.Client.View(func(tx *bolt.Tx) error {
+		return operation(tx.Bucket(boltBucket))
+	})
+}
+
+// Close stops the compaction and closes the database file
+func (b *BoltStore) Close() error {
+	var err error
+
+	b.once.Do(func() {
+		close(b.done)
+		err = b.Client.Close()
+	})
+
+	return err
+}
+
+// compact removes all expired keys
+func (b *BoltStore) compact() error {
+	now := time.Now()
+
+	return b.Client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		// deleting while iterating with cursor skips keys, so we collect them first
+		var expiredKeys [][]byte
+
+		err := bucket.ForEach(func(key, content []byte) error {
+			_, expired, err := decodeBoltValue(content, now)
+
+			// corrupted values are of no use, we remove them as well
+			if err != nil || expired {
+				expiredKeys = append(expiredKeys, append([]byte{}, key...))
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expiredKeys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// compactor periodically removes expired keys until store is closed
+func (b *BoltStore) compactor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = b.compact()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// encodeBoltValue prefixes the value with its expiration, zero means no expiration
+func encodeBoltValue(value string, expiration time.Duration) []byte {
+	var expiresAt int64
+
+	if expiration > 0 {
+		expiresAt = time.Now().Add(expiration).UnixNano()
+	}
+
+	content := make([]byte, boltExpirationSize+len(value))
+	binary.BigEndian.PutUint64(content, uint64(expiresAt))
+	copy(content[boltExpirationSize:], value)
+
+	return content
+}
+
+// decodeBoltValue splits stored content into value and expiration state
+func decodeBoltValue(content []byte, now time.Time) ([]byte, bool, error) {
+	if len(content) < boltExpirationSize {
+		return nil, false, ErrBoltCorruptedValue
+	}
+
+	expiresAt := int64(binary.BigEndian.Uint64(content[:boltExpirationSize]))
+	expired := expiresAt != 0 && now.UnixNano() > expiresAt
+
+	return content[boltExpirationSize:], expired, nil
+}
+
+// boltContextStore is the file store with all calls bound to the context
+type boltContextStore struct {
+	store *BoltStore
+	ctx   context.Context
+}
+
+// Set adds a token to the store
+func (b *boltContextStore) Set(key, value string, expiration time.Duration) error {
+	return b.store.set(b.ctx, key, value, expiration)
+}
+
+// SetNX adds a token to the store only if the key doesn't exist yet
+func (b *boltContextStore) SetNX(key, value string, expiration time.Duration) (bool, error) {
+	return b.store.setNX(b.ctx, key, value, expiration)
+}
+
+// Checks if key exists in store
+func (b *boltContextStore) Exists(key string) (bool, error) {
+	return b.store.exists(b.ctx, key)
+}
+
+// Get retrieves a token from the store, missing key returns empty value
+func (b *boltContextStore) Get(key string) (string, error) {
+	return b.store.get(b.ctx, key)
+}
+
+// Delete remove the key
+func (b *boltContextStore) Delete(key string) error {
+	return b.store.delete(b.ctx, key)
+}
+
+// Close closes the underlying file store
+func (b *boltContextStore) Close() error {
+	return b.store.Close()
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMemoryStoreMaxSize is the default max number of keys held in memory store
+	DefaultMemoryStoreMaxSize = 10000
+	// DefaultMemoryStoreSweepInterval is the default interval of expired keys eviction
+	DefaultMemoryStoreSweepInterval = time.Minute
+)
+
+var _ Storage = (*MemoryStore)(nil)
+
+// memoryEntry is a single key held in the memory store
+type memoryEntry struct {
+	key       string
+	value     string
+	expiresAt time.Time
+}
+
+// expired checks if the entry has expired, zero expiration means no expiration
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// MemoryStore is an in-process store with per-key expiration and LRU eviction
+type MemoryStore struct {
+	mu      sync.Mutex
+	items   map[string]*list.Element
+	lru     *list.List
+	maxSize int
+	done    chan struct{}
+	once    sync.Once
+}
+
+// newMemoryStore creates a new memory store, options are taken from the url query:
+// memory://?max-size=10000&sweep-interval=1m
+func newMemoryStore(location *url.URL) (Storage, error) {
+	maxSize := DefaultMemoryStoreMaxSize
+	sweepInterval := DefaultMemoryStoreSweepInterval
+	query := location.Query()
+
+	if val := query.Get("max-size"); val != "" {
+		size, err := strconv.Atoi(val)
+
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid memory store max-size: %s", val)
+		}
+
+		maxSize = size
+	}
+
+	if val := query.Get("sweep-interval"); val != "" {
+		interval, err := time.ParseDuration(val)
+
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid memory store sweep-interval: %s", val)
+		}
+
+		sweepInterval = interval
+	}
+
+	return NewMemoryStore(maxSize, sweepInterval), nil
+}
+
+// NewMemoryStore creates a memory store holding at most maxSize keys and
+// starts the background sweeper removing expired keys
+func NewMemoryStore(maxSize int, sweepInterval time.Duration) *MemoryStore {
+	store := &MemoryStore{
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+		maxSize: maxSize,
+		done:    make(chan struct{}),
+	}
+
+	go store.sweeper(sweepInterval)
+
+	return store
+}
+
+// Set adds a token to the store
+func (m *MemoryStore) Set(key, value string, expiration time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.set(key, value, expiration)
+
+	return nil
+}
+
+// SetNX adds a token to the store only if the key doesn't exist yet
+func (m *MemoryStore) SetNX(key, value string, expiration time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, found := m.lookup(key); found {
+		return false, nil
+	}
+
+	m.set(key, value, expiration)
+
+	return true, nil
+}
+
+// set adds or replaces the entry and evicts the least recently used entries over
+// the max size, must be called with lock held
+func (m *MemoryStore) set(key, value string, expiration time.Duration) {
+	var expiresAt time.Time
+
+	if expiration > 0 {
+		expiresAt = time.Now().Add(expiration)
+	}
+
+	if elem, found := m.items[key]; found {
+		entry, _ := elem.Value.(*memoryEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		m.lru.MoveToFront(elem)
+
+		return
+	}
+
+	m.items[key] = m.lru.PushFront(&memoryEntry{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
+	})
+
+	for m.maxSize > 0 && m.lru.Len() > m.maxSize {
+		m.removeElement(m.lru.Back())
+	}
+}
+
+// Checks if key exists in store
+func (m *MemoryStore) Exists(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, found := m.lookup(key)
+
+	return found, nil
+}
+
+// Get retrieves a token from the store, missing key returns empty value
+func (m *MemoryStore) Get(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, found := m.lookup(key)
+
+	if !found {
+		return "", nil
+	}
+
+	return entry.value, nil
+}
+
+// Delete remove the key
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, found := m.items[key]; found {
+		m.removeElement(elem)
+	}
+
+	return nil
+}
+
+// Close stops the background sweeper
+func (m *MemoryStore) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+	})
+
+	return nil
+}
+
+// Len returns number of keys currently held, including not yet swept expired keys
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lru.Len()
+}
+
+// lookup returns live entry and marks it as recently used, must be called with lock held
+func (m *MemoryStore) lookup(key string) (*memoryEntry, bool) {
+	elem, found := m.items[key]
+
+	if !found {
+		return nil, false
+	}
+
+	entry, _ := elem.Value.(*memoryEntry)
+
+	if entry.expired(time.Now()) {
+		m.removeElement(elem)
+		return nil, false
+	}
+
+	m.lru.MoveToFront(elem)
+
+	return entry, true
+}
+
+// removeElement removes element from list and index, must be called with lock held
+func (m *MemoryStore) removeElement(elem *list.Element) {
+	entry, _ := m.lru.Remove(elem).(*memoryEntry)
+	delete(m.items, entry.key)
+}
+
+// sweep removes all expired keys
+func (m *MemoryStore) sweep() {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for elem := m.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		entry, _ := elem.Value.(*memoryEntry)
+
+		if entry.expired(now) {
+			m.removeElement(elem)
+		}
+
+		elem = prev
+	}
+}
+
+// sweeper periodically removes expired keys until store is closed
+func (m *MemoryStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.sweep()
+		case <-m.done:
+			return
+		}
+	}
+}
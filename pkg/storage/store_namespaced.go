@@ -0,0 +1,110 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+)
+
+var (
+	_ Storage        = (*NamespacedStore)(nil)
+	_ ContextStorage = (*NamespacedStore)(nil)
+)
+
+// NamespacedStore prefixes all keys, so multiple deployments can share one store,
+// and optionally envelope encrypts all values with a dedicated store key
+type NamespacedStore struct {
+	Store  Storage
+	Prefix string
+	Key    string
+}
+
+// NewNamespacedStore wraps the store, empty key disables the encryption of values
+func NewNamespacedStore(store Storage, prefix string, key string) *NamespacedStore {
+	return &NamespacedStore{
+		Store:  store,
+		Prefix: prefix,
+		Key:    key,
+	}
+}
+
+// WithContext returns the namespaced store with calls of the underlying store bound to the context
+func (n *NamespacedStore) WithContext(ctx context.Context) Storage {
+	return &NamespacedStore{
+		Store:  WithContext(ctx, n.Store),
+		Prefix: n.Prefix,
+		Key:    n.Key,
+	}
+}
+
+// Set adds a token to the store
+func (n *NamespacedStore) Set(key, value string, expiration time.Duration) error {
+	if n.Key != "" {
+		envelope, err := encryption.EncodeEnvelope(value, n.Key)
+
+		if err != nil {
+			return err
+		}
+
+		value = envelope
+	}
+
+	return n.Store.Set(n.Prefix+key, value, expiration)
+}
+
+// SetNX adds a token to the store only if the key doesn't exist yet
+func (n *NamespacedStore) SetNX(key, value string, expiration time.Duration) (bool, error) {
+	if n.Key != "" {
+		envelope, err := encryption.EncodeEnvelope(value, n.Key)
+
+		if err != nil {
+			return false, err
+		}
+
+		value = envelope
+	}
+
+	return n.Store.SetNX(n.Prefix+key, value, expiration)
+}
+
+// Checks if key exists in store
+func (n *NamespacedStore) Exists(key string) (bool, error) {
+	return n.Store.Exists(n.Prefix + key)
+}
+
+// Get retrieves a token from the store, missing key returns empty value
+func (n *NamespacedStore) Get(key string) (string, error) {
+	value, err := n.Store.Get(n.Prefix + key)
+
+	if err != nil || value == "" || n.Key == "" {
+		return value, err
+	}
+
+	return encryption.DecodeEnvelope(value, n.Key)
+}
+
+// Delete remove the key
+func (n *NamespacedStore) Delete(key string) error {
+	return n.Store.Delete(n.Prefix + key)
+}
+
+// Close closes the underlying store
+func (n *NamespacedStore) Close() error {
+	return n.Store.Close()
+}
@@ -16,38 +16,253 @@ limitations under the License.
 package storage
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	redis "gopkg.in/redis.v4"
 )
 
+// redisDefaultDialTimeout is used by tls dialer when dial-timeout is not set
+const redisDefaultDialTimeout = 5 * time.Second
+
 var _ Storage = (*RedisStore)(nil)
 
+// RedisClient is the subset of commands shared by single node, sentinel
+// and cluster redis clients
+type RedisClient interface {
+	redis.Cmdable
+	Close() error
+}
+
 type RedisStore struct {
-	Client *redis.Client
+	Client RedisClient
+}
+
+// redisOptions are the connection options parsed from the store url
+type redisOptions struct {
+	Addrs              []string
+	MasterName         string
+	Password           string
+	DB                 int
+	TLS                bool
+	InsecureSkipVerify bool
+	MaxRetries         int
+	PoolSize           int
+	DialTimeout        time.Duration
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
+	PoolTimeout        time.Duration
+	IdleTimeout        time.Duration
 }
 
-// newRedisStore creates a new redis store
+// newRedisStore creates a new redis store, supported urls are:
+// redis://[:PASSWORD@]HOST:PORT[/DB]
+// rediss://[:PASSWORD@]HOST:PORT[/DB]
+// redis-sentinel://[:PASSWORD@]HOST:PORT[,HOST:PORT]/MASTER[/DB]
+// redis-cluster://[:PASSWORD@]HOST:PORT[,HOST:PORT]
+// connection options are taken from the url query, e.g. ?pool-size=10&read-timeout=3s
 func newRedisStore(location *url.URL) (Storage, error) {
-	// step: get any password
-	password := ""
-	if location.User != nil {
-		password, _ = location.User.Password()
+	opts, err := parseRedisOptions(location)
+
+	if err != nil {
+		return nil, err
 	}
 
-	// step: parse the url notation
-	client := redis.NewClient(&redis.Options{
-		Addr:     location.Host,
-		DB:       0,
-		Password: password,
-	})
+	var client RedisClient
+
+	switch location.Scheme {
+	case "redis-sentinel":
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    opts.MasterName,
+			SentinelAddrs: opts.Addrs,
+			Password:      opts.Password,
+			DB:            opts.DB,
+			MaxRetries:    opts.MaxRetries,
+			DialTimeout:   opts.DialTimeout,
+			ReadTimeout:   opts.ReadTimeout,
+			WriteTimeout:  opts.WriteTimeout,
+			PoolSize:      opts.PoolSize,
+			PoolTimeout:   opts.PoolTimeout,
+			IdleTimeout:   opts.IdleTimeout,
+		})
+	case "redis-cluster":
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        opts.Addrs,
+			Password:     opts.Password,
+			DialTimeout:  opts.DialTimeout,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+			PoolSize:     opts.PoolSize,
+			PoolTimeout:  opts.PoolTimeout,
+			IdleTimeout:  opts.IdleTimeout,
+		})
+	default:
+		options := &redis.Options{
+			Addr:         opts.Addrs[0],
+			DB:           opts.DB,
+			Password:     opts.Password,
+			MaxRetries:   opts.MaxRetries,
+			DialTimeout:  opts.DialTimeout,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+			PoolSize:     opts.PoolSize,
+			PoolTimeout:  opts.PoolTimeout,
+			IdleTimeout:  opts.IdleTimeout,
+		}
+
+		if opts.TLS {
+			options.Dialer = newRedisTLSDialer(opts)
+		}
+
+		client = redis.NewClient(options)
+	}
 
 	return RedisStore{
 		Client: client,
 	}, nil
 }
 
+// parseRedisOptions extracts the connection options from the store url
+//
+//nolint:cyclop
+func parseRedisOptions(location *url.URL) (*redisOptions, error) {
+	opts := &redisOptions{
+		TLS: location.Scheme == "rediss",
+	}
+
+	// step: get any password
+	if location.User != nil {
+		opts.Password, _ = location.User.Password()
+	}
+
+	for _, addr := range strings.Split(location.Host, ",") {
+		if addr != "" {
+			opts.Addrs = append(opts.Addrs, addr)
+		}
+	}
+
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("redis store requires at least one address: %s", location.Redacted())
+	}
+
+	segments := strings.FieldsFunc(location.Path, func(r rune) bool { return r == '/' })
+
+	switch location.Scheme {
+	case "redis-sentinel":
+		if len(segments) == 0 {
+			return nil, fmt.Errorf("redis sentinel store requires a master name, e.g. redis-sentinel://127.0.0.1:26379/mymaster")
+		}
+
+		opts.MasterName = segments[0]
+		segments = segments[1:]
+	case "redis-cluster":
+		if len(segments) > 0 {
+			return nil, fmt.Errorf("redis cluster store does not support database selection")
+		}
+	default:
+		if len(opts.Addrs) > 1 {
+			return nil, fmt.Errorf("redis store supports single address, use redis-sentinel:// or redis-cluster://")
+		}
+	}
+
+	if len(segments) > 1 {
+		return nil, fmt.Errorf("invalid redis store path: %s", location.Path)
+	}
+
+	if len(segments) == 1 {
+		db, err := strconv.Atoi(segments[0])
+
+		if err != nil || db < 0 {
+			return nil, fmt.Errorf("invalid redis store database: %s", segments[0])
+		}
+
+		opts.DB = db
+	}
+
+	query := location.Query()
+
+	ints := map[string]*int{
+		"max-retries": &opts.MaxRetries,
+		"pool-size":   &opts.PoolSize,
+	}
+
+	for name, target := range ints {
+		if val := query.Get(name); val != "" {
+			num, err := strconv.Atoi(val)
+
+			if err != nil || num < 0 {
+				return nil, fmt.Errorf("invalid redis store %s: %s", name, val)
+			}
+
+			*target = num
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"dial-timeout":  &opts.DialTimeout,
+		"read-timeout":  &opts.ReadTimeout,
+		"write-timeout": &opts.WriteTimeout,
+		"pool-timeout":  &opts.PoolTimeout,
+		"idle-timeout":  &opts.IdleTimeout,
+	}
+
+	for name, target := range durations {
+		if val := query.Get(name); val != "" {
+			duration, err := time.ParseDuration(val)
+
+			if err != nil || duration < 0 {
+				return nil, fmt.Errorf("invalid redis store %s: %s", name, val)
+			}
+
+			*target = duration
+		}
+	}
+
+	if val := query.Get("skip-verify"); val != "" {
+		skip, err := strconv.ParseBool(val)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis store skip-verify: %s", val)
+		}
+
+		opts.InsecureSkipVerify = skip
+	}
+
+	return opts, nil
+}
+
+// newRedisTLSDialer returns dialer establishing tls connection to the redis node
+func newRedisTLSDialer(opts *redisOptions) func() (net.Conn, error) {
+	host, _, err := net.SplitHostPort(opts.Addrs[0])
+
+	if err != nil {
+		host = opts.Addrs[0]
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+		//nolint:gosec
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	dialTimeout := opts.DialTimeout
+
+	if dialTimeout == 0 {
+		dialTimeout = redisDefaultDialTimeout
+	}
+
+	return func() (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: dialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", opts.Addrs[0], tlsConfig)
+	}
+}
+
 // Set adds a token to the store
 func (r RedisStore) Set(key, value string, expiration time.Duration) error {
 	if err := r.Client.Set(key, value, expiration); err.Err() != nil {
@@ -57,6 +272,11 @@ func (r RedisStore) Set(key, value string, expiration time.Duration) error {
 	return nil
 }
 
+// SetNX adds a token to the store only if the key doesn't exist yet
+func (r RedisStore) SetNX(key, value string, expiration time.Duration) (bool, error) {
+	return r.Client.SetNX(key, value, expiration).Result()
+}
+
 // Checks if key exists in store
 func (r RedisStore) Exists(key string) (bool, error) {
 	result := r.Client.Exists(key)
@@ -67,9 +287,13 @@ func (r RedisStore) Exists(key string) (bool, error) {
 	return result.Val(), nil
 }
 
-// Get retrieves a token from the store
+// Get retrieves a token from the store, missing key returns empty value
 func (r RedisStore) Get(key string) (string, error) {
 	result := r.Client.Get(key)
+	if result.Err() == redis.Nil {
+		return "", nil
+	}
+
 	if result.Err() != nil {
 		return "", result.Err()
 	}
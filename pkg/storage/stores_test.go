@@ -19,9 +19,23 @@ limitations under the License.
 package storage
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"net/url"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestCreateStorageRedis(t *testing.T) {
@@ -30,8 +44,511 @@ func TestCreateStorageRedis(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestCreateStorageRedisVariants(t *testing.T) {
+	testCases := []string{
+		"redis://127.0.0.1:6379/2?pool-size=20&dial-timeout=1s&read-timeout=2s&write-timeout=2s",
+		"rediss://:secret@127.0.0.1:6380/1?skip-verify=true",
+		"redis-sentinel://127.0.0.1:26379,127.0.0.2:26379/mymaster/3",
+		"redis-cluster://127.0.0.1:7000,127.0.0.2:7000?pool-timeout=4s&idle-timeout=5m",
+	}
+
+	for _, location := range testCases {
+		store, err := CreateStorage(location)
+		assert.NoError(t, err, location)
+		assert.NotNil(t, store, location)
+		assert.NoError(t, store.Close(), location)
+	}
+}
+
+func TestCreateStorageRedisBadOptions(t *testing.T) {
+	testCases := []string{
+		"redis://",
+		"redis://127.0.0.1:6379,127.0.0.2:6379",
+		"redis://127.0.0.1:6379/abc",
+		"redis://127.0.0.1:6379/-1",
+		"redis://127.0.0.1:6379/1/2",
+		"redis://127.0.0.1:6379?pool-size=abc",
+		"redis://127.0.0.1:6379?max-retries=-1",
+		"redis://127.0.0.1:6379?read-timeout=abc",
+		"rediss://127.0.0.1:6379?skip-verify=abc",
+		"redis-sentinel://127.0.0.1:26379",
+		"redis-sentinel://127.0.0.1:26379/mymaster/abc",
+		"redis-cluster://127.0.0.1:7000/1",
+	}
+
+	for _, location := range testCases {
+		store, err := CreateStorage(location)
+		assert.Error(t, err, location)
+		assert.Nil(t, store, location)
+	}
+}
+
+func TestParseRedisOptions(t *testing.T) {
+	location, err := url.Parse(
+		"redis-sentinel://:secret@127.0.0.1:26379,127.0.0.2:26379/mymaster/3" +
+			"?max-retries=2&pool-size=20&dial-timeout=1s&read-timeout=2s&write-timeout=3s",
+	)
+	assert.NoError(t, err)
+
+	opts, err := parseRedisOptions(location)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:26379", "127.0.0.2:26379"}, opts.Addrs)
+	assert.Equal(t, "mymaster", opts.MasterName)
+	assert.Equal(t, "secret", opts.Password)
+	assert.Equal(t, 3, opts.DB)
+	assert.Equal(t, 2, opts.MaxRetries)
+	assert.Equal(t, 20, opts.PoolSize)
+	assert.Equal(t, time.Second, opts.DialTimeout)
+	assert.Equal(t, 2*time.Second, opts.ReadTimeout)
+	assert.Equal(t, 3*time.Second, opts.WriteTimeout)
+	assert.False(t, opts.TLS)
+}
+
+func TestRedisStoreDatabaseSelection(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer server.Close()
+
+	store, err := CreateStorage(fmt.Sprintf("redis://%s/2", server.Addr()))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	assert.NoError(t, store.Set("key", "value", 0))
+
+	value, err := server.DB(2).Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	assert.False(t, server.DB(0).Exists("key"))
+}
+
+func TestRedisStoreGetMissingKey(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer server.Close()
+
+	store, err := CreateStorage(fmt.Sprintf("redis://%s", server.Addr()))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	value, err := store.Get("missing")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+
+	assert.NoError(t, store.Set("key", "value", 0))
+	assert.NoError(t, store.Delete("key"))
+
+	value, err = store.Get("key")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+}
+
+func TestRedisStoreTLS(t *testing.T) {
+	server, err := miniredis.RunTLS(newTestTLSConfig(t))
+	assert.NoError(t, err)
+	defer server.Close()
+
+	store, err := CreateStorage(fmt.Sprintf("rediss://%s?skip-verify=true", server.Addr()))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	assert.NoError(t, store.Set("key", "value", 0))
+
+	value, err := store.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	plain, err := CreateStorage(fmt.Sprintf("redis://%s?dial-timeout=1s&read-timeout=1s", server.Addr()))
+	assert.NoError(t, err)
+	defer plain.Close()
+
+	_, err = plain.Get("key")
+	assert.Error(t, err)
+}
+
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		Certificates: []tls.Certificate{
+			{Certificate: [][]byte{der}, PrivateKey: key},
+		},
+	}
+}
+
 func TestCreateStorageFail(t *testing.T) {
 	store, err := CreateStorage("not_there:///tmp/bolt")
 	assert.Nil(t, store)
 	assert.Error(t, err)
 }
+
+func TestCreateStorageMemory(t *testing.T) {
+	store, err := CreateStorage("memory://?max-size=10&sweep-interval=1s")
+	assert.NotNil(t, store)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+}
+
+func TestCreateStorageMemoryBadOptions(t *testing.T) {
+	testCases := []string{
+		"memory://?max-size=abc",
+		"memory://?max-size=-1",
+		"memory://?sweep-interval=abc",
+		"memory://?sweep-interval=0s",
+	}
+
+	for _, location := range testCases {
+		store, err := CreateStorage(location)
+		assert.Nil(t, store, "case %s", location)
+		assert.Error(t, err, "case %s", location)
+	}
+}
+
+func TestMemoryStoreSetGet(t *testing.T) {
+	store := NewMemoryStore(10, time.Minute)
+	defer store.Close()
+
+	assert.NoError(t, store.Set("key", "value", 0))
+
+	exists, err := store.Exists("key")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	value, err := store.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	assert.NoError(t, store.Set("key", "other", 0))
+	value, err = store.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "other", value)
+
+	assert.NoError(t, store.Delete("key"))
+	exists, err = store.Exists("key")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	value, err = store.Get("key")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+}
+
+func TestMemoryStoreExpiration(t *testing.T) {
+	store := NewMemoryStore(10, time.Hour)
+	defer store.Close()
+
+	assert.NoError(t, store.Set("short", "value", 10*time.Millisecond))
+	assert.NoError(t, store.Set("long", "value", time.Hour))
+	time.Sleep(20 * time.Millisecond)
+
+	exists, err := store.Exists("short")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = store.Exists("long")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestMemoryStoreSweeper(t *testing.T) {
+	store := NewMemoryStore(10, 10*time.Millisecond)
+	defer store.Close()
+
+	assert.NoError(t, store.Set("short", "value", time.Millisecond))
+	assert.NoError(t, store.Set("long", "value", time.Hour))
+
+	assert.Eventually(
+		t,
+		func() bool { return store.Len() == 1 },
+		time.Second,
+		10*time.Millisecond,
+	)
+}
+
+func TestMemoryStoreLRUEviction(t *testing.T) {
+	store := NewMemoryStore(2, time.Minute)
+	defer store.Close()
+
+	assert.NoError(t, store.Set("first", "1", 0))
+	assert.NoError(t, store.Set("second", "2", 0))
+
+	// touch first key, so second becomes least recently used
+	_, err := store.Get("first")
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Set("third", "3", 0))
+	assert.Equal(t, 2, store.Len())
+
+	for key, expected := range map[string]bool{"first": true, "second": false, "third": true} {
+		exists, err := store.Exists(key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, exists, "key %s", key)
+	}
+}
+
+func TestNamespacedStorePrefix(t *testing.T) {
+	backend := NewMemoryStore(10, time.Minute)
+	store := NewNamespacedStore(backend, "app1:", "")
+	defer store.Close()
+
+	assert.NoError(t, store.Set("key", "value", 0))
+
+	value, err := backend.Get("app1:key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	exists, err := backend.Exists("key")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = store.Exists("key")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// other deployment sharing the store does not see the key
+	other := NewNamespacedStore(backend, "app2:", "")
+	value, err = other.Get("key")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+
+	assert.NoError(t, store.Delete("key"))
+	assert.Equal(t, 0, backend.Len())
+}
+
+func TestNamespacedStoreEncryption(t *testing.T) {
+	key := "ZSeCYDUxIlhDrmPpa1Ldc7il384esSF2"
+	backend := NewMemoryStore(10, time.Minute)
+	store := NewNamespacedStore(backend, "", key)
+	defer store.Close()
+
+	assert.NoError(t, store.Set("key", "secret-refresh-token", 0))
+
+	raw, err := backend.Get("key")
+	assert.NoError(t, err)
+	assert.NotContains(t, raw, "secret-refresh-token")
+
+	value, err := store.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret-refresh-token", value)
+
+	value, err = store.Get("missing")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+
+	wrongKey := NewNamespacedStore(backend, "", "u3K0eKsmGl76jY1buzexwYoRRLLQrQck")
+	_, err = wrongKey.Get("key")
+	assert.Error(t, err)
+}
+
+func TestCreateStorageFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	store, err := CreateStorage("file://" + path + "?compaction-interval=1m")
+	assert.NotNil(t, store)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	store, err = CreateStorage("file://" + path + "?compaction-interval=abc")
+	assert.Nil(t, store)
+	assert.Error(t, err)
+}
+
+func TestBoltStoreSetGet(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "tokens.db"), time.Minute)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	assert.NoError(t, store.Set("key", "value", 0))
+
+	exists, err := store.Exists("key")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	value, err := store.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	assert.NoError(t, store.Delete("key"))
+
+	exists, err = store.Exists("key")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	value, err = store.Get("key")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+}
+
+func TestBoltStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	store, err := NewBoltStore(path, time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Set("key", "value", time.Hour))
+	assert.NoError(t, store.Close())
+
+	store, err = NewBoltStore(path, time.Minute)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	value, err := store.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestBoltStoreExpiration(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "tokens.db"), 10*time.Millisecond)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	assert.NoError(t, store.Set("short", "value", time.Millisecond))
+	assert.NoError(t, store.Set("long", "value", time.Hour))
+	time.Sleep(5 * time.Millisecond)
+
+	exists, err := store.Exists("short")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.Eventually(
+		t,
+		func() bool {
+			var count int
+			_ = store.Client.View(func(tx *bolt.Tx) error {
+				count = tx.Bucket(boltBucket).Stats().KeyN
+				return nil
+			})
+			return count == 1
+		},
+		time.Second,
+		10*time.Millisecond,
+	)
+}
+
+func TestBoltStoreConcurrentAccess(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "tokens.db"), time.Minute)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func(num int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", num)
+			assert.NoError(t, store.Set(key, key, time.Hour))
+			value, err := store.Get(key)
+			assert.NoError(t, err)
+			assert.Equal(t, key, value)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestBoltStoreWithContext(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "tokens.db"), time.Minute)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bound := WithContext(ctx, NewNamespacedStore(store, "prefix-", ""))
+
+	assert.NoError(t, bound.Set("key", "value", 0))
+
+	value, err := store.Get("prefix-key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	// step: calls of the cancelled context are not applied
+	cancel()
+	assert.ErrorIs(t, bound.Set("other", "value", 0), context.Canceled)
+	assert.ErrorIs(t, bound.Delete("key"), context.Canceled)
+
+	_, err = bound.Get("key")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	exists, err := store.Exists("prefix-key")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = store.Exists("prefix-other")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestStoreSetNX(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer server.Close()
+
+	redisStore, err := CreateStorage("redis://" + server.Addr())
+	assert.NoError(t, err)
+
+	boltStore, err := NewBoltStore(filepath.Join(t.TempDir(), "tokens.db"), time.Minute)
+	assert.NoError(t, err)
+
+	testCases := map[string]Storage{
+		"Memory":     NewMemoryStore(10, time.Minute),
+		"Bolt":       boltStore,
+		"Redis":      redisStore,
+		"Namespaced": NewNamespacedStore(NewMemoryStore(10, time.Minute), "ns:", "sdkjfhsdkjfhsdkjfhsdkjfhsdkjfhsd"),
+	}
+
+	for name, store := range testCases {
+		added, err := store.SetNX("key", "first", time.Hour)
+		assert.NoError(t, err, name)
+		assert.True(t, added, name)
+
+		added, err = store.SetNX("key", "second", time.Hour)
+		assert.NoError(t, err, name)
+		assert.False(t, added, name)
+
+		value, err := store.Get("key")
+		assert.NoError(t, err, name)
+		assert.Equal(t, "first", value, name)
+
+		assert.NoError(t, store.Delete("key"), name)
+
+		added, err = store.SetNX("key", "third", time.Hour)
+		assert.NoError(t, err, name)
+		assert.True(t, added, name)
+		assert.NoError(t, store.Close(), name)
+	}
+}
+
+func TestStoreSetNXExpired(t *testing.T) {
+	boltStore, err := NewBoltStore(filepath.Join(t.TempDir(), "tokens.db"), time.Minute)
+	assert.NoError(t, err)
+
+	testCases := map[string]Storage{
+		"Memory": NewMemoryStore(10, time.Minute),
+		"Bolt":   boltStore,
+	}
+
+	for name, store := range testCases {
+		assert.NoError(t, store.Set("key", "stale", time.Millisecond), name)
+		time.Sleep(5 * time.Millisecond)
+
+		added, err := store.SetNX("key", "fresh", time.Hour)
+		assert.NoError(t, err, name)
+		assert.True(t, added, name)
+
+		value, err := store.Get("key")
+		assert.NoError(t, err, name)
+		assert.Equal(t, "fresh", value, name)
+		assert.NoError(t, store.Close(), name)
+	}
+}
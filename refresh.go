@@ -0,0 +1,443 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/gogatekeeper/gatekeeper/pkg/storage"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// refreshLockKeyPrefix is the prefix of store keys locking the refresh of the refresh token
+	refreshLockKeyPrefix = "refresh-lock:"
+	// refreshResultKeyPrefix is the prefix of store keys holding the tokens of the finished refresh
+	refreshResultKeyPrefix = "refresh-result:"
+	// proactiveRefreshKeyPrefix is the prefix of keys holding the tokens of the proactive refresh
+	proactiveRefreshKeyPrefix = "refresh-proactive:"
+	// refreshResultTTL is how long the tokens of the finished refresh are handed to late requests
+	refreshResultTTL = 10 * time.Second
+	// refreshPollInterval is how often the replica waiting for the lock checks the store
+	refreshPollInterval = 50 * time.Millisecond
+)
+
+var errRefreshLockTimeout = errors.New("timed out waiting for the token refresh of another instance")
+
+// refreshedTokens are the tokens issued by the provider on refresh
+type refreshedTokens struct {
+	AccessToken      string        `json:"access_token"`
+	RefreshToken     string        `json:"refresh_token,omitempty"`
+	AccessExpiresAt  time.Time     `json:"access_expires_at"`
+	RefreshExpiresIn time.Duration `json:"refresh_expires_in"`
+}
+
+// refreshTokens refreshes the tokens, concurrent refreshes of the same refresh token are
+// collapsed into single provider call within the process, and through short lived lock in
+// the store across the instances, every request gets the tokens of the winning refresh, the
+// tokens are refreshed at the issuer of the session
+func (r *oauthProxy) refreshTokens(issuer *trustedIssuer, refreshToken string) (*refreshedTokens, error) {
+	hash := utils.GetHashKey(refreshToken)
+
+	// step: the refresh token may have been used by the proactive refresh already
+	if r.proactiveRefreshes != nil {
+		tokens, err := r.getRefreshResult(r.proactiveRefreshes, proactiveRefreshKeyPrefix+hash)
+
+		if err != nil {
+			r.log.Warn("failed to retrieve the tokens of the proactive refresh", zap.Error(err))
+		} else if tokens != nil {
+			return tokens, nil
+		}
+	}
+
+	result, err, shared := r.refreshGroup.Do(hash, func() (interface{}, error) {
+		if r.useStoreForRefreshTokens() {
+			return r.refreshTokensWithLock(issuer, hash, refreshToken)
+		}
+
+		return r.requestRefreshedTokens(issuer, refreshToken)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if shared {
+		r.log.Debug("token refresh shared by concurrent requests")
+	}
+
+	return result.(*refreshedTokens), nil
+}
+
+// refreshTokensWithLock refreshes the tokens holding the store lock, the instances not
+// holding the lock wait for the tokens of the winner
+func (r *oauthProxy) refreshTokensWithLock(
+	issuer *trustedIssuer,
+	hash string,
+	refreshToken string,
+) (*refreshedTokens, error) {
+	lockKey := refreshLockKeyPrefix + hash
+	resultKey := refreshResultKeyPrefix + hash
+	deadline := time.Now().Add(r.config.OpenIDProviderTimeout)
+
+	for {
+		tokens, err := r.getRefreshResult(r.store, resultKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if tokens != nil {
+			return tokens, nil
+		}
+
+		// the lock expires by itself when the instance holding it dies
+		acquired, err := r.store.SetNX(lockKey, "true", r.config.OpenIDProviderTimeout)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if acquired {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errRefreshLockTimeout
+		}
+
+		time.Sleep(refreshPollInterval)
+	}
+
+	defer func() {
+		if err := r.store.Delete(lockKey); err != nil {
+			r.log.Warn("failed to release the token refresh lock", zap.Error(err))
+		}
+	}()
+
+	// step: the winner may have shared the tokens and released the lock since the last check,
+	// the refresh token is already used then
+	tokens, err := r.getRefreshResult(r.store, resultKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tokens != nil {
+		return tokens, nil
+	}
+
+	tokens, err = r.requestRefreshedTokens(issuer, refreshToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.setRefreshResult(r.store, resultKey, tokens, refreshResultTTL); err != nil {
+		r.log.Warn("failed to share the refreshed tokens", zap.Error(err))
+	}
+
+	return tokens, nil
+}
+
+// requestRefreshedTokens refreshes the tokens at the provider of the issuer
+func (r *oauthProxy) requestRefreshedTokens(issuer *trustedIssuer, refreshToken string) (*refreshedTokens, error) {
+	conf := r.newOAuth2Config(issuer, r.config.RedirectionURL)
+
+	_, accessToken, newRefreshToken, accessExpiresAt, refreshExpiresIn, err := getRefreshedToken(conf, r.config, refreshToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &refreshedTokens{
+		AccessToken:      accessToken,
+		RefreshToken:     newRefreshToken,
+		AccessExpiresAt:  accessExpiresAt,
+		RefreshExpiresIn: refreshExpiresIn,
+	}, nil
+}
+
+// getRefreshResult retrieves the tokens of the finished refresh, nil when there is none
+func (r *oauthProxy) getRefreshResult(store storage.Storage, key string) (*refreshedTokens, error) {
+	encrypted, err := store.Get(key)
+
+	if err != nil || encrypted == "" {
+		return nil, err
+	}
+
+	content, err := encryption.DecodeText(encrypted, r.config.EncryptionKey)
+
+	if err != nil {
+		return nil, apperrors.ErrDecryption
+	}
+
+	tokens := &refreshedTokens{}
+
+	if err := json.Unmarshal([]byte(content), tokens); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// setRefreshResult keeps the encrypted tokens of the finished refresh for the waiting requests
+func (r *oauthProxy) setRefreshResult(store storage.Storage, key string, tokens *refreshedTokens, expiration time.Duration) error {
+	content, err := json.Marshal(tokens)
+
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := encryption.EncodeText(string(content), r.config.EncryptionKey)
+
+	if err != nil {
+		return err
+	}
+
+	return store.Set(key, encrypted, expiration)
+}
+
+// injectRefreshedTokens replaces the tokens of the session with the refreshed ones, either in
+// the server side session or in the cookies, the renewed refresh token is kept in the store
+// when in use
+func (r *oauthProxy) injectRefreshedTokens(
+	req *http.Request,
+	wrt http.ResponseWriter,
+	logger *zap.Logger,
+	user *userContext,
+	refresh string,
+	tokens *refreshedTokens,
+) error {
+	clientIP := utils.RealIP(req)
+
+	newRawAccToken := tokens.AccessToken
+	newRefreshToken := tokens.RefreshToken
+	accessExpiresAt := tokens.AccessExpiresAt
+	refreshExpiresIn := tokens.RefreshExpiresIn
+
+	logger.Debug(
+		"info about tokens after refreshing",
+		zap.String("new access token", newRawAccToken),
+		zap.String("new refresh token", newRefreshToken),
+		zap.String("email", user.email),
+		zap.String("sub", user.id),
+	)
+
+	accessExpiresIn := time.Until(accessExpiresAt)
+
+	// get the expiration of the new refresh token
+	if newRefreshToken != "" {
+		refresh = newRefreshToken
+	}
+
+	if refreshExpiresIn == 0 {
+		// refresh token expiry claims not available: try to parse refresh token
+		refreshExpiresIn = r.getAccessCookieExpiration(refresh)
+	}
+
+	logger.Info(
+		"injecting the refreshed access token cookie",
+		zap.String("client_ip", clientIP),
+		zap.String("remote_addr", req.RemoteAddr),
+		zap.String("cookie_name", r.config.CookieAccessName),
+		zap.String("email", user.email),
+		zap.String("sub", user.id),
+		zap.Duration("refresh_expires_in", refreshExpiresIn),
+		zap.Duration("expires_in", accessExpiresIn),
+	)
+
+	if user.sessionID != "" {
+		// step: the session keeps its id, only the tokens in the store are replaced
+		err := r.refreshServerSession(user.sessionID, newRawAccToken, newRefreshToken, refreshExpiresIn)
+
+		if err != nil {
+			logger.Error(
+				"failed to update the server session",
+				zap.Error(err),
+				zap.String("email", user.email),
+				zap.String("sub", user.id),
+			)
+
+			return err
+		}
+
+		if err := r.addSessionToIndex(user.id, user.sessionState, sessionKindServer, getSessionKey(user.sessionID), refreshExpiresIn); err != nil {
+			logger.Warn("failed to update the session in subject index", zap.Error(err))
+		}
+
+		r.dropSessionCookie(req, wrt, user.sessionID, refreshExpiresIn)
+	} else {
+		accessToken := newRawAccToken
+
+		if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie {
+			var err error
+
+			if accessToken, err = encryption.EncodeText(accessToken, r.config.EncryptionKey); err != nil {
+				logger.Error(
+					"unable to encode the access token", zap.Error(err),
+					zap.String("email", user.email),
+					zap.String("sub", user.id),
+				)
+
+				return err
+			}
+		}
+
+		// step: inject the refreshed access token
+		r.dropAccessTokenCookie(req, wrt, accessToken, accessExpiresIn)
+
+		// step: inject the renewed refresh token
+		if newRefreshToken != "" {
+			logger.Debug(
+				"renew refresh cookie with new refresh token",
+				zap.Duration("refresh_expires_in", refreshExpiresIn),
+				zap.String("email", user.email),
+				zap.String("sub", user.id),
+			)
+
+			encryptedRefreshToken, err := encryption.EncodeText(newRefreshToken, r.config.EncryptionKey)
+
+			if err != nil {
+				logger.Error(
+					"failed to encrypt the refresh token",
+					zap.Error(err),
+					zap.String("email", user.email),
+					zap.String("sub", user.id),
+				)
+
+				return err
+			}
+
+			if r.useStoreForRefreshTokens() {
+				go func(subject, sid, old, newToken string, encrypted string) {
+					if err := r.DeleteRefreshToken(old); err != nil {
+						logger.Error("failed to remove old token", zap.Error(err))
+					}
+
+					if err := r.removeSessionFromIndex(subject, utils.GetHashKey(old)); err != nil {
+						logger.Warn("failed to remove old token from subject index", zap.Error(err))
+					}
+
+					if err := r.StoreRefreshToken(newToken, encrypted, refreshExpiresIn); err != nil {
+						logger.Error("failed to store refresh token", zap.Error(err))
+						return
+					}
+
+					if err := r.addSessionToIndex(subject, sid, sessionKindRefresh, utils.GetHashKey(newToken), refreshExpiresIn); err != nil {
+						logger.Warn("failed to add refresh token to subject index", zap.Error(err))
+					}
+				}(user.id, user.sessionState, user.rawToken, newRawAccToken, encryptedRefreshToken)
+			} else {
+				r.dropRefreshTokenCookie(req, wrt, encryptedRefreshToken, refreshExpiresIn)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isRefreshDue checks if the still valid access token of the session has passed the
+// proactive refresh percentage of its lifetime
+func (r *oauthProxy) isRefreshDue(user *userContext, now time.Time) bool {
+	if !r.config.EnableRefreshTokens || r.config.ProactiveRefreshPercent <= 0 {
+		return false
+	}
+
+	// bearer tokens can't be replaced through the response cookies
+	if user.bearerToken || user.issuedAt.IsZero() || !user.expiresAt.After(user.issuedAt) {
+		return false
+	}
+
+	lifetime := user.expiresAt.Sub(user.issuedAt)
+	refreshAt := user.issuedAt.Add(lifetime * time.Duration(r.config.ProactiveRefreshPercent) / 100)
+
+	return now.After(refreshAt)
+}
+
+// refreshInBackground refreshes the still valid tokens of the session without holding up
+// the response, which keeps the current cookies. The tokens of the finished refresh are kept
+// until the new refresh token expires and the next request of the session picks them up,
+// as the refresh token used by the refresh may no longer be accepted by the provider
+func (r *oauthProxy) refreshInBackground(
+	req *http.Request,
+	wrt http.ResponseWriter,
+	logger *zap.Logger,
+	user *userContext,
+) {
+	refresh, _, err := r.retrieveRefreshToken(req, user)
+
+	if err != nil {
+		logger.Debug(
+			"unable to find a refresh token for proactive refresh",
+			zap.Error(err),
+			zap.String("sub", user.id),
+		)
+		return
+	}
+
+	key := proactiveRefreshKeyPrefix + utils.GetHashKey(refresh)
+	tokens, err := r.getRefreshResult(r.proactiveRefreshes, key)
+
+	if err != nil {
+		logger.Warn("failed to retrieve the tokens of the proactive refresh", zap.Error(err))
+	}
+
+	if tokens != nil {
+		// failures are logged and the response keeps the current tokens
+		_ = r.injectRefreshedTokens(req, wrt, logger, user, refresh, tokens)
+		return
+	}
+
+	go func() {
+		// the tokens are kept before the concurrent requests of the session are released
+		_, err, _ := r.refreshGroup.Do(key, func() (interface{}, error) {
+			tokens, err := r.refreshTokens(user.issuer, refresh)
+
+			if err != nil {
+				return nil, err
+			}
+
+			expiration := tokens.RefreshExpiresIn
+
+			if expiration == 0 {
+				expiration = r.getAccessCookieExpiration(utils.DefaultTo(tokens.RefreshToken, refresh))
+			}
+
+			if err := r.setRefreshResult(r.proactiveRefreshes, key, tokens, expiration); err != nil {
+				logger.Error("failed to keep the tokens of the proactive refresh", zap.Error(err))
+			}
+
+			return tokens, nil
+		})
+
+		if err != nil {
+			// the access token is still valid, the refresh is retried on next request
+			logger.Warn(
+				"proactive refresh of the access token failed",
+				zap.Error(err),
+				zap.String("email", user.email),
+				zap.String("sub", user.id),
+			)
+		}
+	}()
+}
@@ -0,0 +1,413 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/gogatekeeper/gatekeeper/pkg/storage"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeRefreshConfig() *Config {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testEncryptionKey
+
+	return cfg
+}
+
+func newTestRefreshToken(t *testing.T, proxy *fakeProxy) string {
+	token := newTestToken(proxy.idp.getLocation())
+	token.setExpiration(time.Now().Add(time.Hour))
+	refresh, err := token.getToken()
+	assert.NoError(t, err)
+
+	return refresh
+}
+
+func runConcurrentRefreshes(t *testing.T, proxy *fakeProxy, refresh string, count int) []*refreshedTokens {
+	results := make([]*refreshedTokens, count)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+
+		go func(num int) {
+			defer wg.Done()
+			tokens, err := proxy.proxy.refreshTokens(nil, refresh)
+			assert.NoError(t, err)
+			results[num] = tokens
+		}(i)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+func TestRefreshTokensConcurrentInProcess(t *testing.T) {
+	proxy := newFakeProxy(newFakeRefreshConfig(), &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	proxy.idp.refreshDelay = 200 * time.Millisecond
+	results := runConcurrentRefreshes(t, proxy, newTestRefreshToken(t, proxy), 20)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxy.idp.refreshRequests))
+
+	for _, tokens := range results {
+		assert.NotNil(t, tokens)
+		assert.Equal(t, results[0].AccessToken, tokens.AccessToken)
+	}
+}
+
+func TestRefreshTokensConcurrentWithStore(t *testing.T) {
+	cfg := newFakeRefreshConfig()
+	cfg.StoreURL = "memory://"
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	proxy.idp.refreshDelay = 200 * time.Millisecond
+	refresh := newTestRefreshToken(t, proxy)
+	hash := utils.GetHashKey(refresh)
+	results := runConcurrentRefreshes(t, proxy, refresh, 20)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxy.idp.refreshRequests))
+
+	// the lock is released and the result is kept for the late requests
+	locked, err := proxy.proxy.store.Exists(refreshLockKeyPrefix + hash)
+	assert.NoError(t, err)
+	assert.False(t, locked)
+
+	shared, err := proxy.proxy.getRefreshResult(proxy.proxy.store, refreshResultKeyPrefix+hash)
+	assert.NoError(t, err)
+	assert.Equal(t, results[0].AccessToken, shared.AccessToken)
+
+	tokens, err := proxy.proxy.refreshTokens(nil, refresh)
+	assert.NoError(t, err)
+	assert.Equal(t, results[0].AccessToken, tokens.AccessToken)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxy.idp.refreshRequests))
+}
+
+func TestRefreshTokensWaitsForOtherInstance(t *testing.T) {
+	cfg := newFakeRefreshConfig()
+	cfg.StoreURL = "memory://"
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	refresh := newTestRefreshToken(t, proxy)
+	hash := utils.GetHashKey(refresh)
+	winner := &refreshedTokens{
+		AccessToken:      "access",
+		RefreshToken:     "refresh",
+		AccessExpiresAt:  time.Now().Add(time.Hour).Truncate(time.Second),
+		RefreshExpiresIn: 2 * time.Hour,
+	}
+
+	// step: another instance holds the lock and finishes the refresh later
+	added, err := proxy.proxy.store.SetNX(refreshLockKeyPrefix+hash, "true", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		assert.NoError(t, proxy.proxy.setRefreshResult(proxy.proxy.store, refreshResultKeyPrefix+hash, winner, refreshResultTTL))
+	}()
+
+	tokens, err := proxy.proxy.refreshTokens(nil, refresh)
+	assert.NoError(t, err)
+	assert.Equal(t, winner.AccessToken, tokens.AccessToken)
+	assert.Equal(t, winner.RefreshToken, tokens.RefreshToken)
+	assert.True(t, winner.AccessExpiresAt.Equal(tokens.AccessExpiresAt))
+	assert.Equal(t, winner.RefreshExpiresIn, tokens.RefreshExpiresIn)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&proxy.idp.refreshRequests))
+}
+
+// interleavedStore runs the hook before the first SetNX, i.e. between the check of the
+// shared result and the lock of the caller
+type interleavedStore struct {
+	storage.Storage
+	beforeSetNX func()
+}
+
+func (s *interleavedStore) SetNX(key, value string, expiration time.Duration) (bool, error) {
+	if hook := s.beforeSetNX; hook != nil {
+		s.beforeSetNX = nil
+		hook()
+	}
+
+	return s.Storage.SetNX(key, value, expiration)
+}
+
+func TestRefreshTokensLockedAfterOtherInstanceFinished(t *testing.T) {
+	cfg := newFakeRefreshConfig()
+	cfg.StoreURL = "memory://"
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	refresh := newTestRefreshToken(t, proxy)
+	hash := utils.GetHashKey(refresh)
+
+	var other *refreshedTokens
+
+	// step: the other caller takes the lock, refreshes, shares the tokens and releases the
+	// lock after this caller found no result, but before it takes the lock
+	proxy.proxy.store = &interleavedStore{
+		Storage: proxy.proxy.store,
+		beforeSetNX: func() {
+			var err error
+			other, err = proxy.proxy.refreshTokensWithLock(nil, hash, refresh)
+			assert.NoError(t, err)
+		},
+	}
+
+	tokens, err := proxy.proxy.refreshTokensWithLock(nil, hash, refresh)
+	assert.NoError(t, err)
+	assert.NotNil(t, other)
+	assert.Equal(t, other.AccessToken, tokens.AccessToken)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxy.idp.refreshRequests))
+}
+
+func TestRefreshTokensLockTimeout(t *testing.T) {
+	cfg := newFakeRefreshConfig()
+	cfg.StoreURL = "memory://"
+	cfg.OpenIDProviderTimeout = 200 * time.Millisecond
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	refresh := newTestRefreshToken(t, proxy)
+
+	added, err := proxy.proxy.store.SetNX(refreshLockKeyPrefix+utils.GetHashKey(refresh), "true", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	_, err = proxy.proxy.refreshTokens(nil, refresh)
+	assert.ErrorIs(t, err, errRefreshLockTimeout)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&proxy.idp.refreshRequests))
+}
+
+func TestRefreshTokensAtSessionIssuer(t *testing.T) {
+	partner := newFakeAuthServer(&fakeAuthConfig{})
+	defer partner.Close()
+
+	cfg := newFakeRefreshConfig()
+	cfg.Issuers = []*IssuerConfig{newFakePartnerIssuer(partner)}
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	// step: the refresh tokens of some providers carry no issuer
+	token := newTestToken("")
+	token.setExpiration(time.Now().Add(time.Hour))
+	refresh, err := token.getToken()
+	assert.NoError(t, err)
+
+	tokens, err := proxy.proxy.refreshTokens(proxy.proxy.issuers[0], refresh)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, tokens.AccessToken)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&partner.refreshRequests))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&proxy.idp.refreshRequests))
+}
+
+func TestConcurrentRequestsShareRefresh(t *testing.T) {
+	proxy := newFakeProxy(newFakeRefreshConfig(), &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	proxy.idp.refreshDelay = 200 * time.Millisecond
+
+	expired := newTestToken(proxy.idp.getLocation())
+	expired.setExpiration(time.Now().Add(-time.Minute))
+	accessToken, err := expired.getToken()
+	assert.NoError(t, err)
+
+	refreshCookie, err := encryption.EncodeText(newTestRefreshToken(t, proxy), testEncryptionKey)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			req, err := http.NewRequest(http.MethodGet, proxy.getServiceURL()+"/auth_all/test", nil)
+			assert.NoError(t, err)
+			req.AddCookie(&http.Cookie{Name: proxy.config.CookieAccessName, Value: accessToken})
+			req.AddCookie(&http.Cookie{Name: proxy.config.CookieRefreshName, Value: refreshCookie})
+
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.NotNil(t, utils.FindCookie(proxy.config.CookieAccessName, resp.Cookies()))
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxy.idp.refreshRequests))
+}
+
+func newTestSessionRequest(t *testing.T, proxy *fakeProxy, issuedAt, expiresAt time.Time, refresh string) *http.Request {
+	token := newTestToken(proxy.idp.getLocation())
+	token.claims.Iat = issuedAt.Unix()
+	token.setExpiration(expiresAt)
+	accessToken, err := token.getToken()
+	assert.NoError(t, err)
+
+	refreshCookie, err := encryption.EncodeText(refresh, testEncryptionKey)
+	assert.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, proxy.getServiceURL()+"/auth_all/test", nil)
+	assert.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: proxy.config.CookieAccessName, Value: accessToken})
+	req.AddCookie(&http.Cookie{Name: proxy.config.CookieRefreshName, Value: refreshCookie})
+
+	return req
+}
+
+func TestProactiveRefresh(t *testing.T) {
+	now := time.Now()
+
+	testCases := []struct {
+		Name             string
+		IssuedAt         time.Time
+		ExpiresAt        time.Time
+		Bearer           bool
+		ExpiredRefresh   bool
+		ExpectedRefresh  bool
+		ExpectedRequests int32
+	}{
+		{
+			Name:             "TestTokenInRefreshWindow",
+			IssuedAt:         now.Add(-9 * time.Minute),
+			ExpiresAt:        now.Add(time.Minute),
+			ExpectedRefresh:  true,
+			ExpectedRequests: 1,
+		},
+		{
+			Name:      "TestTokenBeforeRefreshWindow",
+			IssuedAt:  now.Add(-time.Minute),
+			ExpiresAt: now.Add(9 * time.Minute),
+		},
+		{
+			Name:      "TestBearerTokenInRefreshWindow",
+			IssuedAt:  now.Add(-9 * time.Minute),
+			ExpiresAt: now.Add(time.Minute),
+			Bearer:    true,
+		},
+		{
+			Name:           "TestFailedRefreshKeepsValidToken",
+			IssuedAt:       now.Add(-9 * time.Minute),
+			ExpiresAt:      now.Add(time.Minute),
+			ExpiredRefresh: true,
+			// oauth2 retries the failed grant with the client credentials in the body
+			ExpectedRequests: 2,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeRefreshConfig()
+				cfg.ProactiveRefreshPercent = 80
+				proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+				defer proxy.idp.Close()
+
+				proxy.idp.refreshDelay = 100 * time.Millisecond
+
+				refreshToken := newTestToken(proxy.idp.getLocation())
+				refreshToken.setExpiration(time.Now().Add(time.Hour))
+
+				if testCase.ExpiredRefresh {
+					refreshToken.setExpiration(time.Now().Add(-time.Minute))
+				}
+
+				refresh, err := refreshToken.getToken()
+				assert.NoError(t, err)
+
+				req := newTestSessionRequest(t, proxy, testCase.IssuedAt, testCase.ExpiresAt, refresh)
+
+				if testCase.Bearer {
+					bearer, err := req.Cookie(proxy.config.CookieAccessName)
+					assert.NoError(t, err)
+					req.Header.Set("Authorization", "Bearer "+bearer.Value)
+				}
+
+				start := time.Now()
+				resp, err := http.DefaultClient.Do(req)
+				assert.NoError(t, err)
+				resp.Body.Close()
+
+				// step: the response does not wait for the provider
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Less(t, time.Since(start), proxy.idp.refreshDelay)
+				assert.Nil(t, utils.FindCookie(proxy.config.CookieAccessName, resp.Cookies()))
+				assert.Eventually(
+					t,
+					func() bool {
+						return atomic.LoadInt32(&proxy.idp.refreshRequests) == testCase.ExpectedRequests
+					},
+					5*time.Second,
+					10*time.Millisecond,
+				)
+
+				if !testCase.ExpectedRefresh {
+					return
+				}
+
+				// step: the next request of the session gets the refreshed tokens
+				next := newTestSessionRequest(t, proxy, testCase.IssuedAt, testCase.ExpiresAt, refresh)
+				assert.Eventually(
+					t,
+					func() bool {
+						resp, err := http.DefaultClient.Do(next)
+
+						if !assert.NoError(t, err) {
+							return false
+						}
+
+						resp.Body.Close()
+						cookie := utils.FindCookie(proxy.config.CookieAccessName, resp.Cookies())
+
+						if cookie == nil {
+							return false
+						}
+
+						access, err := next.Cookie(proxy.config.CookieAccessName)
+
+						return assert.NoError(t, err) && assert.NotEqual(t, access.Value, cookie.Value)
+					},
+					5*time.Second,
+					10*time.Millisecond,
+				)
+				assert.Equal(t, testCase.ExpectedRequests, atomic.LoadInt32(&proxy.idp.refreshRequests))
+			},
+		)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/storage"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var _ storage.Storage = (*resilientStore)(nil)
+
+// resilientStore wraps a store with latency and error metrics, per call timeouts
+// and a circuit breaker, which rejects calls while the backend is unhealthy
+type resilientStore struct {
+	store     storage.Storage
+	timeout   time.Duration
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// newResilientStore wraps the store, zero timeout or threshold disables the feature
+func newResilientStore(store storage.Storage, timeout time.Duration, threshold int, cooldown time.Duration) *resilientStore {
+	storeBreakerOpenMetric.Set(0)
+
+	return &resilientStore{
+		store:     store,
+		timeout:   timeout,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Set adds a token to the store
+func (s *resilientStore) Set(key, value string, expiration time.Duration) error {
+	return s.call("set", func(store storage.Storage) error {
+		return store.Set(key, value, expiration)
+	})
+}
+
+// SetNX adds a token to the store only if the key doesn't exist yet
+func (s *resilientStore) SetNX(key, value string, expiration time.Duration) (bool, error) {
+	var added bool
+
+	err := s.call("setnx", func(store storage.Storage) error {
+		var err error
+		added, err = store.SetNX(key, value, expiration)
+		return err
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return added, nil
+}
+
+// Get retrieves a token from the store
+func (s *resilientStore) Get(key string) (string, error) {
+	var value string
+
+	err := s.call("get", func(store storage.Storage) error {
+		var err error
+		value, err = store.Get(key)
+		return err
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// Exists checks if key exists in store
+func (s *resilientStore) Exists(key string) (bool, error) {
+	var exists bool
+
+	err := s.call("exists", func(store storage.Storage) error {
+		var err error
+		exists, err = store.Exists(key)
+		return err
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// Delete removes a key from the store
+func (s *resilientStore) Delete(key string) error {
+	return s.call("delete", func(store storage.Storage) error {
+		return store.Delete(key)
+	})
+}
+
+// Close closes the underlying store
+func (s *resilientStore) Close() error {
+	return s.store.Close()
+}
+
+// Available checks if calls are currently let through by the circuit breaker
+func (s *resilientStore) Available() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.state {
+	case breakerOpen:
+		return time.Since(s.openedAt) >= s.cooldown
+	case breakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// call runs the store operation with breaker, timeout and metrics applied
+func (s *resilientStore) call(action string, operation func(storage.Storage) error) error {
+	if !s.allow() {
+		storeErrorsMetric.WithLabelValues(action).Inc()
+		return apperrors.ErrStoreCircuitOpen
+	}
+
+	start := time.Now()
+	err := s.withTimeout(operation)
+	storeLatencyMetric.WithLabelValues(action).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		storeErrorsMetric.WithLabelValues(action).Inc()
+	}
+
+	s.report(err)
+
+	return err
+}
+
+// withTimeout runs the operation, giving up after the configured timeout, the store
+// passed to the operation is bound to the deadline, so the stores supporting the
+// cancellation abandon the call once we stopped waiting for it
+func (s *resilientStore) withTimeout(operation func(storage.Storage) error) error {
+	if s.timeout <= 0 {
+		return operation(s.store)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- operation(storage.WithContext(ctx, s.store))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return apperrors.ErrStoreTimeout
+	}
+}
+
+// allow checks the breaker state, after cooldown single trial call is let through
+func (s *resilientStore) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.state {
+	case breakerOpen:
+		if time.Since(s.openedAt) < s.cooldown {
+			return false
+		}
+
+		s.state = breakerHalfOpen
+
+		return true
+	case breakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// report updates the breaker state with result of the call
+func (s *resilientStore) report(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		if s.state != breakerClosed {
+			storeBreakerOpenMetric.Set(0)
+		}
+
+		s.state = breakerClosed
+		s.failures = 0
+
+		return
+	}
+
+	s.failures++
+
+	if s.state == breakerHalfOpen || (s.threshold > 0 && s.failures >= s.threshold) {
+		s.state = breakerOpen
+		s.openedAt = time.Now()
+		storeBreakerOpenMetric.Set(1)
+	}
+}
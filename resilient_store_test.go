@@ -0,0 +1,231 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var errFakeStoreDown = errors.New("store down")
+
+// fakeUnreliableStore is a memory store which can be switched to fail or hang
+type fakeUnreliableStore struct {
+	storage.Storage
+	mu    sync.Mutex
+	err   error
+	delay time.Duration
+}
+
+func newFakeUnreliableStore() *fakeUnreliableStore {
+	return &fakeUnreliableStore{Storage: storage.NewMemoryStore(100, time.Minute)}
+}
+
+func (f *fakeUnreliableStore) fail(err error, delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+	f.delay = delay
+}
+
+func (f *fakeUnreliableStore) check(ctx context.Context) error {
+	f.mu.Lock()
+	err, delay := f.err, f.delay
+	f.mu.Unlock()
+
+	select {
+	case <-time.After(delay):
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeUnreliableStore) Set(key, value string, expiration time.Duration) error {
+	return f.set(context.Background(), key, value, expiration)
+}
+
+func (f *fakeUnreliableStore) Get(key string) (string, error) {
+	return f.get(context.Background(), key)
+}
+
+func (f *fakeUnreliableStore) WithContext(ctx context.Context) storage.Storage {
+	return &fakeContextStore{fakeUnreliableStore: f, ctx: ctx}
+}
+
+func (f *fakeUnreliableStore) set(ctx context.Context, key, value string, expiration time.Duration) error {
+	if err := f.check(ctx); err != nil {
+		return err
+	}
+
+	return f.Storage.Set(key, value, expiration)
+}
+
+func (f *fakeUnreliableStore) get(ctx context.Context, key string) (string, error) {
+	if err := f.check(ctx); err != nil {
+		return "", err
+	}
+
+	return f.Storage.Get(key)
+}
+
+// fakeContextStore is the unreliable store with the hanging calls abandoned once
+// the context is done
+type fakeContextStore struct {
+	*fakeUnreliableStore
+	ctx context.Context
+}
+
+func (f *fakeContextStore) Set(key, value string, expiration time.Duration) error {
+	return f.set(f.ctx, key, value, expiration)
+}
+
+func (f *fakeContextStore) Get(key string) (string, error) {
+	return f.get(f.ctx, key)
+}
+
+func TestResilientStorePassThrough(t *testing.T) {
+	backend := newFakeUnreliableStore()
+	store := newResilientStore(backend, time.Second, 3, time.Minute)
+	defer store.Close()
+
+	assert.NoError(t, store.Set("key", "value", 0))
+
+	value, err := store.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	exists, err := store.Exists("key")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	assert.NoError(t, store.Delete("key"))
+	assert.True(t, store.Available())
+}
+
+func TestResilientStoreTimeout(t *testing.T) {
+	backend := newFakeUnreliableStore()
+	store := newResilientStore(backend, 20*time.Millisecond, 0, time.Minute)
+	defer store.Close()
+
+	backend.fail(nil, 200*time.Millisecond)
+
+	_, err := store.Get("key")
+	assert.ErrorIs(t, err, apperrors.ErrStoreTimeout)
+	// breaker is disabled, store stays available
+	assert.True(t, store.Available())
+}
+
+func TestResilientStoreTimeoutCancelsCall(t *testing.T) {
+	backend := newFakeUnreliableStore()
+	store := newResilientStore(backend, 20*time.Millisecond, 0, time.Minute)
+	defer store.Close()
+
+	backend.fail(nil, 200*time.Millisecond)
+	assert.ErrorIs(t, store.Set("key", "value", 0), apperrors.ErrStoreTimeout)
+
+	// step: the abandoned write is never applied
+	time.Sleep(250 * time.Millisecond)
+
+	value, err := backend.Storage.Get("key")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+}
+
+func TestResilientStoreCircuitBreaker(t *testing.T) {
+	backend := newFakeUnreliableStore()
+	store := newResilientStore(backend, 0, 2, 50*time.Millisecond)
+	defer store.Close()
+
+	errorsBefore := testutil.ToFloat64(storeErrorsMetric.WithLabelValues("set"))
+
+	backend.fail(errFakeStoreDown, 0)
+
+	assert.ErrorIs(t, store.Set("key", "value", 0), errFakeStoreDown)
+	assert.True(t, store.Available())
+	assert.ErrorIs(t, store.Set("key", "value", 0), errFakeStoreDown)
+	assert.False(t, store.Available())
+	assert.Equal(t, float64(1), testutil.ToFloat64(storeBreakerOpenMetric))
+
+	// while open, backend is not called at all
+	backend.fail(nil, 0)
+	assert.ErrorIs(t, store.Set("key", "value", 0), apperrors.ErrStoreCircuitOpen)
+	assert.Equal(t, errorsBefore+3, testutil.ToFloat64(storeErrorsMetric.WithLabelValues("set")))
+
+	// after cooldown single trial call closes the breaker again
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, store.Available())
+	assert.NoError(t, store.Set("key", "value", 0))
+	assert.True(t, store.Available())
+	assert.Equal(t, float64(0), testutil.ToFloat64(storeBreakerOpenMetric))
+}
+
+func TestResilientStoreHalfOpenFailure(t *testing.T) {
+	backend := newFakeUnreliableStore()
+	store := newResilientStore(backend, 0, 1, 20*time.Millisecond)
+	defer store.Close()
+
+	backend.fail(errFakeStoreDown, 0)
+	assert.Error(t, store.Set("key", "value", 0))
+	assert.False(t, store.Available())
+
+	time.Sleep(30 * time.Millisecond)
+	// failed trial opens the breaker again
+	assert.ErrorIs(t, store.Set("key", "value", 0), errFakeStoreDown)
+	assert.False(t, store.Available())
+	assert.ErrorIs(t, store.Set("key", "value", 0), apperrors.ErrStoreCircuitOpen)
+}
+
+func TestRefreshTokenCookieFallbackWhenBreakerOpen(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testEncryptionKey
+	cfg.StoreURL = "memory://"
+
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	backend := newFakeUnreliableStore()
+	store := newResilientStore(backend, 0, 1, time.Hour)
+	proxy.proxy.store = store
+
+	backend.fail(errFakeStoreDown, 0)
+	assert.Error(t, store.Set("key", "value", 0))
+	assert.False(t, proxy.proxy.useStoreForRefreshTokens())
+
+	proxy.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+				cfg.CookieRefreshName: nil,
+			},
+		},
+	})
+}
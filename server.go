@@ -56,6 +56,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
 type PAT struct {
@@ -65,6 +66,7 @@ type PAT struct {
 
 type oauthProxy struct {
 	provider       *oidc3.Provider
+	issuers        []*trustedIssuer
 	config         *Config
 	endpoint       *url.URL
 	idpClient      *gocloak.GoCloak
@@ -78,6 +80,29 @@ type oauthProxy struct {
 	templates      *template.Template
 	upstream       reverseProxy
 	pat            *PAT
+	// providerClient is the http client of the direct calls to the openid providers
+	providerClient *http.Client
+	// refreshGroup collapses concurrent refreshes of the same refresh token
+	refreshGroup singleflight.Group
+	// proactiveRefreshes holds the tokens of the proactive refreshes until the sessions pick
+	// them up, the store or in memory one
+	proactiveRefreshes storage.Storage
+	// introspectionCache holds the introspection results, the store or in memory one
+	introspectionCache storage.Storage
+	// dpopReplayCache holds the jti of the used DPoP proofs, the store or in memory one
+	dpopReplayCache storage.Storage
+	// verifiedTokens holds the identities of the verified tokens
+	verifiedTokens *verifiedTokenCache
+	// basicAuthCache holds the tokens of the basic credentials, always in memory
+	basicAuthCache storage.Storage
+	// basicAuthGroup collapses concurrent logins with the same basic credentials
+	basicAuthGroup singleflight.Group
+	// apiKeys holds the identities of the api keys in the key file
+	apiKeys *apiKeyProvider
+	// exchangeCache holds the exchanged tokens, always in memory
+	exchangeCache storage.Storage
+	// exchangeGroup collapses concurrent exchanges of the same token
+	exchangeGroup singleflight.Group
 }
 
 func init() {
@@ -88,6 +113,10 @@ func init() {
 	prometheus.MustRegister(oauthLatencyMetric)
 	prometheus.MustRegister(oauthTokensMetric)
 	prometheus.MustRegister(statusMetric)
+	prometheus.MustRegister(storeLatencyMetric)
+	prometheus.MustRegister(storeErrorsMetric)
+	prometheus.MustRegister(storeBreakerOpenMetric)
+	prometheus.MustRegister(verifiedTokenCacheMetric)
 }
 
 const allPath = "/*"
@@ -129,9 +158,92 @@ func newProxy(config *Config) (*oauthProxy, error) {
 
 	// initialize the store if any
 	if config.StoreURL != "" {
-		if svc.store, err = storage.CreateStorage(config.StoreURL); err != nil {
+		store, err := storage.CreateStorage(config.StoreURL)
+
+		if err != nil {
 			return nil, err
 		}
+
+		if config.StoreKeyPrefix != "" || config.StoreEncryptionKey != "" {
+			store = storage.NewNamespacedStore(store, config.StoreKeyPrefix, config.StoreEncryptionKey)
+		}
+
+		svc.store = newResilientStore(
+			store,
+			config.StoreTimeout,
+			config.StoreBreakerThreshold,
+			config.StoreBreakerCooldown,
+		)
+	}
+
+	// introspection results are cached in the store, or in memory without one
+	if config.EnableTokenIntrospection {
+		svc.introspectionCache = svc.store
+
+		if svc.introspectionCache == nil {
+			svc.introspectionCache = storage.NewMemoryStore(
+				storage.DefaultMemoryStoreMaxSize,
+				storage.DefaultMemoryStoreSweepInterval,
+			)
+		}
+	}
+
+	// used proofs are remembered in the store, so they are not replayed to other instance
+	if config.EnableDPoP {
+		svc.dpopReplayCache = svc.store
+
+		if svc.dpopReplayCache == nil {
+			svc.dpopReplayCache = storage.NewMemoryStore(
+				storage.DefaultMemoryStoreMaxSize,
+				storage.DefaultMemoryStoreSweepInterval,
+			)
+		}
+	}
+
+	// the next request of the session may be served by other instance
+	if config.ProactiveRefreshPercent > 0 {
+		svc.proactiveRefreshes = svc.store
+
+		if svc.proactiveRefreshes == nil {
+			svc.proactiveRefreshes = storage.NewMemoryStore(
+				storage.DefaultMemoryStoreMaxSize,
+				storage.DefaultMemoryStoreSweepInterval,
+			)
+		}
+	}
+
+	if config.VerifiedTokenCacheSize > 0 {
+		svc.verifiedTokens = newVerifiedTokenCache(config.VerifiedTokenCacheSize)
+	}
+
+	// tokens of the basic credentials are not shared through the store either
+	if config.useBasicAuth() {
+		svc.basicAuthCache = storage.NewMemoryStore(
+			storage.DefaultMemoryStoreMaxSize,
+			storage.DefaultMemoryStoreSweepInterval,
+		)
+	}
+
+	if config.EnableAPIKeys && config.APIKeysFile != "" {
+		if svc.apiKeys, err = newAPIKeyProvider(config.APIKeysFile, log); err != nil {
+			return nil, err
+		}
+
+		if err := svc.apiKeys.watch(); err != nil {
+			return nil, err
+		}
+	}
+
+	// exchanged tokens are credentials of the user, they are not shared through the store
+	if config.useTokenExchange() {
+		svc.exchangeCache = storage.NewMemoryStore(
+			storage.DefaultMemoryStoreMaxSize,
+			storage.DefaultMemoryStoreSweepInterval,
+		)
+	}
+
+	if svc.providerClient, err = svc.newProviderClient(); err != nil {
+		return nil, err
 	}
 
 	svc.log.Info(
@@ -151,6 +263,14 @@ func newProxy(config *Config) (*oauthProxy, error) {
 
 	svc.log.Info("successfully retrieved openid configuration from the discovery")
 
+	if svc.issuers, err = svc.newTrustedIssuers(); err != nil {
+		svc.log.Error(
+			"failed to get configuration of the trusted issuers",
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
 	if config.EnableUma || config.EnableForwarding {
 		patDone := make(chan bool)
 		go svc.getPAT(patDone)
@@ -308,6 +428,18 @@ func (r *oauthProxy) createReverseProxy() error {
 		adminEngine.Get(constant.MetricsURL, r.proxyMetricsHandler)
 	}
 
+	if r.config.EnableSessionsAdmin {
+		r.log.Info(
+			"enabled the sessions admin api",
+			zap.String("path", path.Clean(r.config.WithOAuthURI(constant.SessionsURL))),
+		)
+		adminEngine.With(r.adminSessionsAuthMiddleware).Route(constant.SessionsURL, func(eng chi.Router) {
+			eng.Get("/{sub}", r.sessionsListHandler)
+			eng.Delete("/{sub}", r.sessionsRevokeHandler)
+			eng.Delete("/{sub}/{id}", r.sessionsRevokeHandler)
+		})
+	}
+
 	// step: add the routing for oauth
 	engine.With(r.proxyDenyMiddleware).Route(r.config.BaseURI+r.config.OAuthURI, func(eng chi.Router) {
 		eng.MethodNotAllowed(methodNotAllowHandlder)
@@ -319,6 +451,15 @@ func (r *oauthProxy) createReverseProxy() error {
 		eng.Post(constant.LoginURL, r.loginHandler)
 		eng.Get(constant.DiscoveryURL, r.discoveryHandler)
 
+		if r.config.EnableBackchannelLogout {
+			eng.Post(constant.BackchannelLogoutURL, r.backchannelLogoutHandler)
+		}
+
+		if r.config.EnableDeviceFlow {
+			eng.Post(constant.DeviceURL, r.deviceAuthorizationHandler)
+			eng.Post(constant.DeviceTokenURL, r.deviceTokenHandler)
+		}
+
 		if r.config.ListenAdmin == "" {
 			eng.Mount("/", adminEngine)
 		}
@@ -441,6 +582,21 @@ func (r *oauthProxy) createReverseProxy() error {
 			}
 		}
 
+		// step: the basic credentials are exchanged for the token before the authentication
+		if res.BasicAuth && !res.WhiteListed {
+			middlewares = append([]func(http.Handler) http.Handler{r.basicAuthMiddleware()}, middlewares...)
+		}
+
+		// step: the token is exchanged before the identity headers, the last of the middlewares
+		if audience, scopes := r.config.getTokenExchange(res); audience != "" && !res.WhiteListed {
+			last := len(middlewares) - 1
+			middlewares = append(
+				middlewares[:last:last],
+				r.tokenExchangeMiddleware(audience, scopes),
+				middlewares[last],
+			)
+		}
+
 		e := engine.With(middlewares...)
 
 		for _, method := range res.Methods {
@@ -1086,6 +1242,32 @@ func (r *oauthProxy) newOpenIDProvider() (*oidc3.Provider, *gocloak.GoCloak, err
 	return provider, client, nil
 }
 
+// newProviderClient returns the http client of the calls to the openid providers, the
+// tls verification, proxy and timeout are the same as of the discovery
+func (r *oauthProxy) newProviderClient() (*http.Client, error) {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			//nolint:gosec
+			InsecureSkipVerify: r.config.SkipOpenIDProviderTLSVerify,
+		},
+	}
+
+	if r.config.OpenIDProviderProxy != "" {
+		proxyURL, err := url.Parse(r.config.OpenIDProviderProxy)
+
+		if err != nil {
+			return nil, err
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
+		Timeout:   r.config.OpenIDProviderTimeout,
+		Transport: transport,
+	}, nil
+}
+
 // Render implements the echo Render interface
 func (r *oauthProxy) Render(w io.Writer, name string, data interface{}) error {
 	return r.templates.ExecuteTemplate(w, name, data)
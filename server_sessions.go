@@ -0,0 +1,212 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// sessionIDSize is the number of random bytes in session identifier
+	sessionIDSize = 32
+	// sessionKeyPrefix is the prefix of store keys holding server side sessions
+	sessionKeyPrefix = "session:"
+)
+
+// serverSession holds the tokens of the user, the browser only carries the session id
+type serverSession struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// newSessionID generates a random opaque session identifier
+func newSessionID() (string, error) {
+	sessionID := make([]byte, sessionIDSize)
+
+	if _, err := io.ReadFull(rand.Reader, sessionID); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(sessionID), nil
+}
+
+// getSessionKey returns the store key of the session, only hash of the session id is
+// kept in the store, so content of the store can't be used to hijack sessions
+func getSessionKey(sessionID string) string {
+	return sessionKeyPrefix + utils.GetHashKey(sessionID)
+}
+
+// newServerSession builds the session from the tokens, session expires with the refresh
+// token if we have one, otherwise with the access token
+func (r *oauthProxy) newServerSession(accessToken, refreshToken, idToken string, accessExpiration time.Duration) (*serverSession, time.Duration) {
+	session := &serverSession{
+		AccessToken: accessToken,
+		IDToken:     idToken,
+	}
+
+	expiration := accessExpiration
+
+	if r.config.EnableRefreshTokens && refreshToken != "" {
+		session.RefreshToken = refreshToken
+		expiration = r.getAccessCookieExpiration(refreshToken)
+	}
+
+	return session, expiration
+}
+
+// createServerSession saves the session into the store and drops the session cookie
+func (r *oauthProxy) createServerSession(req *http.Request, wrt http.ResponseWriter, subject, sid string, session *serverSession, expiration time.Duration) error {
+	sessionID, err := newSessionID()
+
+	if err != nil {
+		return err
+	}
+
+	if err := r.saveServerSession(sessionID, session, expiration); err != nil {
+		return err
+	}
+
+	if err := r.addSessionToIndex(subject, sid, sessionKindServer, getSessionKey(sessionID), expiration); err != nil {
+		r.log.Warn("failed to add the session to the subject index", zap.Error(err))
+	}
+
+	r.dropSessionCookie(req, wrt, sessionID, expiration)
+
+	return nil
+}
+
+// saveServerSession encrypts the session and writes it to the store
+func (r *oauthProxy) saveServerSession(sessionID string, session *serverSession, expiration time.Duration) error {
+	content, err := json.Marshal(session)
+
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := encryption.EncodeText(string(content), r.config.EncryptionKey)
+
+	if err != nil {
+		return err
+	}
+
+	return r.store.Set(getSessionKey(sessionID), encrypted, expiration)
+}
+
+// loadServerSession retrieves the session from the store
+func (r *oauthProxy) loadServerSession(sessionID string) (*serverSession, error) {
+	return r.loadServerSessionByKey(getSessionKey(sessionID))
+}
+
+// loadServerSessionByKey retrieves the session from the store by the store key
+func (r *oauthProxy) loadServerSessionByKey(key string) (*serverSession, error) {
+	encrypted, err := r.store.Get(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if encrypted == "" {
+		return nil, apperrors.ErrNoSessionStateFound
+	}
+
+	content, err := encryption.DecodeText(encrypted, r.config.EncryptionKey)
+
+	if err != nil {
+		return nil, apperrors.ErrDecryption
+	}
+
+	session := &serverSession{}
+
+	if err := json.Unmarshal([]byte(content), session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// refreshServerSession replaces the tokens in the session, keeping the session id
+func (r *oauthProxy) refreshServerSession(sessionID, accessToken, refreshToken string, expiration time.Duration) error {
+	session, err := r.loadServerSession(sessionID)
+
+	if err != nil {
+		return err
+	}
+
+	session.AccessToken = accessToken
+
+	if refreshToken != "" {
+		session.RefreshToken = refreshToken
+	}
+
+	return r.saveServerSession(sessionID, session, expiration)
+}
+
+// deleteServerSession removes the session from the store
+func (r *oauthProxy) deleteServerSession(sessionID string) error {
+	return r.store.Delete(getSessionKey(sessionID))
+}
+
+// getSessionIDFromCookie retrieves the session id from the session cookie
+func (r *oauthProxy) getSessionIDFromCookie(req *http.Request) (string, error) {
+	cookie := utils.FindCookie(r.config.CookieSessionName, req.Cookies())
+
+	if cookie == nil || cookie.Value == "" {
+		return "", apperrors.ErrSessionNotFound
+	}
+
+	return cookie.Value, nil
+}
+
+// getTokenInSession returns the access token from the bearer header or the server side
+// session referenced by the session cookie
+func (r *oauthProxy) getTokenInSession(req *http.Request) (string, bool, string, error) {
+	if !r.config.SkipAuthorizationHeaderIdentity {
+		token, err := utils.GetTokenInBearer(req)
+
+		if err == nil {
+			return token, true, "", nil
+		}
+
+		if err != apperrors.ErrSessionNotFound {
+			return "", false, "", err
+		}
+	}
+
+	sessionID, err := r.getSessionIDFromCookie(req)
+
+	if err != nil {
+		return "", false, "", err
+	}
+
+	session, err := r.loadServerSession(sessionID)
+
+	if err != nil {
+		return "", false, "", err
+	}
+
+	return session.AccessToken, false, sessionID, nil
+}
@@ -0,0 +1,201 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeServerSessionConfig() *Config {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableServerSessions = true
+	cfg.EncryptionKey = testEncryptionKey
+	cfg.StoreURL = "memory://"
+
+	return cfg
+}
+
+func TestServerSessionLifecycle(t *testing.T) {
+	cfg := newFakeServerSessionConfig()
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer proxy.idp.Close()
+
+	token, err := newTestToken(proxy.idp.getLocation()).getToken()
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	session, _ := proxy.proxy.newServerSession(token, "", "id-token", time.Hour)
+
+	assert.NoError(t, proxy.proxy.createServerSession(req, recorder, "", "", session, time.Hour))
+
+	cookies := recorder.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, cfg.CookieSessionName, cookies[0].Name)
+
+	sessionID := cookies[0].Value
+	assert.NotContains(t, sessionID, ".")
+
+	// only hash of the session id is used as store key and tokens are encrypted
+	backend := proxy.proxy.store.(*resilientStore).store.(*storage.MemoryStore)
+	raw, err := backend.Get(getSessionKey(sessionID))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, raw)
+	assert.False(t, strings.Contains(raw, token))
+
+	exists, err := backend.Exists(sessionID)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+
+	user, err := proxy.proxy.getIdentity(req)
+	assert.NoError(t, err)
+	assert.Equal(t, sessionID, user.sessionID)
+	assert.Equal(t, token, user.rawToken)
+	assert.False(t, user.bearerToken)
+
+	assert.NoError(t, proxy.proxy.refreshServerSession(sessionID, "new-access", "new-refresh", time.Hour))
+
+	loaded, err := proxy.proxy.loadServerSession(sessionID)
+	assert.NoError(t, err)
+	assert.Equal(t, "new-access", loaded.AccessToken)
+	assert.Equal(t, "new-refresh", loaded.RefreshToken)
+	assert.Equal(t, "id-token", loaded.IDToken)
+
+	assert.NoError(t, proxy.proxy.deleteServerSession(sessionID))
+
+	_, err = proxy.proxy.getIdentity(req)
+	assert.ErrorIs(t, err, apperrors.ErrNoSessionStateFound)
+}
+
+// delayPastTokenExpiration waits until the access token issued with 1500ms expiration
+// has expired, while the refresh token (twice the expiration) is still valid
+func delayPastTokenExpiration(no int, req *resty.Request, resp *resty.Response) {
+	if no == 0 {
+		<-time.After(1600 * time.Millisecond)
+	}
+}
+
+func TestServerSessions(t *testing.T) {
+	cfg := newFakeServerSessionConfig()
+	var loginSessionID string
+
+	testCases := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name:          "TestServerSessionLogin",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           fakeAuthAllURL,
+					HasLogin:      true,
+					Redirects:     true,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						cfg.CookieSessionName: func(t *testing.T, c *Config, value string) bool {
+							return assert.NotEmpty(t, value) && assert.NotContains(t, value, ".")
+						},
+					},
+				},
+				{
+					URI:           fakeAuthAllURL,
+					Redirects:     false,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+		{
+			Name: "TestServerSessionRefreshKeepsSessionID",
+			ProxySettings: func(c *Config) {
+				c.EnableRefreshTokens = true
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           fakeAuthAllURL,
+					HasLogin:      true,
+					Redirects:     true,
+					OnResponse:    delayPastTokenExpiration,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						cfg.CookieSessionName: func(t *testing.T, c *Config, value string) bool {
+							loginSessionID = value
+							return value != ""
+						},
+					},
+				},
+				{
+					URI:           fakeAuthAllURL,
+					Redirects:     false,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						cfg.CookieSessionName: func(t *testing.T, c *Config, value string) bool {
+							return assert.Equal(t, loginSessionID, value)
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:          "TestServerSessionMissingSession",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI: fakeAuthAllURL,
+					Cookies: []*http.Cookie{
+						{Name: cfg.CookieSessionName, Value: "not-existing-session"},
+					},
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusUnauthorized,
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		cfgCopy := *cfg
+		c := &cfgCopy
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				testCase.ProxySettings(c)
+				p := newFakeProxy(c, &fakeAuthConfig{Expiration: 1500 * time.Millisecond})
+				p.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
@@ -1835,6 +1835,50 @@ func TestStoreAuthz(t *testing.T) {
 	}
 }
 
+func TestStoreAuthzWithPrefixAndEncryption(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	token := newTestToken("http://test")
+	jwt, err := token.getToken()
+
+	if err != nil {
+		t.Fatal("Testing token generation failed")
+	}
+
+	redisServer, err := miniredis.Run()
+
+	if err != nil {
+		t.Fatalf("Starting redis failed %s", err)
+	}
+
+	defer redisServer.Close()
+
+	cfg.StoreURL = fmt.Sprintf("redis://%s", redisServer.Addr())
+	cfg.StoreKeyPrefix = "app1:"
+	cfg.StoreEncryptionKey = testEncryptionKey
+	fProxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	url, err := url.Parse("http://test.com/test")
+
+	if err != nil {
+		t.Fatal("Problem parsing url")
+	}
+
+	err = fProxy.proxy.StoreAuthz(jwt, url, authorization.AllowedAuthz, 1*time.Second)
+	assert.NoError(t, err)
+
+	keys := redisServer.Keys()
+	assert.Len(t, keys, 1)
+	assert.True(t, strings.HasPrefix(keys[0], "app1:"))
+
+	raw, err := redisServer.Get(keys[0])
+	assert.NoError(t, err)
+	assert.NotEqual(t, authorization.AllowedAuthz.String(), raw)
+
+	decision, err := fProxy.proxy.GetAuthz(jwt, url)
+	assert.NoError(t, err)
+	assert.Equal(t, authorization.AllowedAuthz, decision)
+}
+
 //nolint:cyclop
 func TestGetAuthz(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
@@ -1864,6 +1908,21 @@ func TestGetAuthz(t *testing.T) {
 			},
 			JWT: jwt,
 		},
+		{
+			Name: "TestEntryInMemoryStore",
+			ProxySettings: func(conf *Config) {
+				conf.StoreURL = "memory://"
+			},
+			JWT: jwt,
+		},
+		{
+			Name: "TestEmptyResponseMemoryStore",
+			ProxySettings: func(conf *Config) {
+				conf.StoreURL = "memory://"
+			},
+			JWT:             jwt,
+			ExpectedFailure: true,
+		},
 		{
 			Name: "TestZeroLengthToken",
 			ProxySettings: func(conf *Config) {
@@ -33,37 +33,91 @@ import (
 // getIdentity retrieves the user identity from a request, either from a session cookie or a bearer token
 func (r *oauthProxy) getIdentity(req *http.Request) (*userContext, error) {
 	var isBearer bool
-	// step: check for a bearer token or cookie with jwt token
-	access, isBearer, err := utils.GetTokenInRequest(
-		req,
-		r.config.CookieAccessName,
-		r.config.SkipAuthorizationHeaderIdentity,
-	)
+	var isDPoP bool
+	var access string
+	var sessionID string
+	var err error
+
+	// step: check for an api key of the callers which cannot use oauth
+	if r.config.EnableAPIKeys {
+		if key := req.Header.Get(r.config.APIKeyHeader); key != "" {
+			return r.getAPIKeyIdentity(key)
+		}
+	}
+
+	// step: check for a sender constrained token
+	if r.config.EnableDPoP && !r.config.SkipAuthorizationHeaderIdentity {
+		access, isDPoP = getTokenInDPoP(req)
+	}
+
+	// step: check for a bearer token, server side session or cookie with jwt token
+	switch {
+	case isDPoP:
+		isBearer = true
+	case r.config.EnableServerSessions:
+		access, isBearer, sessionID, err = r.getTokenInSession(req)
+	default:
+		access, isBearer, err = utils.GetTokenInRequest(
+			req,
+			r.config.CookieAccessName,
+			r.config.SkipAuthorizationHeaderIdentity,
+		)
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie && !isBearer {
+	presented := access
+
+	// tokens in server side session are kept unencrypted within encrypted session
+	if sessionID == "" && (r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie && !isBearer) {
 		if access, err = encryption.DecodeText(access, r.config.EncryptionKey); err != nil {
 			return nil, apperrors.ErrDecryption
 		}
 	}
 
 	rawToken := access
-	token, err := jwt.ParseSigned(access)
+	// step: the claims of already verified tokens are not extracted again
+	user := r.getVerifiedIdentity(access)
 
-	if err != nil {
-		return nil, err
+	if user == nil {
+		var token *jwt.JSONWebToken
+
+		token, err = jwt.ParseSigned(access)
+
+		switch {
+		case err == nil:
+			if user, err = extractIdentity(token); err == nil {
+				user.issuer = r.getIssuerByURL(user.issuerURL)
+			}
+		case isBearer && r.config.EnableTokenIntrospection:
+			// step: opaque bearer tokens are validated by the provider
+			user, err = r.getIntrospectedIdentity(access)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		r.mapIdentityClaims(user)
 	}
 
-	user, err := extractIdentity(token)
-	if err != nil {
-		return nil, err
+	if r.config.EnableDPoP {
+		switch {
+		case isDPoP:
+			if err := r.verifyDPoPProof(req, user, presented); err != nil {
+				return nil, err
+			}
+		case getDPoPThumbprint(user) != "":
+			// step: bound tokens are accepted only with the proof of possession
+			return nil, fmt.Errorf("%w: bound access token without proof", apperrors.ErrInvalidDPoPProof)
+		}
 	}
 
 	user.bearerToken = isBearer
 	user.rawToken = rawToken
+	user.sessionID = sessionID
 
 	r.log.Debug("found the user identity",
 		zap.String("id", user.id),
@@ -75,42 +129,51 @@ func (r *oauthProxy) getIdentity(req *http.Request) (*userContext, error) {
 	return user, nil
 }
 
+// realmRoles are the roles of the realm access claim
+type realmRoles struct {
+	Roles []string `json:"roles"`
+}
+
+// custClaims are the non standard claims the user identity is made of
+type custClaims struct {
+	Email          string                    `json:"email"`
+	PrefName       string                    `json:"preferred_username"`
+	RealmAccess    realmRoles                `json:"realm_access"`
+	Groups         []string                  `json:"groups"`
+	ResourceAccess map[string]interface{}    `json:"resource_access"`
+	FamilyName     string                    `json:"family_name"`
+	GivenName      string                    `json:"given_name"`
+	Username       string                    `json:"username"`
+	Authorization  authorization.Permissions `json:"authorization"`
+	Sid            string                    `json:"sid"`
+	SessionState   string                    `json:"session_state"`
+}
+
 // extractIdentity parse the jwt token and extracts the various elements is order to construct
 func extractIdentity(token *jwt.JSONWebToken) (*userContext, error) {
-	stdClaims := &jwt.Claims{}
-
-	type RealmRoles struct {
-		Roles []string `json:"roles"`
-	}
+	jsonMap := make(map[string]interface{})
 
-	// Extract custom claims
-	type custClaims struct {
-		Email          string                    `json:"email"`
-		PrefName       string                    `json:"preferred_username"`
-		RealmAccess    RealmRoles                `json:"realm_access"`
-		Groups         []string                  `json:"groups"`
-		ResourceAccess map[string]interface{}    `json:"resource_access"`
-		FamilyName     string                    `json:"family_name"`
-		GivenName      string                    `json:"given_name"`
-		Username       string                    `json:"username"`
-		Authorization  authorization.Permissions `json:"authorization"`
+	if err := token.UnsafeClaimsWithoutVerification(&jsonMap); err != nil {
+		return nil, err
 	}
 
-	customClaims := custClaims{}
-
-	err := token.UnsafeClaimsWithoutVerification(stdClaims, &customClaims)
+	stdClaims, err := getStandardClaims(jsonMap)
 
 	if err != nil {
 		return nil, err
 	}
 
-	jsonMap := make(map[string]interface{})
-	err = token.UnsafeClaimsWithoutVerification(&jsonMap)
+	customClaims, err := getCustomClaims(jsonMap)
 
 	if err != nil {
 		return nil, err
 	}
 
+	return newUserContext(stdClaims, customClaims, jsonMap)
+}
+
+// newUserContext constructs the user identity from the claims
+func newUserContext(stdClaims *jwt.Claims, customClaims *custClaims, jsonMap map[string]interface{}) (*userContext, error) {
 	// @step: ensure we have and can extract the preferred name of the user, if not, we set to the ID
 	preferredName := customClaims.PrefName
 	if preferredName == "" {
@@ -145,14 +208,18 @@ func extractIdentity(token *jwt.JSONWebToken) (*userContext, error) {
 	}
 
 	return &userContext{
+		issuerURL:     stdClaims.Issuer,
 		audiences:     audiences,
 		email:         customClaims.Email,
 		expiresAt:     stdClaims.Expiry.Time(),
+		issuedAt:      stdClaims.IssuedAt.Time(),
 		groups:        customClaims.Groups,
 		id:            stdClaims.Subject,
 		name:          preferredName,
 		preferredName: preferredName,
 		roles:         roleList,
+		scopes:        getTokenScopes(jsonMap),
+		sessionState:  utils.DefaultTo(customClaims.Sid, customClaims.SessionState),
 		claims:        jsonMap,
 		permissions:   customClaims.Authorization,
 	}, nil
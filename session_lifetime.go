@@ -0,0 +1,215 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/encryption"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"go.uber.org/zap"
+)
+
+var (
+	errSessionIdleTimeout = errors.New("session has been idle for too long")
+	errSessionMaxLifetime = errors.New("session has reached the maximum lifetime")
+	errSessionBinding     = errors.New("session timestamps belong to other session")
+)
+
+// sessionTimestamps are the login and last seen times of the session
+type sessionTimestamps struct {
+	loginAt  time.Time
+	lastSeen time.Time
+	// binding is the hash of the subject and provider session the timestamps belong to
+	binding string
+}
+
+// getSessionBinding returns the binding of the timestamps to the session, the provider
+// session id is kept by the refreshed tokens, unlike the tokens themselves
+func getSessionBinding(subject, sessionState string) string {
+	return utils.GetHashKey(subject + ":" + sessionState)
+}
+
+// encodeSessionTimestamps encrypts the timestamps into the cookie value
+func encodeSessionTimestamps(stamps *sessionTimestamps, key string) (string, error) {
+	value := fmt.Sprintf("%d:%d:%s", stamps.loginAt.Unix(), stamps.lastSeen.Unix(), stamps.binding)
+	return encryption.EncodeText(value, key)
+}
+
+// decodeSessionTimestamps decrypts the timestamps from the cookie value
+func decodeSessionTimestamps(value, key string) (*sessionTimestamps, error) {
+	content, err := encryption.DecodeText(value, key)
+
+	if err != nil {
+		return nil, apperrors.ErrDecryption
+	}
+
+	items := strings.SplitN(content, ":", 3)
+
+	if len(items) != 3 || items[2] == "" {
+		return nil, apperrors.ErrInvalidSession
+	}
+
+	loginAt, err := strconv.ParseInt(items[0], 10, 64)
+
+	if err != nil {
+		return nil, apperrors.ErrInvalidSession
+	}
+
+	lastSeen, err := strconv.ParseInt(items[1], 10, 64)
+
+	if err != nil {
+		return nil, apperrors.ErrInvalidSession
+	}
+
+	return &sessionTimestamps{
+		loginAt:  time.Unix(loginAt, 0),
+		lastSeen: time.Unix(lastSeen, 0),
+		binding:  items[2],
+	}, nil
+}
+
+// useSessionTimestamps checks if idle timeout or maximum session lifetime is enforced
+func (r *oauthProxy) useSessionTimestamps() bool {
+	return r.config.SessionIdleTimeout > 0 || r.config.SessionMaxLifetime > 0
+}
+
+// checkSessionTimestamps enforces the idle timeout and maximum lifetime of the session
+func (r *oauthProxy) checkSessionTimestamps(stamps *sessionTimestamps, binding string, now time.Time) error {
+	if stamps.binding != binding {
+		return errSessionBinding
+	}
+
+	if r.config.SessionMaxLifetime > 0 && now.Sub(stamps.loginAt) > r.config.SessionMaxLifetime {
+		return errSessionMaxLifetime
+	}
+
+	if r.config.SessionIdleTimeout > 0 && now.Sub(stamps.lastSeen) > r.config.SessionIdleTimeout {
+		return errSessionIdleTimeout
+	}
+
+	return nil
+}
+
+// getSessionTimestamps retrieves the timestamps from the session timestamp cookie
+func (r *oauthProxy) getSessionTimestamps(req *http.Request) (*sessionTimestamps, error) {
+	cookie := utils.FindCookie(r.config.CookieSessionTimestampName, req.Cookies())
+
+	if cookie == nil || cookie.Value == "" {
+		return nil, apperrors.ErrSessionNotFound
+	}
+
+	return decodeSessionTimestamps(cookie.Value, r.config.EncryptionKey)
+}
+
+// dropSessionTimestampsCookie drops the session timestamp cookie, it expires when
+// either of the limits would be reached
+func (r *oauthProxy) dropSessionTimestampsCookie(req *http.Request, wrt http.ResponseWriter, stamps *sessionTimestamps) error {
+	value, err := encodeSessionTimestamps(stamps, r.config.EncryptionKey)
+
+	if err != nil {
+		return err
+	}
+
+	var expiration time.Duration
+
+	if r.config.SessionMaxLifetime > 0 {
+		expiration = time.Until(stamps.loginAt.Add(r.config.SessionMaxLifetime))
+	}
+
+	if r.config.SessionIdleTimeout > 0 {
+		idle := time.Until(stamps.lastSeen.Add(r.config.SessionIdleTimeout))
+
+		if expiration == 0 || idle < expiration {
+			expiration = idle
+		}
+	}
+
+	r.dropCookie(wrt, req.Host, r.config.CookieSessionTimestampName, value, expiration)
+
+	return nil
+}
+
+// startSessionTimestamps drops the session timestamp cookie on login
+func (r *oauthProxy) startSessionTimestamps(req *http.Request, wrt http.ResponseWriter, subject, sessionState string) error {
+	now := time.Now()
+
+	return r.dropSessionTimestampsCookie(req, wrt, &sessionTimestamps{
+		loginAt:  now,
+		lastSeen: now,
+		binding:  getSessionBinding(subject, sessionState),
+	})
+}
+
+// touchSessionTimestamps checks the session limits and updates the last seen time,
+// missing cookie ends the session, so limits can't be escaped by removing the cookie,
+// nor by presenting the cookie of other session
+func (r *oauthProxy) touchSessionTimestamps(req *http.Request, wrt http.ResponseWriter, user *userContext) error {
+	stamps, err := r.getSessionTimestamps(req)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	if err := r.checkSessionTimestamps(stamps, getSessionBinding(user.id, user.sessionState), now); err != nil {
+		return err
+	}
+
+	stamps.lastSeen = now
+
+	return r.dropSessionTimestampsCookie(req, wrt, stamps)
+}
+
+// clearSessionTimestampsCookie clears the session timestamp cookie
+func (r *oauthProxy) clearSessionTimestampsCookie(req *http.Request, wrt http.ResponseWriter) {
+	r.dropCookie(wrt, req.Host, r.config.CookieSessionTimestampName, "", -10*time.Hour)
+}
+
+// removeSessionState deletes the server side session or the refresh token kept in the
+// store, so the ended session can't be resumed with the tokens of the session
+func (r *oauthProxy) removeSessionState(user *userContext, logger *zap.Logger) {
+	if user.sessionID != "" {
+		if err := r.deleteServerSession(user.sessionID); err != nil {
+			logger.Error("failed to remove the server session", zap.Error(err))
+		}
+
+		if err := r.removeSessionFromIndex(user.id, getSessionKey(user.sessionID)); err != nil {
+			logger.Warn("failed to remove the session from subject index", zap.Error(err))
+		}
+
+		return
+	}
+
+	if !r.useStore() {
+		return
+	}
+
+	if err := r.DeleteRefreshToken(user.rawToken); err != nil {
+		logger.Error("failed to remove the refresh token from store", zap.Error(err))
+	}
+
+	if err := r.removeSessionFromIndex(user.id, utils.GetHashKey(user.rawToken)); err != nil {
+		logger.Warn("failed to remove the session from subject index", zap.Error(err))
+	}
+}
@@ -0,0 +1,273 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSessionBinding is the binding of the timestamps to the session of the test token
+var testSessionBinding = getSessionBinding(defTestTokenClaims.Sub, defTestTokenClaims.SessionState)
+
+func newTestSessionTimestampsCookie(t *testing.T, cfg *Config, loginAt, lastSeen time.Time) *http.Cookie {
+	return newTestBoundSessionTimestampsCookie(t, cfg, loginAt, lastSeen, testSessionBinding)
+}
+
+func newTestBoundSessionTimestampsCookie(t *testing.T, cfg *Config, loginAt, lastSeen time.Time, binding string) *http.Cookie {
+	value, err := encodeSessionTimestamps(
+		&sessionTimestamps{loginAt: loginAt, lastSeen: lastSeen, binding: binding},
+		testEncryptionKey,
+	)
+	assert.NoError(t, err)
+
+	return &http.Cookie{Name: cfg.CookieSessionTimestampName, Value: value}
+}
+
+func TestSessionTimestampsEncoding(t *testing.T) {
+	loginAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	lastSeen := time.Now().Truncate(time.Second)
+
+	value, err := encodeSessionTimestamps(
+		&sessionTimestamps{loginAt: loginAt, lastSeen: lastSeen, binding: testSessionBinding},
+		testEncryptionKey,
+	)
+	assert.NoError(t, err)
+
+	stamps, err := decodeSessionTimestamps(value, testEncryptionKey)
+	assert.NoError(t, err)
+	assert.True(t, loginAt.Equal(stamps.loginAt))
+	assert.True(t, lastSeen.Equal(stamps.lastSeen))
+	assert.Equal(t, testSessionBinding, stamps.binding)
+
+	_, err = decodeSessionTimestamps(value, "a9dIoeaaSqHvRKpIdSJxU8u9Lt0oHB7p")
+	assert.ErrorIs(t, err, apperrors.ErrDecryption)
+
+	_, err = decodeSessionTimestamps("not-encrypted", testEncryptionKey)
+	assert.Error(t, err)
+}
+
+func TestSessionLifetime(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EncryptionKey = testEncryptionKey
+	cfg.SessionIdleTimeout = time.Hour
+	cfg.SessionMaxLifetime = 8 * time.Hour
+
+	now := time.Now()
+
+	testCases := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name:          "TestLoginStartsSession",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           fakeAuthAllURL,
+					HasLogin:      true,
+					Redirects:     true,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						cfg.CookieSessionTimestampName: func(t *testing.T, c *Config, value string) bool {
+							stamps, err := decodeSessionTimestamps(value, testEncryptionKey)
+							return assert.NoError(t, err) &&
+								assert.WithinDuration(t, time.Now(), stamps.loginAt, time.Minute) &&
+								assert.Equal(t, testSessionBinding, stamps.binding)
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:          "TestActiveSessionIsTouched",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:            fakeAuthAllURL,
+					HasToken:       true,
+					HasCookieToken: true,
+					Cookies: []*http.Cookie{
+						newTestSessionTimestampsCookie(t, cfg, now.Add(-2*time.Hour), now.Add(-30*time.Minute)),
+					},
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						cfg.CookieSessionTimestampName: func(t *testing.T, c *Config, value string) bool {
+							stamps, err := decodeSessionTimestamps(value, testEncryptionKey)
+							return assert.NoError(t, err) &&
+								assert.WithinDuration(t, now.Add(-2*time.Hour), stamps.loginAt, time.Second) &&
+								assert.WithinDuration(t, time.Now(), stamps.lastSeen, time.Minute)
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:          "TestIdleSessionEnds",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:            fakeAuthAllURL,
+					HasToken:       true,
+					HasCookieToken: true,
+					Cookies: []*http.Cookie{
+						newTestSessionTimestampsCookie(t, cfg, now.Add(-2*time.Hour), now.Add(-2*time.Hour)),
+					},
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			Name:          "TestSessionOverMaxLifetimeEnds",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:            fakeAuthAllURL,
+					HasToken:       true,
+					HasCookieToken: true,
+					Cookies: []*http.Cookie{
+						newTestSessionTimestampsCookie(t, cfg, now.Add(-9*time.Hour), now.Add(-time.Minute)),
+					},
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			Name:          "TestTimestampsOfOtherSessionEndSession",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:            fakeAuthAllURL,
+					HasToken:       true,
+					HasCookieToken: true,
+					Cookies: []*http.Cookie{
+						newTestBoundSessionTimestampsCookie(
+							t,
+							cfg,
+							now.Add(-time.Minute),
+							now.Add(-time.Minute),
+							getSessionBinding(defTestTokenClaims.Sub, "other-session"),
+						),
+					},
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			Name:          "TestMissingTimestampsEndsSession",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:            fakeAuthAllURL,
+					HasToken:       true,
+					HasCookieToken: true,
+					ExpectedProxy:  false,
+					ExpectedCode:   http.StatusUnauthorized,
+				},
+			},
+		},
+		{
+			Name:          "TestBearerTokenIsNotLimited",
+			ProxySettings: func(c *Config) {},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           fakeAuthAllURL,
+					HasToken:      true,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+		{
+			Name: "TestOnlyIdleTimeout",
+			ProxySettings: func(c *Config) {
+				c.SessionMaxLifetime = 0
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:            fakeAuthAllURL,
+					HasToken:       true,
+					HasCookieToken: true,
+					Cookies: []*http.Cookie{
+						newTestSessionTimestampsCookie(t, cfg, now.Add(-100*time.Hour), now.Add(-time.Minute)),
+					},
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		cfgCopy := *cfg
+		c := &cfgCopy
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				testCase.ProxySettings(c)
+				p := newFakeProxy(c, &fakeAuthConfig{})
+				p.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
+
+func TestSessionLifetimeRemovesStoredRefreshToken(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EncryptionKey = testEncryptionKey
+	cfg.SessionIdleTimeout = time.Hour
+	cfg.EnableRefreshTokens = true
+	cfg.StoreURL = "memory://"
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	token, err := newTestToken(proxy.idp.getLocation()).getToken()
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.proxy.StoreRefreshToken(token, "refresh-token", time.Hour))
+
+	now := time.Now()
+
+	proxy.RunTests(t, []fakeRequest{
+		{
+			URI:            fakeAuthAllURL,
+			RawToken:       token,
+			HasCookieToken: true,
+			Cookies: []*http.Cookie{
+				newTestSessionTimestampsCookie(t, cfg, now.Add(-2*time.Hour), now.Add(-2*time.Hour)),
+			},
+			ExpectedProxy: false,
+			ExpectedCode:  http.StatusUnauthorized,
+		},
+	})
+
+	value, err := proxy.proxy.store.Get(utils.GetHashKey(token))
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+}
@@ -269,6 +269,11 @@ func TestGetUserContext(t *testing.T) {
 	assert.Equal(t, "gambol99@gmail.com", context.email)
 	assert.Equal(t, "rjayawardene", context.preferredName)
 	assert.Equal(t, append(realmRoles, clientRoles...), context.roles)
+	assert.Equal(t, []string{"test"}, context.audiences)
+	assert.False(t, context.issuedAt.IsZero())
+	assert.True(t, context.expiresAt.After(time.Now()))
+	assert.Equal(t, "98f4c3d2-1b8c-4932-b8c4-92ec0ea7e195", context.sessionState)
+	assert.Equal(t, "1e11e539-8256-4b3b-bda8-cc0d56cddb48", context.claims["sub"])
 }
 
 func TestGetUserRealmRoleContext(t *testing.T) {
@@ -23,8 +23,10 @@ import (
 
 	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
 	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
+	"github.com/gogatekeeper/gatekeeper/pkg/storage"
 	"github.com/gogatekeeper/gatekeeper/pkg/utils"
 
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
@@ -33,6 +35,20 @@ func (r *oauthProxy) useStore() bool {
 	return r.store != nil
 }
 
+// useStoreForRefreshTokens checks if the refresh tokens should be kept in the store,
+// while the store circuit breaker is open we fall back to the encrypted cookie
+func (r *oauthProxy) useStoreForRefreshTokens() bool {
+	if !r.useStore() {
+		return false
+	}
+
+	if store, ok := r.store.(*resilientStore); ok {
+		return store.Available()
+	}
+
+	return true
+}
+
 // StoreRefreshToken the token to the store
 func (r *oauthProxy) StoreRefreshToken(token string, value string, expiration time.Duration) error {
 	return r.store.Set(utils.GetHashKey(token), value, expiration)
@@ -113,11 +129,30 @@ func (r *oauthProxy) GetAuthz(token string, url *url.URL) (authorization.AuthzDe
 	return authorization.AuthzDecision(decision), nil
 }
 
-// Close is used to close off any resources
+// Close is used to close off any resources, all of them are closed even when some fail
 func (r *oauthProxy) CloseStore() error {
+	var err error
+
+	// the in memory caches are used only without store
+	for _, cache := range []storage.Storage{r.introspectionCache, r.proactiveRefreshes, r.dpopReplayCache} {
+		if cache != nil && cache != r.store {
+			err = multierr.Append(err, cache.Close())
+		}
+	}
+
+	for _, cache := range []storage.Storage{r.exchangeCache, r.basicAuthCache} {
+		if cache != nil {
+			err = multierr.Append(err, cache.Close())
+		}
+	}
+
 	if r.store != nil {
-		return r.store.Close()
+		err = multierr.Append(err, r.store.Close())
 	}
 
-	return nil
+	if r.apiKeys != nil {
+		err = multierr.Append(err, r.apiKeys.close())
+	}
+
+	return err
 }
@@ -0,0 +1,75 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClosingStore is a memory store recording its close, which fails with the given error
+type fakeClosingStore struct {
+	storage.Storage
+	err    error
+	closed bool
+}
+
+func newFakeClosingStore(err error) *fakeClosingStore {
+	return &fakeClosingStore{Storage: storage.NewMemoryStore(10, time.Minute), err: err}
+}
+
+func (f *fakeClosingStore) Close() error {
+	f.closed = true
+
+	if err := f.Storage.Close(); err != nil {
+		return err
+	}
+
+	return f.err
+}
+
+func TestCloseStoreClosesAll(t *testing.T) {
+	errCache := errors.New("cache close failed")
+	errStore := errors.New("store close failed")
+
+	introspection := newFakeClosingStore(errCache)
+	exchange := newFakeClosingStore(nil)
+	basic := newFakeClosingStore(nil)
+	store := newFakeClosingStore(errStore)
+
+	proxy := &oauthProxy{
+		introspectionCache: introspection,
+		dpopReplayCache:    store,
+		exchangeCache:      exchange,
+		basicAuthCache:     basic,
+		store:              store,
+	}
+
+	err := proxy.CloseStore()
+	assert.ErrorIs(t, err, errCache)
+	assert.ErrorIs(t, err, errStore)
+
+	for _, closing := range []*fakeClosingStore{introspection, exchange, basic, store} {
+		assert.True(t, closing.closed)
+	}
+}
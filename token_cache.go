@@ -0,0 +1,154 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+)
+
+// verifiedTokenEntry is the identity of the verified token, valid until the token expires
+type verifiedTokenEntry struct {
+	key       string
+	user      *userContext
+	expiresAt time.Time
+}
+
+// verifiedTokenCache is bounded lru cache of the identities of verified tokens, keyed by
+// the hash of the token
+type verifiedTokenCache struct {
+	sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// newVerifiedTokenCache returns the cache holding at most size identities
+func newVerifiedTokenCache(size int) *verifiedTokenCache {
+	return &verifiedTokenCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the identity of the token hash, nil when it is not cached or has expired
+func (c *verifiedTokenCache) get(key string) *userContext {
+	c.Lock()
+	defer c.Unlock()
+
+	element, found := c.entries[key]
+
+	if !found {
+		return nil
+	}
+
+	entry, _ := element.Value.(*verifiedTokenEntry)
+
+	if !time.Now().Before(entry.expiresAt) {
+		c.removeElement(element)
+		return nil
+	}
+
+	c.order.MoveToFront(element)
+
+	return entry.user
+}
+
+// set adds the identity of the token hash, evicting the least recently used one when full
+func (c *verifiedTokenCache) set(key string, user *userContext, expiresAt time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if element, found := c.entries[key]; found {
+		element.Value = &verifiedTokenEntry{key: key, user: user, expiresAt: expiresAt}
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&verifiedTokenEntry{key: key, user: user, expiresAt: expiresAt})
+
+	for c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// delete removes the identity of the token hash
+func (c *verifiedTokenCache) delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if element, found := c.entries[key]; found {
+		c.removeElement(element)
+	}
+}
+
+// len returns the number of cached identities
+func (c *verifiedTokenCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *verifiedTokenCache) removeElement(element *list.Element) {
+	entry, _ := c.order.Remove(element).(*verifiedTokenEntry)
+	delete(c.entries, entry.key)
+}
+
+// getVerifiedIdentity returns copy of the cached identity of the verified token
+func (r *oauthProxy) getVerifiedIdentity(token string) *userContext {
+	if r.verifiedTokens == nil {
+		return nil
+	}
+
+	cached := r.verifiedTokens.get(utils.GetHashKey(token))
+
+	if cached == nil {
+		verifiedTokenCacheMetric.WithLabelValues("miss").Inc()
+		return nil
+	}
+
+	verifiedTokenCacheMetric.WithLabelValues("hit").Inc()
+
+	user := *cached
+
+	return &user
+}
+
+// cacheVerifiedIdentity keeps the identity of the verified token until the token expires
+func (r *oauthProxy) cacheVerifiedIdentity(user *userContext) {
+	if r.verifiedTokens == nil || user.introspected || user.expiresAt.IsZero() {
+		return
+	}
+
+	cached := *user
+	cached.verified = true
+
+	r.verifiedTokens.set(utils.GetHashKey(user.rawToken), &cached, user.expiresAt)
+}
+
+// forgetVerifiedIdentity removes the identity of the token hash, on logout or revocation
+func (r *oauthProxy) forgetVerifiedIdentity(hash string) {
+	if r.verifiedTokens == nil {
+		return
+	}
+
+	r.verifiedTokens.delete(hash)
+}
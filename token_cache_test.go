@@ -0,0 +1,119 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/constant"
+	"github.com/gogatekeeper/gatekeeper/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifiedTokenCacheEviction(t *testing.T) {
+	cache := newVerifiedTokenCache(2)
+	expiresAt := time.Now().Add(time.Hour)
+
+	cache.set("first", &userContext{id: "first"}, expiresAt)
+	cache.set("second", &userContext{id: "second"}, expiresAt)
+
+	// step: the first entry becomes the most recently used one
+	assert.NotNil(t, cache.get("first"))
+
+	cache.set("third", &userContext{id: "third"}, expiresAt)
+
+	assert.Equal(t, 2, cache.len())
+	assert.NotNil(t, cache.get("first"))
+	assert.Nil(t, cache.get("second"))
+	assert.NotNil(t, cache.get("third"))
+
+	cache.delete("first")
+
+	assert.Nil(t, cache.get("first"))
+	assert.Equal(t, 1, cache.len())
+}
+
+func TestVerifiedTokenCacheExpiration(t *testing.T) {
+	cache := newVerifiedTokenCache(2)
+
+	cache.set("expired", &userContext{id: "expired"}, time.Now().Add(-time.Second))
+
+	assert.Nil(t, cache.get("expired"))
+	assert.Equal(t, 0, cache.len())
+}
+
+func TestVerifiedTokenCacheRequests(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.VerifiedTokenCacheSize = 10
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	token, err := newTestToken(proxy.idp.getLocation()).getToken()
+	assert.NoError(t, err)
+
+	hits := testutil.ToFloat64(verifiedTokenCacheMetric.WithLabelValues("hit"))
+	misses := testutil.ToFloat64(verifiedTokenCacheMetric.WithLabelValues("miss"))
+
+	proxy.RunTests(t, []fakeRequest{
+		{
+			URI:           "/auth_all/test",
+			RawToken:      token,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/auth_all/test",
+			RawToken:      token,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedContent: func(body string, testNum int) {
+				assert.Equal(t, 1, proxy.proxy.verifiedTokens.len())
+			},
+		},
+		{
+			URI:          cfg.WithOAuthURI(constant.LogoutURL),
+			RawToken:     token,
+			ExpectedCode: http.StatusOK,
+		},
+	})
+
+	// step: the logout is authenticated and gets the identity from the cache too
+	assert.Equal(t, misses+1, testutil.ToFloat64(verifiedTokenCacheMetric.WithLabelValues("miss")))
+	assert.Equal(t, hits+3, testutil.ToFloat64(verifiedTokenCacheMetric.WithLabelValues("hit")))
+	assert.Equal(t, 0, proxy.proxy.verifiedTokens.len())
+	assert.Nil(t, proxy.proxy.verifiedTokens.get(utils.GetHashKey(token)))
+}
+
+func TestVerifiedTokenCacheDisabled(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	proxy.RunTests(t, []fakeRequest{
+		{
+			URI:           "/auth_all/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	})
+
+	assert.Nil(t, proxy.proxy.verifiedTokens)
+}